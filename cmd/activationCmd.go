@@ -0,0 +1,88 @@
+/*
+   Pilot Host Controller
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"os"
+	"southwinds.dev/artisan/core"
+	core2 "southwinds.dev/piloth/core"
+	"text/tabwriter"
+	"time"
+)
+
+// ActivationCmd groups the activation key commands
+type ActivationCmd struct {
+	cmd *cobra.Command
+}
+
+func NewActivationCmd() *ActivationCmd {
+	c := &ActivationCmd{
+		cmd: &cobra.Command{
+			Use:   "activation",
+			Short: "manages the host activation",
+			Long:  `manages the host activation`,
+		},
+	}
+	return c
+}
+
+// ActivationShowCmd shows the activation key information and trusted verification keys
+type ActivationShowCmd struct {
+	cmd *cobra.Command
+}
+
+func NewActivationShowCmd() *ActivationShowCmd {
+	c := &ActivationShowCmd{
+		cmd: &cobra.Command{
+			Use:   "show",
+			Short: "shows the activation information and the trusted verification keys",
+			Long:  `shows the activation information and the trusted verification keys`,
+		},
+	}
+	c.cmd.Run = c.Run
+	return c
+}
+
+func (c *ActivationShowCmd) Run(_ *cobra.Command, _ []string) {
+	ak, err := core2.LoadActivationKey()
+	core.CheckErr(err, "cannot load activation key")
+	core2.A = ak
+	fmt.Printf("host uuid:  %s\n", ak.HostUUID)
+	fmt.Printf("device id:  %s\n", ak.DeviceId)
+	fmt.Printf("control:    %s\n", ak.CtlURI)
+	fmt.Printf("expiry:     %s\n\n", ak.Expiry.Format(time.RFC3339))
+	keys, err := core2.TrustedKeys()
+	core.CheckErr(err, "cannot load verification keys")
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "FINGERPRINT\tSOURCE\tNOT BEFORE\tNOT AFTER\tVALID")
+	now := time.Now()
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%t\n", key.Fingerprint(), key.Source, fmtTime(key.NotBefore), fmtTime(key.NotAfter), key.ValidAt(now))
+	}
+	w.Flush()
+}
+
+func fmtTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
@@ -0,0 +1,68 @@
+/*
+   Pilot Host Controller
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"os"
+	core2 "southwinds.dev/piloth/core"
+)
+
+// AuditCmd groups the audit log commands
+type AuditCmd struct {
+	cmd *cobra.Command
+}
+
+func NewAuditCmd() *AuditCmd {
+	c := &AuditCmd{
+		cmd: &cobra.Command{
+			Use:   "audit",
+			Short: "manages the host audit log",
+			Long:  `manages the host audit log`,
+		},
+	}
+	return c
+}
+
+// AuditVerifyCmd checks the integrity of the audit log hash chain
+type AuditVerifyCmd struct {
+	cmd *cobra.Command
+}
+
+func NewAuditVerifyCmd() *AuditVerifyCmd {
+	c := &AuditVerifyCmd{
+		cmd: &cobra.Command{
+			Use:   "verify",
+			Short: "verifies the integrity of the audit log",
+			Long:  `verifies the hash chain of the audit log and reports any gap, modification or truncation`,
+		},
+	}
+	c.cmd.Run = c.Run
+	return c
+}
+
+func (c *AuditVerifyCmd) Run(_ *cobra.Command, _ []string) {
+	count, err := core2.VerifyAuditLog(core2.DefaultStateDir().Audit())
+	if err != nil {
+		fmt.Printf("audit log verification failed after %d record(s): %s\n", count, err)
+		os.Exit(1)
+	}
+	fmt.Printf("audit log verified, %d record(s)\n", count)
+}
@@ -22,6 +22,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/spf13/cobra"
+	"os"
 	"southwinds.dev/artisan/core"
 	ctl "southwinds.dev/pilotctl/types"
 	core2 "southwinds.dev/piloth/core"
@@ -37,8 +38,9 @@ func NewConfigCmd() *ConfigCmd {
 	c := &ConfigCmd{
 		cmd: &cobra.Command{
 			Use:   "config [host-uuid|mac-addr|hw-id|machine-id|ALL]",
-			Short: "retrieves host/device configuration",
-			Long:  `retrieves host/device configuration`,
+			Short: "retrieves host/device configuration and checks the pilot configuration",
+			Long: `retrieves host/device configuration
+use the validate and effective sub-commands to check the pilot configuration`,
 		},
 	}
 	c.cmd.Run = c.Run
@@ -91,8 +93,72 @@ func (c *ConfigCmd) Run(cmd *cobra.Command, args []string) {
 	}
 }
 
+// ConfigValidateCmd validates the pilot configuration
+type ConfigValidateCmd struct {
+	cmd  *cobra.Command
+	file string
+}
+
+func NewConfigValidateCmd() *ConfigValidateCmd {
+	c := &ConfigValidateCmd{
+		cmd: &cobra.Command{
+			Use:   "validate [flags]",
+			Short: "validates the pilot configuration",
+			Long:  `validates the pilot configuration resulting from the configuration file and environment variables`,
+		},
+	}
+	c.cmd.Flags().StringVarP(&c.file, "config", "c", "", "the configuration file (yaml or toml); overrides PILOT_CONFIG")
+	c.cmd.Run = c.Run
+	return c
+}
+
+func (c *ConfigValidateCmd) Run(_ *cobra.Command, _ []string) {
+	settings, err := core2.LoadSettings(c.file)
+	if err == nil {
+		err = settings.Validate()
+	}
+	if err != nil {
+		fmt.Printf("%s\n", err)
+		os.Exit(1)
+	}
+	if len(settings.File()) > 0 {
+		fmt.Printf("configuration in %s is valid\n", settings.File())
+	} else {
+		fmt.Printf("no configuration file found, default configuration and environment variables are valid\n")
+	}
+}
+
+// ConfigEffectiveCmd prints the configuration pilot would use
+type ConfigEffectiveCmd struct {
+	cmd    *cobra.Command
+	file   string
+	format string
+}
+
+func NewConfigEffectiveCmd() *ConfigEffectiveCmd {
+	c := &ConfigEffectiveCmd{
+		cmd: &cobra.Command{
+			Use:   "effective [flags]",
+			Short: "prints the effective pilot configuration",
+			Long: `prints the pilot configuration after applying, in order, the defaults, the configuration file and environment variables
+note: flags passed to the launch command are applied last and are not included`,
+		},
+	}
+	c.cmd.Flags().StringVarP(&c.file, "config", "c", "", "the configuration file (yaml or toml); overrides PILOT_CONFIG")
+	c.cmd.Flags().StringVarP(&c.format, "output", "o", "yaml", "the output format: yaml, toml or json")
+	c.cmd.Run = c.Run
+	return c
+}
+
+func (c *ConfigEffectiveCmd) Run(_ *cobra.Command, _ []string) {
+	settings, err := core2.LoadSettings(c.file)
+	core.CheckErr(err, "cannot load configuration")
+	out, err := settings.Marshal(c.format)
+	core.CheckErr(err, "cannot print configuration")
+	fmt.Printf("%s", out)
+}
+
 func hostUUID() string {
-	core2.TRA, core2.CE = core2.NewTracer(false)
 	var (
 		ak  *core2.AKInfo
 		err error
@@ -100,7 +166,7 @@ func hostUUID() string {
 	// prints the host UUID
 	ak, err = core2.LoadActivationKey()
 	if err != nil {
-		core.InfoLogger.Printf("Host UUID is unknown: %s\n", err)
+		core2.InfoLogger.Printf("Host UUID is unknown: %s\n", err)
 		return "unknown"
 	}
 	return ak.HostUUID
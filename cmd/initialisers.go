@@ -22,9 +22,31 @@ func InitialiseRootCmd() *RootCmd {
 	rootCmd := NewRootCmd()
 	launchCmd := NewLaunchCmd()
 	configCmd := NewConfigCmd()
+	configValidateCmd := NewConfigValidateCmd()
+	configEffectiveCmd := NewConfigEffectiveCmd()
+	activationCmd := NewActivationCmd()
+	activationShowCmd := NewActivationShowCmd()
+	auditCmd := NewAuditCmd()
+	auditVerifyCmd := NewAuditVerifyCmd()
+	statusCmd := NewStatusCmd()
+	healthCmd := NewHealthCmd()
 	rootCmd.Cmd.AddCommand(
 		launchCmd.cmd,
 		configCmd.cmd,
+		activationCmd.cmd,
+		auditCmd.cmd,
+		statusCmd.cmd,
+		healthCmd.cmd,
+	)
+	configCmd.cmd.AddCommand(
+		configValidateCmd.cmd,
+		configEffectiveCmd.cmd,
+	)
+	activationCmd.cmd.AddCommand(
+		activationShowCmd.cmd,
+	)
+	auditCmd.cmd.AddCommand(
+		auditVerifyCmd.cmd,
 	)
 	return rootCmd
 }
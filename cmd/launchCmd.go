@@ -20,16 +20,19 @@ package cmd
 
 import (
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"southwinds.dev/artisan/core"
 	ctl "southwinds.dev/pilotctl/types"
 	pilotCore "southwinds.dev/piloth/core"
+	"time"
 )
 
 // LaunchCmd launches host pilot
 type LaunchCmd struct {
 	cmd                *cobra.Command
+	configFile         string // the configuration file, overrides PILOT_CONFIG
 	useHwId            bool   // use hardware uuid to identify device (instead of primary mac address)
-	tracing            bool   // enables tracing
+	tracing            bool   // writes spans to the trace folder, unless a span exporter is configured
 	telemetry          bool   // enables telemetry file upload
 	cpu                *bool  // enables cpu profiling
 	mem                *bool  // enables memory profiling
@@ -43,11 +46,13 @@ func NewLaunchCmd() *LaunchCmd {
 		cmd: &cobra.Command{
 			Use:   "launch [flags]",
 			Short: "launches host pilot",
-			Long:  `launches host pilot`,
+			Long: `launches host pilot
+flags override the configuration file and environment variables, see 'pilot config effective'`,
 		},
 	}
+	c.cmd.Flags().StringVarP(&c.configFile, "config", "c", "", "the configuration file (yaml or toml); overrides PILOT_CONFIG")
 	c.cmd.Flags().BoolVarP(&c.useHwId, "hw-id", "w", false, "use hardware uuid to identify device(instead of primary mac address)")
-	c.cmd.Flags().BoolVarP(&c.tracing, "trace", "t", false, "enables tracing")
+	c.cmd.Flags().BoolVarP(&c.tracing, "trace", "t", false, "writes spans to the trace folder, unless tracing.exporter is set to otlp")
 	c.cmd.Flags().BoolVarP(&c.telemetry, "telemetry", "m", false, "enables the upload of telemetry information to pilot control")
 	c.cpu = c.cmd.Flags().Bool("cpu", false, "enables cpu profiling only; cannot profile memory")
 	c.mem = c.cmd.Flags().Bool("mem", false, "enables memory profiling only; cannot profile cpu")
@@ -58,7 +63,19 @@ func NewLaunchCmd() *LaunchCmd {
 	return c
 }
 
-func (c *LaunchCmd) Run(_ *cobra.Command, _ []string) {
+func (c *LaunchCmd) Run(cmd *cobra.Command, _ []string) {
+	// resolves the configuration from the defaults, configuration file, environment and flags
+	load := func() (*pilotCore.Settings, error) {
+		s, err := pilotCore.LoadSettings(c.configFile)
+		if err != nil {
+			return nil, err
+		}
+		c.override(cmd.Flags(), s)
+		return s, s.Validate()
+	}
+	settings, err := load()
+	core.CheckErr(err, "cannot launch pilot")
+	pilotCore.SetSettings(settings)
 	// collects device/host information
 	hostInfo, err := ctl.NewHostInfo()
 	if err != nil {
@@ -66,17 +83,39 @@ func (c *LaunchCmd) Run(_ *cobra.Command, _ []string) {
 	}
 	// creates pilot instance
 	p, err := pilotCore.NewPilot(pilotCore.PilotOptions{
-		UseHwId:            c.useHwId,
-		Telemetry:          c.telemetry,
-		Tracing:            c.tracing,
+		UseHwId:            settings.Identity.UseHwId,
+		Telemetry:          settings.Telemetry.Enabled,
 		Info:               hostInfo,
 		CPU:                *c.cpu,
 		MEM:                *c.mem,
-		InsecureSkipVerify: c.insecureSkipVerify,
-		CVEPath:            c.cvePath,
-		CVEUploadDelay:     *c.cveUploadDelayMins,
+		InsecureSkipVerify: settings.TLS.InsecureSkipVerify,
+		CVEPath:            settings.Paths.CVE,
+		CVEUploadDelay:     int(settings.Intervals.CVEUploadDelay.Duration() / time.Minute),
+		LoadSettings:       load,
 	})
 	core.CheckErr(err, "cannot start pilot")
 	// start the pilot
 	p.Start()
 }
+
+// override applies the flags explicitly set in the command line, which take precedence over any other source
+func (c *LaunchCmd) override(flags *pflag.FlagSet, s *pilotCore.Settings) {
+	if flags.Changed("hw-id") {
+		s.Identity.UseHwId = c.useHwId
+	}
+	if flags.Changed("trace") && c.tracing && s.Tracing.Exporter == pilotCore.TraceExporterNone {
+		s.Tracing.Exporter = pilotCore.TraceExporterFile
+	}
+	if flags.Changed("telemetry") {
+		s.Telemetry.Enabled = c.telemetry
+	}
+	if flags.Changed("insecureSkipVerify") {
+		s.TLS.InsecureSkipVerify = c.insecureSkipVerify
+	}
+	if flags.Changed("cve-path") {
+		s.Paths.CVE = c.cvePath
+	}
+	if flags.Changed("cve-up-delay") {
+		s.Intervals.CVEUploadDelay = pilotCore.Duration(time.Duration(*c.cveUploadDelayMins) * time.Minute)
+	}
+}
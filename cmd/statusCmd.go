@@ -0,0 +1,150 @@
+/*
+   Pilot Host Controller
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/cobra"
+	"os"
+	core2 "southwinds.dev/piloth/core"
+	"text/tabwriter"
+	"time"
+)
+
+// StatusCmd shows the status of the running pilot
+type StatusCmd struct {
+	cmd    *cobra.Command
+	format string
+}
+
+func NewStatusCmd() *StatusCmd {
+	c := &StatusCmd{
+		cmd: &cobra.Command{
+			Use:   "status [flags]",
+			Short: "shows the status of the running pilot",
+			Long: `shows the status of the running pilot using its local status API
+it does not require network access`,
+		},
+	}
+	c.cmd.Flags().StringVarP(&c.format, "output", "o", "text", "the output format: text or json")
+	c.cmd.Run = c.Run
+	return c
+}
+
+func (c *StatusCmd) Run(_ *cobra.Command, _ []string) {
+	s, err := core2.GetStatus(core2.StatusSocket())
+	if err != nil {
+		fmt.Printf("%s\n", err)
+		os.Exit(2)
+	}
+	if c.format == "json" {
+		b, _ := json.MarshalIndent(s, "", "  ")
+		fmt.Printf("%s\n", b)
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "version:\t%s\n", s.Version)
+	fmt.Fprintf(w, "host uuid:\t%s\n", s.HostUUID)
+	fmt.Fprintf(w, "started:\t%s\n", s.Started.Format(time.RFC3339))
+	fmt.Fprintf(w, "connected:\t%t\n", s.Connected)
+	fmt.Fprintf(w, "control:\t%s\n", s.ControlURI)
+	fmt.Fprintf(w, "last ping:\t%s\n", fmtTimePtr(s.LastPing))
+	fmt.Fprintf(w, "ping interval:\t%s\n", s.PingInterval.Duration())
+	fmt.Fprintf(w, "activation expiry:\t%s\n", fmtTimePtr(s.ActivationExpiry))
+	if s.RunningJob != nil {
+		fmt.Fprintf(w, "running job:\t#%d %s -> %s since %s\n", s.RunningJob.JobId, s.RunningJob.Package, s.RunningJob.Function, s.RunningJob.Started.Format(time.RFC3339))
+	} else {
+		fmt.Fprintf(w, "running job:\tnone\n")
+	}
+	fmt.Fprintf(w, "queued jobs:\t%d\n", s.Queues.Jobs)
+	fmt.Fprintf(w, "queued results:\t%d\n", s.Queues.Results)
+	fmt.Fprintf(w, "queued events:\t%d\n", s.Queues.Events)
+	fmt.Fprintf(w, "quarantined jobs:\t%d\n", s.Queues.Quarantined)
+	if s.CVE.Enabled {
+		fmt.Fprintf(w, "cve exporter:\t%d report(s) pending in %s, upload delay up to %s\n", s.CVE.Pending, s.CVE.Path, s.CVE.UploadDelay.Duration())
+		fmt.Fprintf(w, "cve retrying:\t%d report(s), next retry %s\n", s.CVE.Retrying, fmtTimePtr(s.CVE.NextRetry))
+		if len(s.CVE.LastError) > 0 {
+			fmt.Fprintf(w, "cve last error:\t%s\n", s.CVE.LastError)
+		}
+		fmt.Fprintf(w, "cve failed:\t%d report(s)\n", s.CVE.Failed)
+	} else {
+		fmt.Fprintf(w, "cve exporter:\tdisabled\n")
+	}
+	w.Flush()
+	if len(s.Telemetry) > 0 {
+		fmt.Println()
+		w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "TELEMETRY\tCHANNEL\tBACKLOG\tQUARANTINED\tHEALTH\tERROR")
+		for _, ch := range s.Telemetry {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\t%s\n", ch.Type, ch.Channel, ch.Backlog, ch.Quarantined, ch.Health, ch.Error)
+		}
+		w.Flush()
+	}
+}
+
+// HealthCmd checks the health of the running pilot
+type HealthCmd struct {
+	cmd    *cobra.Command
+	format string
+}
+
+func NewHealthCmd() *HealthCmd {
+	c := &HealthCmd{
+		cmd: &cobra.Command{
+			Use:   "health [flags]",
+			Short: "checks the health of the running pilot",
+			Long: `checks the health of the running pilot using its local status API
+exits with 0 if pilot is healthy or has warnings, 1 if a check fails and 2 if pilot cannot be reached`,
+		},
+	}
+	c.cmd.Flags().StringVarP(&c.format, "output", "o", "text", "the output format: text or json")
+	c.cmd.Run = c.Run
+	return c
+}
+
+func (c *HealthCmd) Run(_ *cobra.Command, _ []string) {
+	h, err := core2.GetHealth(core2.StatusSocket())
+	if err != nil {
+		fmt.Printf("%s\n", err)
+		os.Exit(2)
+	}
+	if c.format == "json" {
+		b, _ := json.MarshalIndent(h, "", "  ")
+		fmt.Printf("%s\n", b)
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "CHECK\tSTATUS\tMESSAGE")
+		for _, check := range h.Checks {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", check.Name, check.Status, check.Message)
+		}
+		w.Flush()
+		fmt.Printf("\npilot health: %s\n", h.Status)
+	}
+	if h.Status == core2.HealthFail {
+		os.Exit(1)
+	}
+}
+
+func fmtTimePtr(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
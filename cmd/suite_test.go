@@ -35,7 +35,6 @@ func TestStart(t *testing.T) {
 	p, err := pilotCore.NewPilot(pilotCore.PilotOptions{
 		UseHwId:            false,
 		Telemetry:          true,
-		Tracing:            false,
 		Info:               hostInfo,
 		CPU:                false,
 		MEM:                false,
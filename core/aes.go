@@ -108,7 +108,10 @@ func (c AesCrypto) Decrypt(cipherText string, key []byte) (string, error) {
 		return "", err
 	}
 
-	encryptedBytes, iv, tagSize := c.UnpackCipherData(data)
+	encryptedBytes, iv, tagSize, err := c.UnpackCipherData(data)
+	if err != nil {
+		return "", err
+	}
 
 	aes, err := aes.NewCipher(key)
 	if err != nil {
@@ -129,6 +132,10 @@ func DecryptGcm(aes cipher.Block, encrypted []byte, nonce []byte, tagSize int) (
 	if err != nil {
 		return "", err
 	}
+	// Open panics if the nonce size is wrong
+	if len(nonce) != aesgcm.NonceSize() {
+		return "", fmt.Errorf("invalid GCM nonce size %d", len(nonce))
+	}
 	decryptedBytes, err := aesgcm.Open(nil, nonce, encrypted, nil)
 	if err != nil {
 		return "", err
@@ -137,6 +144,10 @@ func DecryptGcm(aes cipher.Block, encrypted []byte, nonce []byte, tagSize int) (
 }
 
 func DecryptCbc(aes cipher.Block, encrypted []byte, iv []byte) (string, error) {
+	// the decrypter panics if the iv size is wrong or the data is not made of full blocks
+	if len(iv) != aes.BlockSize() || len(encrypted)%aes.BlockSize() != 0 {
+		return "", fmt.Errorf("invalid CBC cipher data")
+	}
 	decryptor := cipher.NewCBCDecrypter(aes, iv)
 
 	decryptedBytes := make([]byte, len(encrypted))
@@ -174,7 +185,16 @@ func (c AesCrypto) PackCipherData(cipherText []byte, iv []byte, tagSize int) str
 	return base64.StdEncoding.EncodeToString(data)
 }
 
-func (c AesCrypto) UnpackCipherData(data []byte) ([]byte, []byte, int) {
+// UnpackCipherData splits packed cipher data into the encrypted bytes, the iv and the tag size
+// truncated or corrupted data returns an error
+func (c AesCrypto) UnpackCipherData(data []byte) ([]byte, []byte, int, error) {
+	headerSize := 1
+	if c.CipherMode == GCM {
+		headerSize = 2
+	}
+	if len(data) < headerSize {
+		return nil, nil, 0, fmt.Errorf("cipher data too short: %d bytes", len(data))
+	}
 	ivSize := int(data[0])
 	index := 1
 	tagSize := 0
@@ -182,9 +202,12 @@ func (c AesCrypto) UnpackCipherData(data []byte) ([]byte, []byte, int) {
 		tagSize = int(data[index])
 		index += 1
 	}
+	if ivSize == 0 || len(data) < index+ivSize {
+		return nil, nil, 0, fmt.Errorf("cipher data too short for a %d byte iv: %d bytes", ivSize, len(data))
+	}
 	iv, encryptedBytes := data[index:index+ivSize], data[index+ivSize:]
 
-	return encryptedBytes, iv, tagSize
+	return encryptedBytes, iv, tagSize, nil
 }
 
 // ref: https://golang-examples.tumblr.com/post/98350728789/pkcs7-padding
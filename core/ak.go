@@ -29,6 +29,8 @@ import (
 type AK struct {
 	Data      string `json:"ak"`
 	Signature string `json:"s"`
+	// Format the format used to protect the key data, zero if the key was issued in the legacy format
+	Format int `json:"f,omitempty"`
 }
 
 func (ak *AK) String() string {
@@ -45,7 +47,6 @@ type AKInfo struct {
 }
 
 func (a AKInfo) Validate() {
-	defer TRA(CE())
 	// if the verification key is not provided
 	if len(a.VerifyKey) == 0 {
 		// cannot continue
@@ -65,25 +66,19 @@ func (a AKInfo) Validate() {
 }
 
 func AkExist() bool {
-	defer TRA(CE())
 	_, err := os.Stat(AkFile())
 	return err == nil
 }
 
 func UserKeyExist() bool {
-	defer TRA(CE())
 	_, err := os.Stat(UserKeyFile())
 	return err == nil
 }
 
 func readAKey(ak AK) (*AKInfo, error) {
-	defer TRA(CE())
-	if valid, err := verify(ak.Data, ak.Signature); !valid {
-		return nil, fmt.Errorf("signature verification failed: %s\n", err)
-	}
-	data, err := decrypt(sk, ak.Data, iv)
+	data, err := openKey(ak.Format, ak.Data, ak.Signature)
 	if err != nil {
-		return nil, fmt.Errorf("cannot decrypt activation key: %s\n", err)
+		return nil, fmt.Errorf("cannot open activation key: %s\n", err)
 	}
 	akinfo := new(AKInfo)
 	err = json.Unmarshal([]byte(data), akinfo)
@@ -94,7 +89,6 @@ func readAKey(ak AK) (*AKInfo, error) {
 }
 
 func loadAKey(path string) (*AK, error) {
-	defer TRA(CE())
 	path = Abs(path)
 	keyBytes, err := os.ReadFile(path)
 	if err != nil {
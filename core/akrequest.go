@@ -24,7 +24,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"os"
 	"time"
@@ -41,7 +40,6 @@ type AKRequestBearerToken struct {
 }
 
 func NewAKRequestBearerToken(clientInfo userKeyInfo, options PilotOptions) AKRequestBearerToken {
-	defer TRA(CE())
 	var deviceId string
 	// if hardware id should be used to identify the device
 	if options.UseHwId {
@@ -62,7 +60,6 @@ func NewAKRequestBearerToken(clientInfo userKeyInfo, options PilotOptions) AKReq
 }
 
 func (t AKRequestBearerToken) String() string {
-	defer TRA(CE())
 	b, err := json.Marshal(t)
 	if err != nil {
 		ErrorLogger.Printf("cannot create activation key request bearer token: %s\n", err)
@@ -72,7 +69,6 @@ func (t AKRequestBearerToken) String() string {
 }
 
 func activate(options PilotOptions) {
-	defer TRA(CE())
 	var (
 		failures float64 = 0
 		interval time.Duration
@@ -117,11 +113,16 @@ func activate(options PilotOptions) {
 			}
 		}
 		InfoLogger.Printf("activation key deployed, pilot is ready to launch\n")
+		audit(AuditActivation, map[string]interface{}{
+			"event": "activation key received",
+			"uri":   tenant.URI,
+			"user":  tenant.Username,
+		})
 	}
 	// before doing anything, verify activation key
 	akInfo, err := LoadActivationKey()
 	if err != nil {
-		log.Fatalf("cannot start pilot: %s", err)
+		Log.Fatal().Err(err).Msg("cannot start pilot")
 	}
 	// set the activation
 	A = akInfo
@@ -158,6 +159,19 @@ func activate(options PilotOptions) {
 	}
 	// set host UUID
 	options.Info.HostUUID = A.HostUUID
+	setLogHostUUID(A.HostUUID)
+	audit(AuditActivation, map[string]interface{}{
+		"event":     "activated",
+		"host_uuid": A.HostUUID,
+		"device_id": A.DeviceId,
+		"expiry":    A.Expiry,
+	})
+	// load the key used to sign payloads submitted to pilot control
+	HK, err = loadHostKey(A.HostUUID)
+	if err != nil {
+		ErrorLogger.Printf("cannot launch pilot: %s\n", err)
+		os.Exit(1)
+	}
 }
 
 func LoadActivationKey() (*AKInfo, error) {
@@ -182,7 +196,7 @@ func requestAKey(clientKey userKeyInfo, options PilotOptions) (bool, error) {
 				InsecureSkipVerify: options.InsecureSkipVerify,
 			},
 		},
-		Timeout: time.Second * 60,
+		Timeout: CurrentSettings().Limits.ActivationTimeout.Duration(),
 	}
 	req, err := http.NewRequest("POST", fmt.Sprintf("%s/activation-key", clientKey.URI), nil)
 	if err != nil {
@@ -215,7 +229,7 @@ func requestAKey(clientKey userKeyInfo, options PilotOptions) (bool, error) {
 	if err != nil {
 		return false, fmt.Errorf("cannot read activation key from http response: %s\n", err)
 	}
-	err = os.WriteFile(AkFile(), ak, 0600)
+	err = writeFile(AkFile(), ak)
 	if err != nil {
 		return false, fmt.Errorf("cannot write activation file: %s\n", err)
 	}
@@ -0,0 +1,340 @@
+/*
+   Pilot Host Controller
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// audit record types
+const (
+	AuditActivation   = "activation"
+	AuditRegistration = "registration"
+	AuditEnvelope     = "envelope"
+	AuditPolicy       = "policy"
+	AuditExecution    = "execution"
+	AuditSubmission   = "submission"
+)
+
+// AuditRecord an entry in the audit log
+// each record includes the hash of the previous one, so that editing or removing any record breaks the chain;
+// hashes are keyed with a secret held outside the audit folder, so that the chain cannot be recomputed by
+// someone who can only edit the log
+type AuditRecord struct {
+	Seq  uint64                 `json:"seq"`
+	Time time.Time              `json:"time"`
+	Type string                 `json:"type"`
+	Data map[string]interface{} `json:"data,omitempty"`
+	Prev string                 `json:"prev"`
+	Hash string                 `json:"hash"`
+}
+
+// digest calculates the record hash, i.e. the HMAC-SHA256 of the canonical JSON of the record without its hash
+func (r AuditRecord) digest(key []byte) (string, error) {
+	r.Hash = ""
+	b, err := canonicalJSON(r)
+	if err != nil {
+		return "", err
+	}
+	return auditMac(key, b), nil
+}
+
+// auditHead the last record written to the audit log, used to detect truncation of the log
+type auditHead struct {
+	Seq  uint64 `json:"seq"`
+	Hash string `json:"hash"`
+	Mac  string `json:"mac,omitempty"`
+}
+
+// mac calculates the HMAC of the head, so that it cannot be moved back to an earlier record without the key
+func (h auditHead) mac(key []byte) string {
+	return auditMac(key, []byte(fmt.Sprintf("%d|%s", h.Seq, h.Hash)))
+}
+
+func auditMac(key, data []byte) string {
+	m := hmac.New(sha256.New, key)
+	m.Write(data)
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// loadAuditKey reads the key used to hash audit records, creating it if specified and it does not exist
+func loadAuditKey(create bool) ([]byte, error) {
+	b, err := os.ReadFile(AuditKeyFile())
+	if err == nil {
+		key, err := hex.DecodeString(strings.TrimSpace(string(b)))
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("invalid audit key in %s", AuditKeyFile())
+		}
+		return key, nil
+	}
+	if !os.IsNotExist(err) || !create {
+		return nil, fmt.Errorf("cannot read audit key: %s", err)
+	}
+	key := make([]byte, 32)
+	if _, err = rand.Read(key); err != nil {
+		return nil, fmt.Errorf("cannot generate audit key: %s", err)
+	}
+	if err = writeFile(AuditKeyFile(), []byte(hex.EncodeToString(key))); err != nil {
+		return nil, fmt.Errorf("cannot write audit key: %s", err)
+	}
+	return key, nil
+}
+
+// AuditLog an append-only, hash-chained log of the security relevant actions pilot takes
+type AuditLog struct {
+	sync.Mutex
+	dir  string
+	key  []byte
+	w    *FileRotator
+	head auditHead
+}
+
+// Audit the audit log, nil if not opened
+var Audit *AuditLog
+
+const (
+	auditFile     = "audit.log"
+	auditHeadFile = "head.json"
+)
+
+// OpenAuditLog opens the audit log in the specified folder, continuing the existing chain
+// the audit key is only created for a new log: a log with records cannot be extended without its key
+func OpenAuditLog(dir string) (*AuditLog, error) {
+	if err := ensureDir(dir); err != nil {
+		return nil, err
+	}
+	head, err := readAuditHead(dir)
+	if err != nil {
+		return nil, err
+	}
+	last, err := lastAuditRecord(dir)
+	if err != nil {
+		return nil, err
+	}
+	key, err := loadAuditKey(head.Seq == 0 && last == nil)
+	if err != nil {
+		return nil, err
+	}
+	// the head is written after the record, so a crash in between leaves it behind the log: the chain continues
+	// from the last record, if its hash proves pilot wrote it; a head ahead of the log is kept, so that
+	// verification reports the missing records
+	if last != nil && last.Seq > head.Seq {
+		if hash, err := last.digest(key); err != nil || !hmac.Equal([]byte(hash), []byte(last.Hash)) {
+			WarningLogger.Printf("audit record #%d has been modified, continuing the audit log from its head\n", last.Seq)
+		} else {
+			head = &auditHead{Seq: last.Seq, Hash: last.Hash}
+			head.Mac = head.mac(key)
+		}
+	}
+	// rotated audit files are never deleted as that would break the chain
+	w, err := newLogFileRotator(filepath.Join(dir, auditFile), 0)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open audit log: %s", err)
+	}
+	return &AuditLog{dir: dir, key: key, w: w, head: *head}, nil
+}
+
+// Append adds a record to the audit log
+func (a *AuditLog) Append(recordType string, data map[string]interface{}) error {
+	a.Lock()
+	defer a.Unlock()
+	r := AuditRecord{
+		Seq:  a.head.Seq + 1,
+		Time: time.Now().UTC(),
+		Type: recordType,
+		Data: data,
+		Prev: a.head.Hash,
+	}
+	hash, err := r.digest(a.key)
+	if err != nil {
+		return fmt.Errorf("cannot hash audit record: %s", err)
+	}
+	r.Hash = hash
+	line, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("cannot marshal audit record: %s", err)
+	}
+	if _, err = a.w.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("cannot write audit record: %s", err)
+	}
+	a.w.Flush()
+	a.head = auditHead{Seq: r.Seq, Hash: r.Hash}
+	a.head.Mac = a.head.mac(a.key)
+	b, _ := json.Marshal(a.head)
+	return writeFile(filepath.Join(a.dir, auditHeadFile), b)
+}
+
+// audit adds a record to the audit log, if it is open; failures are logged but do not stop pilot
+func audit(recordType string, data map[string]interface{}) {
+	if Audit == nil {
+		return
+	}
+	if err := Audit.Append(recordType, data); err != nil {
+		ErrorLogger.Printf("%s\n", err)
+	}
+}
+
+// VerifyAuditLog checks the hash chain of the audit log in the specified folder using the audit key
+// it detects edited, inserted or removed records anywhere in the log, including truncation of its end,
+// and returns the number of records verified
+func VerifyAuditLog(dir string) (uint64, error) {
+	key, err := loadAuditKey(false)
+	if err != nil {
+		return 0, err
+	}
+	files, err := auditFiles(dir)
+	if err != nil {
+		return 0, err
+	}
+	var last auditHead
+	for _, file := range files {
+		if last, err = verifyAuditFile(file, last, key); err != nil {
+			return last.Seq, err
+		}
+	}
+	head, err := readAuditHead(dir)
+	if err != nil {
+		return last.Seq, err
+	}
+	// the head is written after the record, so it can be behind the log, e.g. after a crash, but never ahead
+	if head.Seq > last.Seq || (head.Seq == last.Seq && head.Hash != last.Hash) {
+		return last.Seq, fmt.Errorf("audit log truncated: last record is #%d but #%d was written", last.Seq, head.Seq)
+	}
+	if head.Seq > 0 && !hmac.Equal([]byte(head.Mac), []byte(head.mac(key))) {
+		return last.Seq, fmt.Errorf("audit head has been modified")
+	}
+	return last.Seq, nil
+}
+
+func verifyAuditFile(path string, last auditHead, key []byte) (auditHead, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return last, fmt.Errorf("cannot open %s: %s", path, err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		var r AuditRecord
+		if err = json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return last, fmt.Errorf("%s:%d: invalid audit record: %s", path, line, err)
+		}
+		if r.Seq != last.Seq+1 {
+			return last, fmt.Errorf("%s:%d: expected record #%d, found #%d", path, line, last.Seq+1, r.Seq)
+		}
+		if r.Prev != last.Hash {
+			return last, fmt.Errorf("%s:%d: record #%d does not chain to the previous record", path, line, r.Seq)
+		}
+		hash, err := r.digest(key)
+		if err != nil {
+			return last, err
+		}
+		if !hmac.Equal([]byte(hash), []byte(r.Hash)) {
+			return last, fmt.Errorf("%s:%d: record #%d has been modified", path, line, r.Seq)
+		}
+		last = auditHead{Seq: r.Seq, Hash: r.Hash}
+	}
+	if err = scanner.Err(); err != nil {
+		return last, fmt.Errorf("cannot read %s: %s", path, err)
+	}
+	return last, nil
+}
+
+// auditFiles returns the rotated audit files in the order they were written followed by the current file
+func auditFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read audit folder: %s", err)
+	}
+	var (
+		rotated []string
+		current string
+	)
+	prefix := strings.TrimSuffix(auditFile, filepath.Ext(auditFile)) + "."
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || filepath.Ext(name) != filepath.Ext(auditFile) {
+			continue
+		}
+		if name == auditFile {
+			current = filepath.Join(dir, name)
+		} else if strings.HasPrefix(name, prefix) {
+			rotated = append(rotated, filepath.Join(dir, name))
+		}
+	}
+	// rotated names include the date and a sequence number, e.g. audit.2006-01-02.0001.log
+	sort.Strings(rotated)
+	if len(current) > 0 {
+		rotated = append(rotated, current)
+	}
+	return rotated, nil
+}
+
+// lastAuditRecord returns the last record written to the audit log, nil if the log has no records
+func lastAuditRecord(dir string) (*AuditRecord, error) {
+	files, err := auditFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(files) - 1; i >= 0; i-- {
+		content, err := os.ReadFile(files[i])
+		if err != nil {
+			return nil, fmt.Errorf("cannot read %s: %s", files[i], err)
+		}
+		lines := bytes.Split(bytes.TrimSpace(content), []byte("\n"))
+		for j := len(lines) - 1; j >= 0; j-- {
+			var r AuditRecord
+			// a partially written last line is not a record
+			if json.Unmarshal(lines[j], &r) == nil && r.Seq > 0 {
+				return &r, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+func readAuditHead(dir string) (*auditHead, error) {
+	head := new(auditHead)
+	b, err := os.ReadFile(filepath.Join(dir, auditHeadFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return head, nil
+		}
+		return nil, fmt.Errorf("cannot read audit head: %s", err)
+	}
+	if err = json.Unmarshal(b, head); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal audit head: %s", err)
+	}
+	return head, nil
+}
@@ -0,0 +1,168 @@
+/*
+   Pilot Host Controller
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAuditLog(t *testing.T) {
+	t.Setenv(PilotCfgPath.String(), t.TempDir())
+	dir := filepath.Join(t.TempDir(), "audit")
+	log, err := OpenAuditLog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		if err = log.Append(AuditExecution, map[string]interface{}{"job_id": i, "success": true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, err := VerifyAuditLog(dir); err != nil || n != 3 {
+		t.Fatalf("expected 3 verified records, got %d: %v", n, err)
+	}
+	// the chain continues across restarts
+	if log, err = OpenAuditLog(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err = log.Append(AuditSubmission, map[string]interface{}{"type": "events"}); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := VerifyAuditLog(dir); err != nil || n != 4 {
+		t.Fatalf("expected 4 verified records, got %d: %v", n, err)
+	}
+	// reopening rotated the first three records into another file
+	files, err := auditFiles(dir)
+	if err != nil || len(files) != 2 {
+		t.Fatalf("expected 2 audit files, got %v: %v", files, err)
+	}
+	path := files[0]
+	content, _ := os.ReadFile(path)
+	// an edited record is detected
+	os.WriteFile(path, bytes.Replace(content, []byte(`"success":true`), []byte(`"success":false`), 1), filePerm)
+	if _, err = VerifyAuditLog(dir); err == nil {
+		t.Fatal("modified record not detected")
+	}
+	// a truncated log is detected
+	lines := bytes.SplitAfter(content, []byte("\n"))
+	os.WriteFile(path, bytes.Join(lines[:2], nil), filePerm)
+	if _, err = VerifyAuditLog(dir); err == nil {
+		t.Fatal("truncated log not detected")
+	}
+}
+
+func TestAuditLogKey(t *testing.T) {
+	t.Setenv(PilotCfgPath.String(), t.TempDir())
+	dir := filepath.Join(t.TempDir(), "audit")
+	log, err := OpenAuditLog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 2; i++ {
+		if err = log.Append(AuditExecution, map[string]interface{}{"job_id": i, "success": true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := filepath.Join(dir, auditFile)
+	content, _ := os.ReadFile(path)
+	head, _ := os.ReadFile(filepath.Join(dir, auditHeadFile))
+	// moving the head back to an earlier record is detected
+	var r AuditRecord
+	json.Unmarshal(bytes.SplitAfter(content, []byte("\n"))[0], &r)
+	b, _ := json.Marshal(auditHead{Seq: r.Seq, Hash: r.Hash, Mac: "forged"})
+	os.WriteFile(path, bytes.SplitAfter(content, []byte("\n"))[0], filePerm)
+	os.WriteFile(filepath.Join(dir, auditHeadFile), b, filePerm)
+	if _, err = VerifyAuditLog(dir); err == nil {
+		t.Fatal("rolled back head not detected")
+	}
+	// a chain recomputed without the audit key is detected
+	forged := []byte{}
+	last := auditHead{}
+	for _, line := range bytes.Split(bytes.TrimSpace(content), []byte("\n")) {
+		json.Unmarshal(line, &r)
+		r.Data["success"] = false
+		r.Prev = last.Hash
+		r.Hash, _ = r.digest(bytes.Repeat([]byte{1}, 32))
+		last = auditHead{Seq: r.Seq, Hash: r.Hash}
+		line, _ = json.Marshal(r)
+		forged = append(forged, append(line, '\n')...)
+	}
+	os.WriteFile(path, forged, filePerm)
+	b, _ = json.Marshal(last)
+	os.WriteFile(filepath.Join(dir, auditHeadFile), b, filePerm)
+	if _, err = VerifyAuditLog(dir); err == nil {
+		t.Fatal("recomputed chain not detected")
+	}
+	// the original log still verifies, but not without its key
+	os.WriteFile(path, content, filePerm)
+	os.WriteFile(filepath.Join(dir, auditHeadFile), head, filePerm)
+	if n, err := VerifyAuditLog(dir); err != nil || n != 2 {
+		t.Fatalf("expected 2 verified records, got %d: %v", n, err)
+	}
+	os.Remove(AuditKeyFile())
+	if _, err = VerifyAuditLog(dir); err == nil {
+		t.Fatal("log verified without its key")
+	}
+	if _, err = OpenAuditLog(dir); err == nil {
+		t.Fatal("log extended without its key")
+	}
+}
+
+func TestAuditLogHeadRecovery(t *testing.T) {
+	t.Setenv(PilotCfgPath.String(), t.TempDir())
+	dir := filepath.Join(t.TempDir(), "audit")
+	headPath := filepath.Join(dir, auditHeadFile)
+	log, err := OpenAuditLog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = log.Append(AuditExecution, map[string]interface{}{"job_id": 1, "success": true}); err != nil {
+		t.Fatal(err)
+	}
+	head, _ := os.ReadFile(headPath)
+	if err = log.Append(AuditExecution, map[string]interface{}{"job_id": 2, "success": true}); err != nil {
+		t.Fatal(err)
+	}
+	// a crash before the head was written leaves it one record behind the log
+	os.WriteFile(headPath, head, filePerm)
+	if log, err = OpenAuditLog(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err = log.Append(AuditSubmission, map[string]interface{}{"type": "events"}); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := VerifyAuditLog(dir); err != nil || n != 3 {
+		t.Fatalf("expected 3 verified records, got %d: %v", n, err)
+	}
+	// a crash before the first head was written leaves no head at all
+	os.Remove(headPath)
+	if log, err = OpenAuditLog(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err = log.Append(AuditSubmission, map[string]interface{}{"type": "events"}); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := VerifyAuditLog(dir); err != nil || n != 4 {
+		t.Fatalf("expected 4 verified records, got %d: %v", n, err)
+	}
+}
@@ -0,0 +1,60 @@
+/*
+   Pilot Host Controller
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// BatchNewline the batch format where the content of several telemetry files, each terminated by a new line, is
+// sent in a single request
+const BatchNewline = "newline"
+
+// headers used to negotiate the batching of telemetry uploads
+const (
+	// the batch formats pilot can upload, sent with every request including registration and ping
+	acceptBatchHeader = "Pilot-Accept-Batch"
+	// the batch format pilot control chose, returned in registration and ping responses
+	batchHeader = "Pilot-Batch"
+)
+
+// SupportedBatches the batch formats pilot can upload telemetry with
+var SupportedBatches = []string{BatchNewline}
+
+// negotiatedBatch holds whether pilot control accepts batched telemetry uploads, false until a response says
+// otherwise, so that control planes that do not support batching keep receiving one file per request
+type negotiatedBatch struct {
+	v atomic.Bool
+}
+
+// get returns true if telemetry files can be batched
+func (b *negotiatedBatch) get() bool {
+	return b.v.Load()
+}
+
+// set records the batch format chosen by pilot control in a registration or ping response
+// a response without a choice or with a format pilot does not support means one file per request
+func (b *negotiatedBatch) set(resp *http.Response) {
+	batch := strings.ToLower(strings.TrimSpace(resp.Header.Get(batchHeader))) == BatchNewline
+	if b.v.Swap(batch) != batch {
+		logFor("pilotctl").Info().Bool("batch", batch).Msg("telemetry batching negotiated")
+	}
+}
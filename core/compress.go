@@ -0,0 +1,169 @@
+/*
+   Pilot Host Controller
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// content encodings of the bodies uploaded to pilot control
+const (
+	EncodingIdentity = "identity"
+	EncodingGzip     = "gzip"
+	EncodingZstd     = "zstd"
+)
+
+// headers used to negotiate the encoding of uploaded bodies
+const (
+	// the encodings pilot can upload, sent with every request including registration and ping
+	encodingsHeader = "Pilot-Accept-Encoding"
+	// the encoding pilot control chose, returned in registration and ping responses
+	encodingHeader = "Pilot-Encoding"
+)
+
+// SupportedEncodings the encodings pilot can compress uploads with, in order of preference
+var SupportedEncodings = []string{EncodingZstd, EncodingGzip}
+
+// the kinds of uploaded bodies, used as metric labels
+const (
+	uploadTelemetry = "telemetry"
+	uploadCVE       = "cve"
+	uploadJobResult = "job_result"
+	uploadEvents    = "events"
+)
+
+// negotiatedEncoding holds the encoding pilot control chose, identity until a response says otherwise, so that
+// control planes that do not support compression keep receiving uncompressed uploads
+type negotiatedEncoding struct {
+	v atomic.Value
+	// the encoding pilot control rejected for each kind of upload
+	rejected sync.Map
+}
+
+// get returns the encoding uploads of a kind must use, identity if compression is disabled or pilot control
+// rejected the negotiated encoding for this kind of upload
+func (e *negotiatedEncoding) get(kind string) string {
+	if !CurrentSettings().Compression.Enabled {
+		return EncodingIdentity
+	}
+	encoding, ok := e.v.Load().(string)
+	if !ok {
+		return EncodingIdentity
+	}
+	if rejected, _ := e.rejected.Load(kind); rejected == encoding {
+		return EncodingIdentity
+	}
+	return encoding
+}
+
+// set records the encoding chosen by pilot control in a registration or ping response
+// a response without a choice or with an encoding pilot does not support means uncompressed uploads
+func (e *negotiatedEncoding) set(resp *http.Response) {
+	encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get(encodingHeader)))
+	if !supportedEncoding(encoding) {
+		encoding = EncodingIdentity
+	}
+	if previous, _ := e.v.Load().(string); previous != encoding {
+		logFor("pilotctl").Info().Str("encoding", encoding).Msg("upload encoding negotiated")
+	}
+	e.v.Store(encoding)
+}
+
+// reject falls back to uncompressed uploads of a kind when pilot control rejects a body compressed with an
+// encoding; the fallback is kept when a ping chooses the same encoding again, so that uploads of this kind are
+// not sent twice, and ends when pilot control chooses another encoding or pilot restarts
+func (e *negotiatedEncoding) reject(kind, encoding string) {
+	e.rejected.Store(kind, encoding)
+}
+
+// acceptedEncodings returns the encodings pilot offers to pilot control, none if compression is disabled
+func acceptedEncodings() []string {
+	if !CurrentSettings().Compression.Enabled {
+		return nil
+	}
+	return SupportedEncodings
+}
+
+func supportedEncoding(encoding string) bool {
+	for _, e := range SupportedEncodings {
+		if e == encoding {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeBody compresses an upload body with the passed-in encoding
+// bodies smaller than compression.min_bytes are not worth compressing and are returned as they are, with the
+// identity encoding
+func encodeBody(kind, encoding string, content []byte) ([]byte, string, error) {
+	if encoding == EncodingIdentity || len(content) < CurrentSettings().Compression.MinBytes {
+		return content, EncodingIdentity, nil
+	}
+	encoded, err := compress(encoding, content)
+	if err != nil {
+		return nil, "", fmt.Errorf("cannot compress %s upload: %s", kind, err)
+	}
+	return encoded, encoding, nil
+}
+
+// compress encodes content using gzip or zstd
+func compress(encoding string, content []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	switch encoding {
+	case EncodingGzip:
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(content); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+	case EncodingZstd:
+		w, err := zstd.NewWriter(&buf)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = w.Write(content); err != nil {
+			return nil, err
+		}
+		if err = w.Close(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported encoding '%s'", encoding)
+	}
+	return buf.Bytes(), nil
+}
+
+// observeUpload records the size of an upload body before and after compression
+func observeUpload(kind, encoding string, raw, sent int) {
+	uploadRawBytes.WithLabelValues(kind, encoding).Add(float64(raw))
+	uploadSentBytes.WithLabelValues(kind, encoding).Add(float64(sent))
+	if sent > 0 {
+		uploadCompressionRatio.WithLabelValues(kind, encoding).Observe(float64(raw) / float64(sent))
+	}
+}
@@ -0,0 +1,124 @@
+/*
+   Pilot Host Controller
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCompress(t *testing.T) {
+	content := []byte(strings.Repeat("pilot telemetry ", 100))
+	for _, encoding := range SupportedEncodings {
+		encoded, err := compress(encoding, content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(encoded) >= len(content) {
+			t.Fatalf("%s did not compress the content: %d bytes", encoding, len(encoded))
+		}
+		decoded, err := decompress(encoding, encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decoded, content) {
+			t.Fatalf("%s round trip changed the content", encoding)
+		}
+	}
+}
+
+func TestCompressedTelemetry(t *testing.T) {
+	var encodings []string
+	r := newTestPilotCtl(t, func(w http.ResponseWriter, req *http.Request) {
+		encoding := req.Header.Get("Content-Encoding")
+		encodings = append(encodings, encoding)
+		// a control plane that only supports gzip
+		if encoding == EncodingZstd {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		body, _ := io.ReadAll(req.Body)
+		if len(encoding) > 0 {
+			body, _ = decompress(encoding, body)
+		}
+		if !strings.HasPrefix(string(body), "pilot telemetry") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_, _ = w.Write([]byte(`{"t":1,"s":1}`))
+	})
+	content := []byte(strings.Repeat("pilot telemetry ", 100))
+	negotiate := func(encoding string) {
+		resp := &http.Response{Header: http.Header{}}
+		resp.Header.Set(encodingHeader, encoding)
+		r.encoding.set(resp)
+	}
+	submit := func() {
+		if _, err := r.SubmitTelemetry(context.Background(), "app", content, "metrics"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// uploads are uncompressed until pilot control chooses an encoding
+	submit()
+	negotiate(EncodingGzip)
+	submit()
+	// small bodies are not compressed
+	content = []byte("pilot telemetry")
+	submit()
+	// pilot falls back to uncompressed uploads if pilot control rejects the encoding
+	content = []byte(strings.Repeat("pilot telemetry ", 100))
+	negotiate(EncodingZstd)
+	submit()
+	submit()
+	// the fallback is kept when a ping chooses the rejected encoding again
+	negotiate(EncodingZstd)
+	submit()
+	// and ends when pilot control chooses another encoding
+	negotiate(EncodingGzip)
+	submit()
+	if got := strings.Join(encodings, ","); got != ",gzip,,zstd,,,,gzip" {
+		t.Fatalf("unexpected encodings %q", got)
+	}
+}
+
+func decompress(encoding string, content []byte) ([]byte, error) {
+	var r io.Reader
+	switch encoding {
+	case EncodingGzip:
+		gz, err := gzip.NewReader(bytes.NewReader(content))
+		if err != nil {
+			return nil, err
+		}
+		r = gz
+	case EncodingZstd:
+		zr, err := zstd.NewReader(bytes.NewReader(content))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		r = zr
+	}
+	return io.ReadAll(r)
+}
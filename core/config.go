@@ -20,13 +20,9 @@ package core
 
 import (
 	"fmt"
-	"github.com/rs/zerolog"
-	"github.com/rs/zerolog/log"
 	"os"
-	"path/filepath"
 	"southwinds.dev/artisan/core"
 	"strconv"
-	"strings"
 )
 
 // Config pilot configuration
@@ -52,6 +48,100 @@ func (k ConfigKey) String() string {
 		return "PILOT_DEBUG"
 	case PilotCVEPath:
 		return "PILOT_CVE_PATH"
+	case PilotTrustAnchor:
+		return "PILOT_TRUST_ANCHOR"
+	case PilotTenantKey:
+		return "PILOT_TENANT_KEY"
+	case PilotTenantKeyPwd:
+		return "PILOT_TENANT_KEY_PWD"
+	case PilotLegacyKey:
+		return "PILOT_LEGACY_KEY"
+	case PilotConfigFile:
+		return "PILOT_CONFIG"
+	case PilotCfgPath:
+		return "PILOT_CFG_PATH"
+	case PilotHome:
+		return "PILOT_HOME"
+	case PilotTelemPath:
+		return "PILOT_CTL_TELEM_PATH"
+	case PilotHttpProxy:
+		return "PILOT_HTTP_PROXY"
+	case PilotInsecureSkipVerify:
+		return "PILOT_INSECURE_SKIP_VERIFY"
+	case PilotTelemetry:
+		return "PILOT_TELEMETRY"
+	case PilotUseHwId:
+		return "PILOT_USE_HW_ID"
+	case PilotPingInterval:
+		return "PILOT_PING_INTERVAL"
+	case PilotKeyRefreshInterval:
+		return "PILOT_KEY_REFRESH_INTERVAL"
+	case PilotCVEUploadDelay:
+		return "PILOT_CVE_UPLOAD_DELAY"
+	case PilotRequestTimeout:
+		return "PILOT_REQUEST_TIMEOUT"
+	case PilotActivationTimeout:
+		return "PILOT_ACTIVATION_TIMEOUT"
+	case PilotMaxRetryInterval:
+		return "PILOT_MAX_RETRY_INTERVAL"
+	case PilotReloadWatch:
+		return "PILOT_RELOAD_WATCH"
+	case PilotStatusSocket:
+		return "PILOT_STATUS_SOCKET"
+	case PilotMetricsEnabled:
+		return "PILOT_METRICS_ENABLED"
+	case PilotMetricsAddress:
+		return "PILOT_METRICS_ADDRESS"
+	case PilotLogFormat:
+		return "PILOT_LOG_FORMAT"
+	case PilotLogFile:
+		return "PILOT_LOG_FILE"
+	case PilotTraceExporter:
+		return "PILOT_TRACE_EXPORTER"
+	case PilotTraceEndpoint:
+		return "PILOT_TRACE_ENDPOINT"
+	case PilotTraceInsecure:
+		return "PILOT_TRACE_INSECURE"
+	case PilotTraceFile:
+		return "PILOT_TRACE_FILE"
+	case PilotHostMetrics:
+		return "PILOT_HOST_METRICS"
+	case PilotHostMetricsInterval:
+		return "PILOT_HOST_METRICS_INTERVAL"
+	case PilotHostMetricsChannel:
+		return "PILOT_HOST_METRICS_CHANNEL"
+	case PilotOTLPReceiver:
+		return "PILOT_OTLP_RECEIVER"
+	case PilotOTLPHTTPAddress:
+		return "PILOT_OTLP_HTTP_ADDRESS"
+	case PilotOTLPGRPCAddress:
+		return "PILOT_OTLP_GRPC_ADDRESS"
+	case PilotOTLPChannel:
+		return "PILOT_OTLP_CHANNEL"
+	case PilotTelemetryBatchBytes:
+		return "PILOT_TELEMETRY_BATCH_BYTES"
+	case PilotSpoolMaxBytes:
+		return "PILOT_SPOOL_MAX_BYTES"
+	case PilotSpoolChannelMaxBytes:
+		return "PILOT_SPOOL_CHANNEL_MAX_BYTES"
+	case PilotSpoolMaxAge:
+		return "PILOT_SPOOL_MAX_AGE"
+	case PilotSpoolPolicy:
+		return "PILOT_SPOOL_POLICY"
+	case PilotCompression:
+		return "PILOT_COMPRESSION"
+	case PilotCompressionMinBytes:
+		return "PILOT_COMPRESSION_MIN_BYTES"
+	case PilotJournal:
+		return "PILOT_JOURNAL"
+	case PilotJournalOutput:
+		return "PILOT_JOURNAL_OUTPUT"
+	case PilotJournalChannel:
+		return "PILOT_JOURNAL_CHANNEL"
+	case PilotJournalPriority:
+		return "PILOT_JOURNAL_PRIORITY"
+	case PilotJournalMaxEvents:
+		return "PILOT_JOURNAL_MAX_EVENTS"
 	}
 	return ""
 }
@@ -63,20 +153,60 @@ const (
 	PilotUserKey
 	PilotDebug
 	PilotCVEPath
+	PilotTrustAnchor
+	PilotTenantKey
+	PilotTenantKeyPwd
+	PilotLegacyKey
+	PilotConfigFile
+	PilotCfgPath
+	PilotHome
+	PilotTelemPath
+	PilotHttpProxy
+	PilotInsecureSkipVerify
+	PilotTelemetry
+	PilotUseHwId
+	PilotPingInterval
+	PilotKeyRefreshInterval
+	PilotCVEUploadDelay
+	PilotRequestTimeout
+	PilotActivationTimeout
+	PilotMaxRetryInterval
+	PilotReloadWatch
+	PilotStatusSocket
+	PilotMetricsEnabled
+	PilotMetricsAddress
+	PilotLogFormat
+	PilotLogFile
+	PilotTraceExporter
+	PilotTraceEndpoint
+	PilotTraceInsecure
+	PilotTraceFile
+	PilotHostMetrics
+	PilotHostMetricsInterval
+	PilotHostMetricsChannel
+	PilotOTLPReceiver
+	PilotOTLPHTTPAddress
+	PilotOTLPGRPCAddress
+	PilotOTLPChannel
+	PilotTelemetryBatchBytes
+	PilotSpoolMaxBytes
+	PilotSpoolChannelMaxBytes
+	PilotSpoolMaxAge
+	PilotSpoolPolicy
+	PilotCompression
+	PilotCompressionMinBytes
+	PilotJournal
+	PilotJournalOutput
+	PilotJournalChannel
+	PilotJournalPriority
+	PilotJournalMaxEvents
 )
 
 func (c *Config) getSyslogPort() string {
-	defer TRA(CE())
-	port := c.Get(PilotSyslogPort)
-	if len(port) == 0 {
-		// set default
-		port = "1514"
-	}
-	return port
+	return strconv.Itoa(CurrentSettings().Syslog.Port)
 }
 
 func (c *Config) Get(key ConfigKey) string {
-	defer TRA(CE())
 	return os.Getenv(key.String())
 }
 
@@ -85,46 +215,33 @@ func (c *Config) GetIntDefault(key ConfigKey, defValue int) int {
 		i   = defValue
 		err error
 	)
-	defer TRA(CE())
 	value := os.Getenv(key.String())
 	if len(value) > 0 {
 		i, err = strconv.Atoi(value)
 		if err != nil {
-			core.WarningLogger.Printf("cannot get default value for '%s': %s\n", key, err)
+			WarningLogger.Printf("cannot get default value for '%s': %s\n", key, err)
 		}
 	}
 	return i
 }
 
 func (c *Config) GetBool(key ConfigKey) bool {
-	defer TRA(CE())
 	b, _ := strconv.ParseBool(c.Get(key))
 	return b
 }
 
 func (c *Config) Load() error {
-	defer TRA(CE())
 	// set the file path to where pilot is running
 	c.path = CurrentPath()
 
-	// log level
-	c.LogLevel = c.Get(PilotLogLevel)
-
-	logLevel, err := zerolog.ParseLevel(strings.ToLower(c.LogLevel))
-	if err != nil {
-		log.Warn().Msg(err.Error())
-		log.Info().Msg("defaulting log level to INFO")
-		zerolog.SetGlobalLevel(zerolog.InfoLevel)
-	}
-	zerolog.SetGlobalLevel(logLevel)
-	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
-
+	// log level, applied by ConfigureLogging
+	c.LogLevel = CurrentSettings().Log.Level
 	return nil
 }
 
 func CurrentPath() string {
 	// check if the current path is overridden
-	path := os.Getenv("PILOT_CFG_PATH")
+	path := os.Getenv(PilotCfgPath.String())
 	// if so
 	if len(path) > 0 {
 		// works out the absolute path and return
@@ -145,27 +262,50 @@ func CurrentPath() string {
 }
 
 func AkFile() string {
-	defer TRA(CE())
 	return fmt.Sprintf("%s/.pilot", CurrentPath())
 }
 
 func UserKeyFile() string {
-	defer TRA(CE())
 	return fmt.Sprintf("%s/.userkey", CurrentPath())
 }
 
-// DataPath returns the path of the root local folder where files are cached
-func DataPath() string {
-	return filepath.Join(CurrentPath(), "data")
+// HostKeyFile returns the path of the private PGP key the host uses to sign submitted payloads
+func HostKeyFile() string {
+	return fmt.Sprintf("%s/.pilot_host.pgp", CurrentPath())
+}
+
+// VerifyKeysFile returns the path of the file with the verification keys received via key rotation
+func VerifyKeysFile() string {
+	return fmt.Sprintf("%s/.pilot_keys", CurrentPath())
 }
 
-// SubmitPath returns the path of the local folder used to cache information to be submitted to pilotctl
-func SubmitPath() string {
-	defer TRA(CE())
-	return filepath.Join(DataPath(), "submit")
+// KeyRotationFile returns the path of the file with the time of the last key rotation applied
+func KeyRotationFile() string {
+	return fmt.Sprintf("%s/.pilot_keys_rotation", CurrentPath())
+}
+
+// AuditKeyFile returns the path of the secret key used to hash the audit log records
+func AuditKeyFile() string {
+	return fmt.Sprintf("%s/.pilot_audit_key", CurrentPath())
+}
+
+// TrustAnchorFile returns the path of the public PGP key used to verify user and activation keys
+func TrustAnchorFile() string {
+	if path := CurrentSettings().Paths.TrustAnchor; len(path) > 0 {
+		return Abs(path)
+	}
+	return fmt.Sprintf("%s/.pilot_verify.pgp", CurrentPath())
+}
+
+// TenantKeyFile returns the path of the tenant private PGP key used to decrypt user and activation keys
+func TenantKeyFile() string {
+	if path := CurrentSettings().Paths.TenantKey; len(path) > 0 {
+		return Abs(path)
+	}
+	return fmt.Sprintf("%s/.pilot_tenant.pgp", CurrentPath())
 }
 
-// ProcessPath returns the path of the local folder used to cache jobs to be processed by pilot
-func ProcessPath() string {
-	return filepath.Join(DataPath(), "process")
+// LegacyKeyFile returns the path of the file with the key material required to read legacy keys, if any
+func LegacyKeyFile() string {
+	return CurrentSettings().Paths.LegacyKey
 }
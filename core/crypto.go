@@ -41,11 +41,11 @@ import (
 	"path/filepath"
 	"southwinds.dev/artisan/core"
 	"strconv"
+	"strings"
 	"time"
 )
 
 func decrypt(key string, cypherText string, iv string) (string, error) {
-	defer TRA(CE())
 	keyBytes, _ := hex.DecodeString(key)
 	ciphertext, _ := hex.DecodeString(cypherText)
 	ivBytes, _ := hex.DecodeString(iv)
@@ -66,7 +66,6 @@ func decrypt(key string, cypherText string, iv string) (string, error) {
 }
 
 func encrypt(key []byte, plaintext string, iv []byte) string {
-	defer TRA(CE())
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		fmt.Printf(err.Error())
@@ -81,59 +80,68 @@ func encrypt(key []byte, plaintext string, iv []byte) string {
 	return hex.EncodeToString(ciphertext)
 }
 
-func verify(text, signature string) (bool, error) {
-	defer TRA(CE())
-	msg := c.NewPlainMessageFromString(text)
+// verifyKeySignature checks the hex encoded detached PGP signature of user or activation key data using the
+// specified armored public key
+// it only opens keys, the objects sent by pilot control are verified with Verify (see verify.go)
+func verifyKeySignature(data, signature, armoredKey string) error {
+	msg := c.NewPlainMessageFromString(data)
 	sigBytes, err := hex.DecodeString(signature)
 	if err != nil {
-		return false, fmt.Errorf("cannot decode PGP signature: %s\n", err)
+		return fmt.Errorf("cannot decode PGP signature: %s", err)
 	}
 	pgpSig := c.NewPGPSignature(sigBytes)
+	pub, err := c.NewKeyFromArmored(armoredKey)
 	if err != nil {
-		return false, fmt.Errorf("cannot read PGP signature: %s\n", err)
+		return fmt.Errorf("cannot read public PGP key: %s", err)
 	}
-	d, err := decrypt(sk, pub, iv)
-	if err != nil {
-		return false, fmt.Errorf("cannot decrypt public PGP key: %s\n", err)
+	if pub.IsPrivate() {
+		return fmt.Errorf("verification key should be public, private key found")
 	}
-	pub, err := c.NewKeyFromArmored(d)
+	signKR, err := c.NewKeyRing(pub)
 	if err != nil {
-		return false, fmt.Errorf("cannot read public PGP key: %s\n", err)
+		return fmt.Errorf("cannot create PGP key ring: %s", err)
 	}
-	signKR, err := c.NewKeyRing(pub)
-	err = signKR.VerifyDetached(msg, pgpSig, c.GetUnixTime())
-	return err == nil, err
+	return signKR.VerifyDetached(msg, pgpSig, c.GetUnixTime())
 }
 
-// sign create a cryptographic signature for the passed-in object
-func verify2(obj interface{}, signature string) error {
-	defer TRA(CE())
-	// decode the  signature
-	sig, err := base64.StdEncoding.DecodeString(signature)
+// sign creates a PGP signature of the canonical JSON digest of the passed-in object using the host key
+// the signature is returned in the pgp/jcs form described in verify.go, so that pilot control verifies it the same
+// way pilot verifies its commands
+func sign(key *PGP, obj interface{}) (string, error) {
+	sum, err := Digest(CanonJCS, obj)
 	if err != nil {
-		return fmt.Errorf("verify => cannot decode signature string '%s': %s\n", signature, err)
+		return "", fmt.Errorf("sign => cannot calculate digest: %s", err)
 	}
-	// obtain the object checksum
-	sum, err := checksum(obj)
+	sig, err := signSum(key, sum)
 	if err != nil {
-		return fmt.Errorf("verify => cannot calculate checksum: %s\n", err)
+		return "", err
 	}
-	// load verification key from activation key
-	pgp, err := LoadPGPBytes([]byte(A.VerifyKey))
+	return Signature{Alg: SigAlgPGP, Canon: CanonJCS, Value: sig}.String(), nil
+}
+
+// signBytes creates a base64 encoded signature of the sha256 of the passed-in content using the host key
+func signBytes(key *PGP, content []byte) (string, error) {
+	sum := sha256.Sum256(content)
+	sig, err := signSum(key, sum[:])
 	if err != nil {
-		return fmt.Errorf("verify => cannot load host verification key: %s", err)
+		return "", err
 	}
-	// check loaded key is not private
-	if pgp.HasPrivate() {
-		return fmt.Errorf("verify => verification key should be public, private key found\n")
+	return base64.StdEncoding.EncodeToString(sig), nil
+}
+
+func signSum(key *PGP, sum []byte) ([]byte, error) {
+	if !key.HasPrivate() {
+		return nil, fmt.Errorf("sign => signing key should be private, public key found")
 	}
-	// verify digital signature
-	return pgp.Verify(sum, sig)
+	sig, err := key.Sign(sum)
+	if err != nil {
+		return nil, fmt.Errorf("sign => %s", err)
+	}
+	return sig, nil
 }
 
 // checksum create a checksum of the passed-in object
 func checksum(obj interface{}) ([]byte, error) {
-	defer TRA(CE())
 	source, err := json.Marshal(obj)
 	if err != nil {
 		return nil, fmt.Errorf("checksum => cannot convert object to JSON to produce checksum: %s", err)
@@ -170,6 +178,29 @@ const (
 	defaultCipher = packet.CipherAES128
 )
 
+// NewPGP creates a new PGP entity with the specified identity and RSA key size
+func NewPGP(name, comment, email string, bits int) (*PGP, error) {
+	conf := &packet.Config{
+		DefaultCipher: defaultCipher,
+		DefaultHash:   defaultDigest,
+		RSABits:       bits,
+		Time: func() time.Time {
+			return time.Now()
+		},
+	}
+	entity, err := openpgp.NewEntity(name, comment, email, conf)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create PGP entity: %s", err)
+	}
+	return &PGP{
+		entity:  entity,
+		conf:    conf,
+		name:    name,
+		comment: comment,
+		email:   email,
+	}, nil
+}
+
 // LoadPGP load a PGP entity from file
 func LoadPGP(filename, passphrase string) (*PGP, error) {
 	if !filepath.IsAbs(filename) {
@@ -282,6 +313,36 @@ func (p *PGP) HasPrivate() bool {
 	return p.entity.PrivateKey != nil
 }
 
+// Fingerprint returns the hex encoded fingerprint of the entity primary key
+func (p *PGP) Fingerprint() string {
+	return strings.ToUpper(hex.EncodeToString(p.entity.PrimaryKey.Fingerprint[:]))
+}
+
+// PrivateKey returns the armored private key of the entity
+func (p *PGP) PrivateKey() ([]byte, error) {
+	if !p.HasPrivate() {
+		return nil, fmt.Errorf("PGP entity does not have a private key")
+	}
+	buf := new(bytes.Buffer)
+	if err := p.entity.SerializePrivate(buf, p.conf); err != nil {
+		return nil, fmt.Errorf("cannot serialise private key: %s", err)
+	}
+	return armorEncode(buf, openpgp.PrivateKeyType, p.headers())
+}
+
+// PublicKey returns the armored public key of the entity
+func (p *PGP) PublicKey() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := p.entity.Serialize(buf); err != nil {
+		return nil, fmt.Errorf("cannot serialise public key: %s", err)
+	}
+	return armorEncode(buf, openpgp.PublicKeyType, p.headers())
+}
+
+func (p *PGP) headers() map[string]string {
+	return pemHeaders("1.0", cipherToString(p.conf.DefaultCipher), p.conf.DefaultHash.String(), p.conf.RSABits, p.conf.Time())
+}
+
 // Sign signs the specified message (requires loading a private key)
 func (p *PGP) Sign(message []byte) ([]byte, error) {
 	writer := new(bytes.Buffer)
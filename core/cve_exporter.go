@@ -19,116 +19,330 @@
 package core
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/radovskyb/watcher"
-	"io/ioutil"
 	"math/rand"
 	"os"
 	"path/filepath"
 	"regexp"
-	"southwinds.dev/artisan/core"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
+// CVEExporter uploads the CVE reports written to a folder to pilot control
+// the folder is a durable queue: reports are only removed once uploaded, failed uploads are retried with
+// exponential backoff, and reports in an unsupported format or that pilot control rejects are moved to the failed
+// folder
 type CVEExporter struct {
 	delay       time.Duration
-	submit      func(cveReportFile string, delay time.Duration, ctl *PilotCtl) error
+	submit      func(cveReportFile string, content []byte) error
 	ctl         *PilotCtl
 	w           *watcher.Watcher
 	pathToWatch string
+	// where the upload state of queued reports is persisted, it is not persisted if nil
+	state *StateDir
+	// the upload state of the queued reports keyed by file name
+	queue map[string]*cveRetry
+	mu    sync.Mutex
+	// wakes up the upload loop when a report is queued
+	wake chan struct{}
+	quit chan struct{}
 }
 
-func NewCVEExporter(ctl *PilotCtl, pathToWatch string) *CVEExporter {
+// cveRetry the upload state of a queued CVE report
+type cveRetry struct {
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+func NewCVEExporter(ctl *PilotCtl, pathToWatch string, state *StateDir) *CVEExporter {
 	pathToWatch, _ = filepath.Abs(pathToWatch)
 	w := watcher.New()
 	w.SetMaxEvents(1)
 	w.FilterOps(watcher.Create)
 	w.AddFilterHook(watcher.RegexFilterHook(regexp.MustCompile("^*.json$"), false))
-	return &CVEExporter{
-		submit:      postReport,
+	r := &CVEExporter{
 		ctl:         ctl,
 		w:           w,
 		pathToWatch: pathToWatch,
+		state:       state,
+		queue:       map[string]*cveRetry{},
+		wake:        make(chan struct{}, 1),
+		quit:        make(chan struct{}),
 	}
+	r.submit = r.postReport
+	return r
 }
 
 func (r *CVEExporter) Start(minutes int) error {
-	if _, err := os.Stat(r.pathToWatch); os.IsNotExist(err) {
-		if err = os.MkdirAll(r.pathToWatch, 0755); err != nil {
-			return fmt.Errorf("cannot create cve folder: %s", err)
-		}
+	r.delay = time.Duration(minutes) * time.Minute
+	if err := ensureDir(r.failedPath()); err != nil {
+		return fmt.Errorf("cannot create cve folder: %s", err)
 	}
 	// watch this folder for changes
 	if err := r.w.Add(r.pathToWatch); err != nil {
-		return fmt.Errorf(err.Error())
-	}
-	core.InfoLogger.Printf("inspecting CVE path for existing reports\n")
-	files, err := ioutil.ReadDir(r.pathToWatch)
-	core.CheckErr(err, "cannot read CVE path")
-	for _, file := range files {
-		// if the file is not a directory and is a json file
-		if !file.IsDir() && strings.HasSuffix(file.Name(), ".json") {
-			// works out the FQN of the cve file
-			cveFile := filepath.Join(r.pathToWatch, file.Name())
-			// submits it to pilot control
-			err = r.submit(cveFile, time.Duration(0), r.ctl)
-			// if there was an error
-			if err != nil {
-				// log the error
-				core.ErrorLogger.Printf("cannot submit CVE report: %s\n", err)
-			} else {
-				_ = os.Remove(cveFile)
-			}
+		return fmt.Errorf("cannot watch cve folder: %s", err)
+	}
+	logFor("cve").Info().Str("path", r.pathToWatch).Msg("inspecting CVE path for existing reports")
+	r.load()
+	entries, err := os.ReadDir(r.pathToWatch)
+	if err != nil {
+		return fmt.Errorf("cannot read CVE path: %s", err)
+	}
+	for _, entry := range entries {
+		// existing reports are uploaded straight away, or when their retry is due
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".json") {
+			r.enqueue(entry.Name(), 0)
 		}
 	}
-	core.InfoLogger.Printf("starting CVE exporter, listening for reports at %s, a delay of up to %v minutes will be applied before uploading a file\n", r.pathToWatch, minutes)
+	logFor("cve").Info().Str("path", r.pathToWatch).Msgf("starting CVE exporter, a delay of up to %v minutes will be applied before uploading a file", minutes)
 	go func() {
 		for {
 			select {
 			case event := <-r.w.Event:
-				// randomise the post over a 5-minute window to prevent all pilots hitting pilot-ctl at the same time
-				err = r.submit(event.Path, time.Duration(int64(rand.Intn(minutes*60)))*time.Second, r.ctl)
-				if err != nil {
-					core.ErrorLogger.Printf("cannot submit CVE report: %s\n", err)
+				// randomise the post over the upload delay window to prevent all pilots hitting pilot-ctl at the same time
+				var delay time.Duration
+				if r.delay > 0 {
+					delay = time.Duration(rand.Int63n(int64(r.delay/time.Second))) * time.Second
 				}
-			case err = <-r.w.Error:
-				core.WarningLogger.Println(err.Error())
+				logFor("cve").Info().Str("file", event.Path).Msgf("new CVE report detected, staggering publication by %v", delay)
+				r.enqueue(filepath.Base(event.Path), delay)
+			case err := <-r.w.Error:
+				logFor("cve").Warn().Err(err).Msg("CVE path watch")
 			case <-r.w.Closed:
 				return
 			}
 		}
 	}()
-	core.InfoLogger.Printf("watching for new CVE (*.json) reports at %s\n", r.pathToWatch)
+	go r.run()
+	logFor("cve").Info().Str("path", r.pathToWatch).Msg("watching for new CVE (*.json) reports")
 	// Start the watching process - it'll check for changes every 15 secs.
 	go func() {
-		err = r.w.Start(time.Second * 15)
-		if err != nil {
-			core.ErrorLogger.Printf(err.Error())
+		if err := r.w.Start(time.Second * 15); err != nil {
+			logFor("cve").Error().Err(err).Msg("CVE path watch stopped")
 		}
 	}()
 	return nil
 }
 
+// Pending returns the number of CVE reports waiting to be uploaded
+func (r *CVEExporter) Pending() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.queue)
+}
+
+// Status returns the state of the upload queue
+func (r *CVEExporter) Status() CVEStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := CVEStatus{
+		Enabled:     true,
+		Path:        r.pathToWatch,
+		Pending:     len(r.queue),
+		Failed:      countFiles(r.failedPath(), ".json"),
+		UploadDelay: Duration(r.delay),
+	}
+	for _, retry := range r.queue {
+		if retry.Attempts == 0 {
+			continue
+		}
+		s.Retrying++
+		if s.NextRetry == nil || retry.NextAttempt.Before(*s.NextRetry) {
+			next := retry.NextAttempt
+			s.NextRetry = &next
+			s.LastError = retry.LastError
+		}
+	}
+	return s
+}
+
 func (r *CVEExporter) Close() {
 	r.w.Close()
+	close(r.quit)
+}
+
+// failedPath returns the folder reports rejected by pilot control are moved to
+func (r *CVEExporter) failedPath() string {
+	return filepath.Join(r.pathToWatch, "failed")
+}
+
+// enqueue queues a report to be uploaded after the passed-in delay, unless it is already queued
+func (r *CVEExporter) enqueue(name string, delay time.Duration) {
+	r.mu.Lock()
+	if _, exists := r.queue[name]; exists {
+		r.mu.Unlock()
+		return
+	}
+	r.queue[name] = &cveRetry{NextAttempt: time.Now().Add(delay)}
+	r.save()
+	r.mu.Unlock()
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run uploads the reports as they become due until the exporter is closed
+func (r *CVEExporter) run() {
+	for {
+		due, next := r.due()
+		for _, name := range due {
+			select {
+			case <-r.quit:
+				return
+			default:
+			}
+			r.upload(name)
+		}
+		if len(due) > 0 {
+			continue
+		}
+		wait := time.Hour
+		if !next.IsZero() {
+			wait = time.Until(next)
+		}
+		select {
+		case <-r.quit:
+			return
+		case <-r.wake:
+		case <-time.After(wait):
+		}
+	}
 }
 
-func postReport(cveReportFile string, delay time.Duration, ctl *PilotCtl) error {
-	core.InfoLogger.Printf("new CVE report detected: %s\n", cveReportFile)
-	core.InfoLogger.Printf("staggering publication by %v\n", delay)
-	time.Sleep(delay)
-	content, err := os.ReadFile(cveReportFile)
+// due returns the names of the reports to upload now, oldest first, and when the next report is due
+func (r *CVEExporter) due() ([]string, time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var (
+		due  []string
+		next time.Time
+		now  = time.Now()
+	)
+	for name, retry := range r.queue {
+		if !retry.NextAttempt.After(now) {
+			due = append(due, name)
+		} else if next.IsZero() || retry.NextAttempt.Before(next) {
+			next = retry.NextAttempt
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		return r.queue[due[i]].NextAttempt.Before(r.queue[due[j]].NextAttempt)
+	})
+	return due, next
+}
+
+// upload submits a queued report: uploaded reports are removed, reports pilot control rejects are moved to the
+// failed folder and any other failure is retried with exponential backoff
+func (r *CVEExporter) upload(name string) {
+	file := filepath.Join(r.pathToWatch, name)
+	source, err := r.safeSubmit(file)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	retry := r.queue[name]
+	if retry == nil {
+		return
+	}
+	switch {
+	case err == nil:
+		logFor("cve").Info().Str("file", file).Str("format", source.Format).Str("scanner", source.Scanner).Str("version", source.Version).Msg("CVE report posted successfully")
+		// if the report was submitted successfully, removes it
+		_ = os.Remove(file)
+		delete(r.queue, name)
+	case os.IsNotExist(err):
+		// the report was removed in the meantime
+		delete(r.queue, name)
+	case invalidReport(err):
+		logFor("cve").Error().Err(err).Str("file", file).Msgf("CVE report cannot be uploaded, moving it to %s", r.failedPath())
+		r.fail(name, "CVE report %s was not uploaded and was moved to %s: %s", name, r.failedPath(), err)
+	case rejected(err):
+		logFor("cve").Error().Err(err).Str("file", file).Msgf("CVE report failed permanently, moving it to %s", r.failedPath())
+		r.fail(name, "CVE report %s failed permanently and was moved to %s: %s", name, r.failedPath(), err)
+	default:
+		retry.Attempts++
+		retry.LastError = err.Error()
+		wait := backoffTime(retry.Attempts + 1)
+		retry.NextAttempt = time.Now().Add(wait)
+		logFor("cve").Warn().Err(err).Str("file", file).Int("attempts", retry.Attempts).Msgf("cannot submit CVE report, retrying in %v", wait)
+	}
+	r.save()
+}
+
+// safeSubmit normalises and submits a report, returning a panic as an invalid report error, so that a report pilot
+// cannot process is moved to the failed folder rather than stopping pilot each time it is read from the queue
+func (r *CVEExporter) safeSubmit(file string) (source cveSource, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = &InvalidReportError{Err: fmt.Errorf("CVE report processing panic: %v", p)}
+		}
+	}()
+	// reports are normalised before being uploaded, so that pilot control reads a single schema
+	report, source, err := readCVEReport(file)
+	if err == nil {
+		err = r.submit(file, report)
+	}
+	return source, err
+}
+
+// fail moves a report that cannot be uploaded to the failed folder and raises an event
+func (r *CVEExporter) fail(name, format string, a ...interface{}) {
+	file := filepath.Join(r.pathToWatch, name)
+	if err := moveFile(file, filepath.Join(r.failedPath(), name)); err != nil {
+		logFor("cve").Error().Err(err).Str("file", file).Msg("cannot move failed CVE report")
+	}
+	if r.state != nil {
+		raiseEvent(r.state, SevError, "cve", format, a...)
+	}
+	delete(r.queue, name)
+}
+
+// load reads the persisted upload state of the reports still in the folder
+func (r *CVEExporter) load() {
+	if r.state == nil {
+		return
+	}
+	content, err := os.ReadFile(r.state.Path("cve_queue.json"))
 	if err != nil {
-		return err
+		return
 	}
-	err = ctl.SubmitCveReport(content)
+	queue := map[string]*cveRetry{}
+	if err = json.Unmarshal(content, &queue); err != nil {
+		logFor("cve").Warn().Err(err).Msg("cannot read CVE upload queue, retrying all reports")
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for name, retry := range queue {
+		if _, err = os.Stat(filepath.Join(r.pathToWatch, name)); err == nil {
+			r.queue[name] = retry
+		}
+	}
+}
+
+// save persists the upload state of the queued reports, so that backoff survives a restart
+func (r *CVEExporter) save() {
+	if r.state == nil {
+		return
+	}
+	content, err := json.Marshal(r.queue)
 	if err != nil {
-		return err
-	} else {
-		core.InfoLogger.Printf("CVE report %s posted successfully\n", cveReportFile)
-		// if the report was submitted successfully, removes it
-		_ = os.Remove(cveReportFile)
+		return
 	}
-	return nil
+	if err = writeFile(r.state.Path("cve_queue.json"), content); err != nil {
+		logFor("cve").Error().Err(err).Msg("cannot save CVE upload queue")
+	}
+}
+
+func (r *CVEExporter) postReport(cveReportFile string, content []byte) error {
+	ctx, span := startSpan(context.Background(), "cve.upload", attrFile.String(filepath.Base(cveReportFile)))
+	err := r.ctl.SubmitCveReport(ctx, content)
+	endSpan(span, err)
+	cveUploads.WithLabelValues(resultLabel(err)).Inc()
+	return err
 }
@@ -0,0 +1,166 @@
+/*
+   Pilot Host Controller
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	ctl "southwinds.dev/pilotctl/types"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCVEExporterRetry(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		attempts int
+	)
+	api := newTestPilotCtl(t, func(w http.ResponseWriter, req *http.Request) {
+		report := new(ctl.CveRequest)
+		_ = json.NewDecoder(req.Body).Decode(report)
+		// pilot control rejects malformed reports
+		if strings.Contains(string(report.Report), "bad") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		// the first upload fails with a transient error
+		if attempts++; attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+	dir := t.TempDir()
+	cvePath := filepath.Join(dir, "cve")
+	_ = os.MkdirAll(cvePath, dirPerm)
+	_ = os.WriteFile(filepath.Join(cvePath, "good.json"), []byte(`{"jsonVersion":4,"serverName":"good","scannedCves":{}}`), filePerm)
+	_ = os.WriteFile(filepath.Join(cvePath, "bad.json"), []byte(`{"jsonVersion":4,"serverName":"bad","scannedCves":{}}`), filePerm)
+	// reports in an unknown format are not uploaded
+	_ = os.WriteFile(filepath.Join(cvePath, "unknown.json"), []byte(`{"report":"unknown"}`), filePerm)
+	state := NewStateDir(dir)
+	_ = ensureDir(state.Submit(""))
+	r := NewCVEExporter(api, cvePath, state)
+	if err := r.Start(0); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	// the failed upload is retried after backing off
+	for i := 0; i < 20; i++ {
+		if s := r.Status(); s.Retrying == 1 {
+			if s.NextRetry == nil || len(s.LastError) == 0 {
+				t.Fatalf("retry state not reported: %+v", s)
+			}
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	for i := 0; i < 50 && r.Pending() > 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	s := r.Status()
+	if s.Pending != 0 || s.Failed != 2 {
+		t.Fatalf("unexpected status %+v", s)
+	}
+	mu.Lock()
+	if attempts != 2 {
+		t.Fatalf("expected the report to be uploaded on the second attempt, got %d attempts", attempts)
+	}
+	mu.Unlock()
+	if _, err := os.Stat(filepath.Join(cvePath, "good.json")); !os.IsNotExist(err) {
+		t.Fatalf("uploaded report not removed")
+	}
+	if _, err := os.Stat(filepath.Join(cvePath, "failed", "bad.json")); err != nil {
+		t.Fatalf("rejected report not moved to the failed folder: %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(cvePath, "failed", "unknown.json")); err != nil {
+		t.Fatalf("unknown report not moved to the failed folder: %s", err)
+	}
+	if events := countFiles(state.Submit(""), ".ev"); events != 2 {
+		t.Fatalf("expected two failed report events, got %d", events)
+	}
+}
+
+func TestCVEExporterIncompleteReport(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		uploaded int
+	)
+	api := newTestPilotCtl(t, func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		uploaded++
+		mu.Unlock()
+	})
+	dir := t.TempDir()
+	cvePath := filepath.Join(dir, "cve")
+	_ = os.MkdirAll(cvePath, dirPerm)
+	// the scanner is still writing the report
+	report := filepath.Join(cvePath, "report.json")
+	_ = os.WriteFile(report, []byte(`{"jsonVersion":4,"serverName":"host","scann`), filePerm)
+	state := NewStateDir(dir)
+	_ = ensureDir(state.Submit(""))
+	r := NewCVEExporter(api, cvePath, state)
+	if err := r.Start(0); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	for i := 0; i < 20 && r.Status().Retrying == 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if s := r.Status(); s.Retrying != 1 || s.Failed != 0 || !strings.Contains(s.LastError, "incomplete") {
+		t.Fatalf("expected the incomplete report to be retried, got %+v", s)
+	}
+	// the completed report is uploaded on the next attempt
+	_ = os.WriteFile(report, []byte(`{"jsonVersion":4,"serverName":"host","scannedCves":{}}`), filePerm)
+	for i := 0; i < 50 && r.Pending() > 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if s := r.Status(); s.Pending != 0 || s.Failed != 0 || uploaded != 1 {
+		t.Fatalf("expected the completed report to be uploaded, got %+v after %d uploads", s, uploaded)
+	}
+}
+
+func TestCVEExporterPanic(t *testing.T) {
+	dir := t.TempDir()
+	cvePath := filepath.Join(dir, "cve")
+	_ = os.MkdirAll(cvePath, dirPerm)
+	_ = os.WriteFile(filepath.Join(cvePath, "report.json"), []byte(`{"jsonVersion":4,"serverName":"host","scannedCves":{}}`), filePerm)
+	state := NewStateDir(dir)
+	_ = ensureDir(state.Submit(""))
+	r := NewCVEExporter(nil, cvePath, state)
+	r.submit = func(string, []byte) error {
+		panic("unexpected report")
+	}
+	if err := r.Start(0); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	for i := 0; i < 50 && r.Pending() > 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	// the report that caused the panic is moved out of the queue
+	if _, err := os.Stat(filepath.Join(cvePath, "failed", "report.json")); err != nil {
+		t.Fatalf("report not moved to the failed folder: %s", err)
+	}
+}
@@ -0,0 +1,738 @@
+/*
+   Pilot Host Controller
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the CVE report formats the exporter reads
+const (
+	CVEFormatVuls      = "vuls"
+	CVEFormatTrivy     = "trivy"
+	CVEFormatGrype     = "grype"
+	CVEFormatCycloneDX = "cyclonedx-vex"
+	CVEFormatSARIF     = "sarif"
+)
+
+// InvalidReportError a complete CVE report that is not in a supported format or is not valid in its format, so that
+// uploading it again cannot succeed
+type InvalidReportError struct {
+	Format string
+	Err    error
+}
+
+func (e *InvalidReportError) Error() string {
+	if len(e.Format) == 0 {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("invalid %s report: %s", e.Format, e.Err)
+}
+
+// invalidReport returns true if the error is caused by the content of a CVE report
+func invalidReport(err error) bool {
+	var e *InvalidReportError
+	return errors.As(err, &e)
+}
+
+// cveSource describes the scanner that produced a CVE report
+type cveSource struct {
+	Format  string
+	Scanner string
+	Version string
+}
+
+// readCVEReport reads a CVE report, detects its format and normalises it into the Vuls JSON schema pilot control
+// reads, tagged with the scanner that produced it
+// read errors, e.g. permission denied, and reports that end early, e.g. because the scanner is still writing them,
+// are not InvalidReportError, so that they are retried
+func readCVEReport(file string) ([]byte, cveSource, error) {
+	content, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, cveSource{}, err
+	}
+	if err != nil {
+		return nil, cveSource{}, fmt.Errorf("cannot read CVE report: %s", err)
+	}
+	return normaliseCVEReport(content)
+}
+
+// incompleteJSON returns true if content could not be parsed because it ends early
+func incompleteJSON(content []byte, err error) bool {
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var syntaxErr *json.SyntaxError
+	return errors.As(err, &syntaxErr) && syntaxErr.Offset >= int64(len(content))
+}
+
+// normaliseCVEReport detects the format of a CVE report and converts it into the Vuls JSON schema
+func normaliseCVEReport(content []byte) ([]byte, cveSource, error) {
+	var probe struct {
+		JSONVersion   *int            `json:"jsonVersion"`
+		ScannedCves   json.RawMessage `json:"scannedCves"`
+		SchemaVersion *int            `json:"SchemaVersion"`
+		ArtifactName  string          `json:"ArtifactName"`
+		Descriptor    *struct {
+			Name string `json:"name"`
+		} `json:"descriptor"`
+		BomFormat       string          `json:"bomFormat"`
+		Vulnerabilities json.RawMessage `json:"vulnerabilities"`
+		Schema          string          `json:"$schema"`
+		// a string in SARIF logs, a number in CycloneDX documents
+		Version json.RawMessage `json:"version"`
+		Runs    json.RawMessage `json:"runs"`
+	}
+	if err := json.Unmarshal(content, &probe); err != nil {
+		if incompleteJSON(content, err) {
+			return nil, cveSource{}, fmt.Errorf("CVE report is incomplete, it might still be written: %s", err)
+		}
+		return nil, cveSource{}, &InvalidReportError{Err: fmt.Errorf("CVE report is not a JSON object: %s", err)}
+	}
+	var (
+		report *vulsReport
+		err    error
+		format string
+	)
+	switch {
+	case probe.JSONVersion != nil && probe.ScannedCves != nil:
+		return tagVulsReport(content)
+	case probe.SchemaVersion != nil && len(probe.ArtifactName) > 0:
+		format = CVEFormatTrivy
+		report, err = convertTrivyReport(content)
+	case probe.Descriptor != nil && probe.Descriptor.Name == "grype":
+		format = CVEFormatGrype
+		report, err = convertGrypeReport(content)
+	case probe.BomFormat == "CycloneDX":
+		format = CVEFormatCycloneDX
+		if probe.Vulnerabilities == nil {
+			err = fmt.Errorf("the CycloneDX document has no vulnerabilities, only VEX documents are supported")
+			break
+		}
+		report, err = convertCycloneDXReport(content)
+	case probe.Runs != nil && (string(probe.Version) == `"2.1.0"` || strings.Contains(strings.ToLower(probe.Schema), "sarif")):
+		format = CVEFormatSARIF
+		report, err = convertSARIFReport(content)
+	default:
+		return nil, cveSource{}, &InvalidReportError{Err: fmt.Errorf("unrecognised CVE report format, expected a Vuls, Trivy, Grype, CycloneDX VEX or SARIF JSON report")}
+	}
+	if err != nil {
+		return nil, cveSource{}, &InvalidReportError{Format: format, Err: err}
+	}
+	normalised, err := json.Marshal(report)
+	if err != nil {
+		return nil, cveSource{}, fmt.Errorf("cannot marshal normalised CVE report: %s", err)
+	}
+	return normalised, cveSource{Format: report.ReportFormat, Scanner: report.Scanner, Version: report.ScannerVersion}, nil
+}
+
+// tagVulsReport validates a Vuls report and tags it with the scanner, keeping all its fields
+func tagVulsReport(content []byte) ([]byte, cveSource, error) {
+	var report map[string]json.RawMessage
+	if err := json.Unmarshal(content, &report); err != nil {
+		return nil, cveSource{}, &InvalidReportError{Format: CVEFormatVuls, Err: err}
+	}
+	var cves map[string]struct {
+		CveID string `json:"cveID"`
+	}
+	if err := json.Unmarshal(report["scannedCves"], &cves); err != nil {
+		return nil, cveSource{}, &InvalidReportError{Format: CVEFormatVuls, Err: fmt.Errorf("cannot read scannedCves: %s", err)}
+	}
+	var version string
+	_ = json.Unmarshal(report["scannedVersion"], &version)
+	source := cveSource{Format: CVEFormatVuls, Scanner: CVEFormatVuls, Version: version}
+	report["scanner"], _ = json.Marshal(source.Scanner)
+	report["scannerVersion"], _ = json.Marshal(source.Version)
+	report["reportFormat"], _ = json.Marshal(source.Format)
+	tagged, err := json.Marshal(report)
+	if err != nil {
+		return nil, cveSource{}, fmt.Errorf("cannot marshal tagged CVE report: %s", err)
+	}
+	return tagged, source, nil
+}
+
+// vulsReport the subset of the Vuls JSON schema pilot control reads, tagged with the scanner and format of the
+// original report
+type vulsReport struct {
+	JSONVersion    int                    `json:"jsonVersion"`
+	ServerName     string                 `json:"serverName"`
+	Family         string                 `json:"family"`
+	Release        string                 `json:"release"`
+	ScannedAt      time.Time              `json:"scannedAt"`
+	ScannedVersion string                 `json:"scannedVersion"`
+	ScannedBy      string                 `json:"scannedBy"`
+	ReportedAt     time.Time              `json:"reportedAt"`
+	ScannedCves    map[string]*vulsCve    `json:"scannedCves"`
+	Packages       map[string]vulsPackage `json:"packages"`
+	Scanner        string                 `json:"scanner"`
+	ScannerVersion string                 `json:"scannerVersion"`
+	ReportFormat   string                 `json:"reportFormat"`
+}
+
+type vulsCve struct {
+	CveID            string                      `json:"cveID"`
+	Confidences      []vulsConfidence            `json:"confidences"`
+	AffectedPackages []vulsAffectedPackage       `json:"affectedPackages"`
+	CveContents      map[string][]vulsCveContent `json:"cveContents"`
+}
+
+type vulsConfidence struct {
+	Score           int    `json:"score"`
+	DetectionMethod string `json:"detectionMethod"`
+}
+
+type vulsAffectedPackage struct {
+	Name        string `json:"name"`
+	NotFixedYet bool   `json:"notFixedYet"`
+	FixState    string `json:"fixState,omitempty"`
+	FixedIn     string `json:"fixedIn,omitempty"`
+}
+
+type vulsCveContent struct {
+	Type          string          `json:"type"`
+	CveID         string          `json:"cveID"`
+	Title         string          `json:"title"`
+	Summary       string          `json:"summary"`
+	Cvss2Score    float64         `json:"cvss2Score"`
+	Cvss2Vector   string          `json:"cvss2Vector"`
+	Cvss2Severity string          `json:"cvss2Severity"`
+	Cvss3Score    float64         `json:"cvss3Score"`
+	Cvss3Vector   string          `json:"cvss3Vector"`
+	Cvss3Severity string          `json:"cvss3Severity"`
+	SourceLink    string          `json:"sourceLink"`
+	References    []vulsReference `json:"references"`
+	Published     time.Time       `json:"published"`
+	LastModified  time.Time       `json:"lastModified"`
+}
+
+type vulsReference struct {
+	Link   string `json:"link"`
+	Source string `json:"source"`
+}
+
+type vulsPackage struct {
+	Name       string `json:"name"`
+	Version    string `json:"version"`
+	NewVersion string `json:"newVersion"`
+}
+
+func newVulsReport(format, scanner, version string, scannedAt time.Time) *vulsReport {
+	hostname, _ := os.Hostname()
+	if scannedAt.IsZero() {
+		scannedAt = time.Now().UTC()
+	}
+	return &vulsReport{
+		JSONVersion:    4,
+		ServerName:     hostname,
+		ScannedAt:      scannedAt,
+		ScannedVersion: version,
+		ScannedBy:      hostname,
+		ReportedAt:     time.Now().UTC(),
+		ScannedCves:    map[string]*vulsCve{},
+		Packages:       map[string]vulsPackage{},
+		Scanner:        scanner,
+		ScannerVersion: version,
+		ReportFormat:   format,
+	}
+}
+
+// add records a vulnerability of a package, a vulnerability reported for several packages is recorded once
+func (v *vulsReport) add(pkg vulsPackage, affected vulsAffectedPackage, content vulsCveContent) {
+	cve := v.ScannedCves[content.CveID]
+	if cve == nil {
+		// the content type and detection method follow the Vuls convention, e.g. trivy and TrivyMatch
+		cve = &vulsCve{
+			CveID:       content.CveID,
+			Confidences: []vulsConfidence{{Score: 100, DetectionMethod: capitalise(v.Scanner) + "Match"}},
+			CveContents: map[string][]vulsCveContent{},
+		}
+		content.Type = v.Scanner
+		cve.CveContents[v.Scanner] = []vulsCveContent{content}
+		v.ScannedCves[content.CveID] = cve
+	}
+	if len(affected.Name) == 0 {
+		return
+	}
+	for _, p := range cve.AffectedPackages {
+		if p.Name == affected.Name {
+			return
+		}
+	}
+	cve.AffectedPackages = append(cve.AffectedPackages, affected)
+	if _, exists := v.Packages[pkg.Name]; !exists {
+		v.Packages[pkg.Name] = pkg
+	}
+}
+
+type trivyReport struct {
+	CreatedAt time.Time `json:"CreatedAt"`
+	Trivy     struct {
+		Version string `json:"Version"`
+	} `json:"Trivy"`
+	Metadata struct {
+		OS *struct {
+			Family string `json:"Family"`
+			Name   string `json:"Name"`
+		} `json:"OS"`
+	} `json:"Metadata"`
+	Results []struct {
+		Target          string `json:"Target"`
+		Vulnerabilities []struct {
+			VulnerabilityID  string     `json:"VulnerabilityID"`
+			PkgName          string     `json:"PkgName"`
+			InstalledVersion string     `json:"InstalledVersion"`
+			FixedVersion     string     `json:"FixedVersion"`
+			Status           string     `json:"Status"`
+			Title            string     `json:"Title"`
+			Description      string     `json:"Description"`
+			Severity         string     `json:"Severity"`
+			PrimaryURL       string     `json:"PrimaryURL"`
+			References       []string   `json:"References"`
+			PublishedDate    *time.Time `json:"PublishedDate"`
+			LastModifiedDate *time.Time `json:"LastModifiedDate"`
+			CVSS             map[string]struct {
+				V2Vector string  `json:"V2Vector"`
+				V3Vector string  `json:"V3Vector"`
+				V2Score  float64 `json:"V2Score"`
+				V3Score  float64 `json:"V3Score"`
+			} `json:"CVSS"`
+		} `json:"Vulnerabilities"`
+	} `json:"Results"`
+}
+
+func convertTrivyReport(content []byte) (*vulsReport, error) {
+	r := new(trivyReport)
+	if err := json.Unmarshal(content, r); err != nil {
+		return nil, err
+	}
+	report := newVulsReport(CVEFormatTrivy, "trivy", r.Trivy.Version, r.CreatedAt)
+	if r.Metadata.OS != nil {
+		report.Family, report.Release = r.Metadata.OS.Family, r.Metadata.OS.Name
+	}
+	for _, result := range r.Results {
+		for _, vuln := range result.Vulnerabilities {
+			if len(vuln.VulnerabilityID) == 0 || len(vuln.PkgName) == 0 {
+				return nil, fmt.Errorf("vulnerability without id or package in %s", result.Target)
+			}
+			c := vulsCveContent{
+				CveID:         vuln.VulnerabilityID,
+				Title:         vuln.Title,
+				Summary:       vuln.Description,
+				Cvss3Severity: capitalise(vuln.Severity),
+				SourceLink:    vuln.PrimaryURL,
+				Published:     timeValue(vuln.PublishedDate),
+				LastModified:  timeValue(vuln.LastModifiedDate),
+			}
+			// prefer the NVD scores, then those of the first vendor in alphabetical order
+			vendors := make([]string, 0, len(vuln.CVSS))
+			for vendor := range vuln.CVSS {
+				vendors = append(vendors, vendor)
+			}
+			sort.Slice(vendors, func(i, j int) bool {
+				return vendors[i] == "nvd" || (vendors[j] != "nvd" && vendors[i] < vendors[j])
+			})
+			if len(vendors) > 0 {
+				cvss := vuln.CVSS[vendors[0]]
+				c.Cvss2Score, c.Cvss2Vector, c.Cvss2Severity = cvss.V2Score, cvss.V2Vector, severityOf(cvss.V2Score)
+				c.Cvss3Score, c.Cvss3Vector = cvss.V3Score, cvss.V3Vector
+			}
+			for _, ref := range vuln.References {
+				c.References = append(c.References, vulsReference{Link: ref, Source: "trivy"})
+			}
+			report.add(
+				vulsPackage{Name: vuln.PkgName, Version: vuln.InstalledVersion, NewVersion: vuln.FixedVersion},
+				vulsAffectedPackage{Name: vuln.PkgName, NotFixedYet: len(vuln.FixedVersion) == 0, FixState: vuln.Status, FixedIn: vuln.FixedVersion},
+				c)
+		}
+	}
+	return report, nil
+}
+
+type grypeCVSS struct {
+	Version string `json:"version"`
+	Vector  string `json:"vector"`
+	Metrics struct {
+		BaseScore float64 `json:"baseScore"`
+	} `json:"metrics"`
+}
+
+type grypeReport struct {
+	Matches []struct {
+		Vulnerability struct {
+			ID          string      `json:"id"`
+			DataSource  string      `json:"dataSource"`
+			Severity    string      `json:"severity"`
+			URLs        []string    `json:"urls"`
+			Description string      `json:"description"`
+			CVSS        []grypeCVSS `json:"cvss"`
+			Fix         struct {
+				Versions []string `json:"versions"`
+				State    string   `json:"state"`
+			} `json:"fix"`
+		} `json:"vulnerability"`
+		RelatedVulnerabilities []struct {
+			ID   string      `json:"id"`
+			CVSS []grypeCVSS `json:"cvss"`
+		} `json:"relatedVulnerabilities"`
+		Artifact struct {
+			Name    string `json:"name"`
+			Version string `json:"version"`
+		} `json:"artifact"`
+	} `json:"matches"`
+	Distro struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	} `json:"distro"`
+	Descriptor struct {
+		Version   string `json:"version"`
+		Timestamp string `json:"timestamp"`
+	} `json:"descriptor"`
+}
+
+func convertGrypeReport(content []byte) (*vulsReport, error) {
+	r := new(grypeReport)
+	if err := json.Unmarshal(content, r); err != nil {
+		return nil, err
+	}
+	report := newVulsReport(CVEFormatGrype, "grype", r.Descriptor.Version, parseTime(r.Descriptor.Timestamp))
+	report.Family, report.Release = r.Distro.Name, r.Distro.Version
+	for _, match := range r.Matches {
+		vuln := match.Vulnerability
+		if len(vuln.ID) == 0 || len(match.Artifact.Name) == 0 {
+			return nil, fmt.Errorf("match without vulnerability id or artifact")
+		}
+		c := vulsCveContent{
+			CveID:         vuln.ID,
+			Summary:       vuln.Description,
+			Cvss3Severity: capitalise(vuln.Severity),
+			SourceLink:    vuln.DataSource,
+		}
+		// the scores of vulnerabilities matched through a distribution advisory are in the related NVD record
+		scores := vuln.CVSS
+		for _, related := range match.RelatedVulnerabilities {
+			if len(scores) == 0 {
+				scores = related.CVSS
+			}
+		}
+		for _, cvss := range scores {
+			if strings.HasPrefix(cvss.Version, "2") {
+				c.Cvss2Score, c.Cvss2Vector, c.Cvss2Severity = cvss.Metrics.BaseScore, cvss.Vector, severityOf(cvss.Metrics.BaseScore)
+			} else if cvss.Metrics.BaseScore > c.Cvss3Score {
+				c.Cvss3Score, c.Cvss3Vector = cvss.Metrics.BaseScore, cvss.Vector
+			}
+		}
+		for _, url := range vuln.URLs {
+			c.References = append(c.References, vulsReference{Link: url, Source: "grype"})
+		}
+		var fixedIn string
+		if len(vuln.Fix.Versions) > 0 {
+			fixedIn = vuln.Fix.Versions[0]
+		}
+		report.add(
+			vulsPackage{Name: match.Artifact.Name, Version: match.Artifact.Version, NewVersion: fixedIn},
+			vulsAffectedPackage{Name: match.Artifact.Name, NotFixedYet: vuln.Fix.State != "fixed", FixState: vuln.Fix.State, FixedIn: fixedIn},
+			c)
+	}
+	return report, nil
+}
+
+type cycloneDXTool struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type cycloneDXReport struct {
+	Metadata struct {
+		Timestamp string `json:"timestamp"`
+		// an array of tools up to CycloneDX 1.4, an object with tool components from 1.5
+		Tools json.RawMessage `json:"tools"`
+	} `json:"metadata"`
+	Components []struct {
+		BomRef  string `json:"bom-ref"`
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	} `json:"components"`
+	Vulnerabilities []struct {
+		ID     string `json:"id"`
+		Source struct {
+			URL string `json:"url"`
+		} `json:"source"`
+		Ratings []struct {
+			Score    float64 `json:"score"`
+			Severity string  `json:"severity"`
+			Method   string  `json:"method"`
+			Vector   string  `json:"vector"`
+		} `json:"ratings"`
+		Description string `json:"description"`
+		Detail      string `json:"detail"`
+		Advisories  []struct {
+			URL string `json:"url"`
+		} `json:"advisories"`
+		Published string `json:"published"`
+		Updated   string `json:"updated"`
+		Analysis  struct {
+			State string `json:"state"`
+		} `json:"analysis"`
+		Affects []struct {
+			Ref string `json:"ref"`
+		} `json:"affects"`
+	} `json:"vulnerabilities"`
+}
+
+// tool returns the first tool that produced the CycloneDX document
+func (r *cycloneDXReport) tool() cycloneDXTool {
+	var tools []cycloneDXTool
+	if err := json.Unmarshal(r.Metadata.Tools, &tools); err != nil {
+		var v15 struct {
+			Components []cycloneDXTool `json:"components"`
+		}
+		_ = json.Unmarshal(r.Metadata.Tools, &v15)
+		tools = v15.Components
+	}
+	if len(tools) == 0 || len(tools[0].Name) == 0 {
+		return cycloneDXTool{Name: "cyclonedx"}
+	}
+	return cycloneDXTool{Name: strings.ToLower(tools[0].Name), Version: tools[0].Version}
+}
+
+func convertCycloneDXReport(content []byte) (*vulsReport, error) {
+	r := new(cycloneDXReport)
+	if err := json.Unmarshal(content, r); err != nil {
+		return nil, err
+	}
+	tool := r.tool()
+	report := newVulsReport(CVEFormatCycloneDX, tool.Name, tool.Version, parseTime(r.Metadata.Timestamp))
+	components := map[string]vulsPackage{}
+	for _, c := range r.Components {
+		components[c.BomRef] = vulsPackage{Name: c.Name, Version: c.Version}
+	}
+	for _, vuln := range r.Vulnerabilities {
+		if len(vuln.ID) == 0 {
+			return nil, fmt.Errorf("vulnerability without id")
+		}
+		// the VEX analysis states the host is not exploitable
+		switch vuln.Analysis.State {
+		case "not_affected", "false_positive", "resolved", "resolved_with_pedigree":
+			continue
+		}
+		c := vulsCveContent{
+			CveID:        vuln.ID,
+			Title:        vuln.Description,
+			Summary:      vuln.Detail,
+			SourceLink:   vuln.Source.URL,
+			Published:    parseTime(vuln.Published),
+			LastModified: parseTime(vuln.Updated),
+		}
+		if len(c.Summary) == 0 {
+			c.Summary = vuln.Description
+		}
+		for _, rating := range vuln.Ratings {
+			if rating.Method == "CVSSv2" {
+				c.Cvss2Score, c.Cvss2Vector, c.Cvss2Severity = rating.Score, rating.Vector, capitalise(rating.Severity)
+			} else if rating.Score >= c.Cvss3Score {
+				c.Cvss3Score, c.Cvss3Vector, c.Cvss3Severity = rating.Score, rating.Vector, capitalise(rating.Severity)
+			}
+		}
+		for _, advisory := range vuln.Advisories {
+			c.References = append(c.References, vulsReference{Link: advisory.URL, Source: "advisory"})
+		}
+		if len(vuln.Affects) == 0 {
+			report.add(vulsPackage{}, vulsAffectedPackage{}, c)
+		}
+		for _, affects := range vuln.Affects {
+			// references to components of other documents are in the form urn:cdx:serial/version#bom-ref
+			pkg, found := components[affects.Ref]
+			if !found {
+				pkg, found = components[affects.Ref[strings.LastIndex(affects.Ref, "#")+1:]]
+			}
+			if !found {
+				pkg = vulsPackage{Name: affects.Ref}
+			}
+			report.add(pkg, vulsAffectedPackage{Name: pkg.Name, NotFixedYet: true, FixState: vuln.Analysis.State}, c)
+		}
+	}
+	return report, nil
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifReport struct {
+	Runs []struct {
+		Tool struct {
+			Driver struct {
+				Name            string `json:"name"`
+				Version         string `json:"version"`
+				SemanticVersion string `json:"semanticVersion"`
+				Rules           []struct {
+					ID               string       `json:"id"`
+					ShortDescription sarifMessage `json:"shortDescription"`
+					FullDescription  sarifMessage `json:"fullDescription"`
+					HelpURI          string       `json:"helpUri"`
+					Properties       struct {
+						SecuritySeverity string `json:"security-severity"`
+					} `json:"properties"`
+				} `json:"rules"`
+			} `json:"driver"`
+		} `json:"tool"`
+		Results []struct {
+			RuleID    string       `json:"ruleId"`
+			RuleIndex *int         `json:"ruleIndex"`
+			Level     string       `json:"level"`
+			Message   sarifMessage `json:"message"`
+			Locations []struct {
+				PhysicalLocation struct {
+					ArtifactLocation struct {
+						URI string `json:"uri"`
+					} `json:"artifactLocation"`
+				} `json:"physicalLocation"`
+			} `json:"locations"`
+		} `json:"results"`
+	} `json:"runs"`
+}
+
+// the package details scanners such as Trivy write in the SARIF result messages
+var (
+	sarifPackage   = regexp.MustCompile(`(?m)^Package: (.+)$`)
+	sarifInstalled = regexp.MustCompile(`(?m)^Installed Version: (.+)$`)
+	sarifFixed     = regexp.MustCompile(`(?m)^Fixed Version: (.+)$`)
+)
+
+func convertSARIFReport(content []byte) (*vulsReport, error) {
+	r := new(sarifReport)
+	if err := json.Unmarshal(content, r); err != nil {
+		return nil, err
+	}
+	if len(r.Runs) == 0 {
+		return nil, fmt.Errorf("the SARIF log has no runs")
+	}
+	driver := r.Runs[0].Tool.Driver
+	version := driver.SemanticVersion
+	if len(version) == 0 {
+		version = driver.Version
+	}
+	scanner := strings.ToLower(driver.Name)
+	if len(scanner) == 0 {
+		scanner = CVEFormatSARIF
+	}
+	report := newVulsReport(CVEFormatSARIF, scanner, version, time.Time{})
+	for _, run := range r.Runs {
+		rules := run.Tool.Driver.Rules
+		for _, result := range run.Results {
+			id := result.RuleID
+			if len(id) == 0 && result.RuleIndex != nil && *result.RuleIndex >= 0 && *result.RuleIndex < len(rules) {
+				id = rules[*result.RuleIndex].ID
+			}
+			if len(id) == 0 {
+				return nil, fmt.Errorf("result without rule id")
+			}
+			c := vulsCveContent{CveID: id, Summary: result.Message.Text, Cvss3Severity: levelSeverity(result.Level)}
+			for _, rule := range rules {
+				if rule.ID != id {
+					continue
+				}
+				c.Title, c.SourceLink = rule.ShortDescription.Text, rule.HelpURI
+				if len(rule.FullDescription.Text) > 0 {
+					c.Summary = rule.FullDescription.Text
+				}
+				if score, err := strconv.ParseFloat(rule.Properties.SecuritySeverity, 64); err == nil {
+					c.Cvss3Score, c.Cvss3Severity = score, severityOf(score)
+				}
+				break
+			}
+			pkg := vulsPackage{
+				Name:       submatch(sarifPackage, result.Message.Text),
+				Version:    submatch(sarifInstalled, result.Message.Text),
+				NewVersion: submatch(sarifFixed, result.Message.Text),
+			}
+			if len(pkg.Name) == 0 && len(result.Locations) > 0 {
+				pkg.Name = result.Locations[0].PhysicalLocation.ArtifactLocation.URI
+			}
+			report.add(pkg, vulsAffectedPackage{Name: pkg.Name, NotFixedYet: len(pkg.NewVersion) == 0, FixedIn: pkg.NewVersion}, c)
+		}
+	}
+	return report, nil
+}
+
+// severityOf returns the CVSS severity of a score
+func severityOf(score float64) string {
+	switch {
+	case score >= 9:
+		return "Critical"
+	case score >= 7:
+		return "High"
+	case score >= 4:
+		return "Medium"
+	case score > 0:
+		return "Low"
+	}
+	return ""
+}
+
+// levelSeverity maps a SARIF result level to a severity
+func levelSeverity(level string) string {
+	switch level {
+	case "error":
+		return "High"
+	case "warning":
+		return "Medium"
+	case "note":
+		return "Low"
+	}
+	return ""
+}
+
+// capitalise returns a word in lower case with its first letter in upper case, e.g. HIGH -> High
+func capitalise(s string) string {
+	if len(s) == 0 {
+		return s
+	}
+	s = strings.ToLower(s)
+	return strings.ToUpper(s[:1]) + s[1:]
+}
+
+func submatch(re *regexp.Regexp, s string) string {
+	if m := re.FindStringSubmatch(s); len(m) > 1 {
+		return strings.TrimSpace(m[1])
+	}
+	return ""
+}
+
+// parseTime parses an RFC3339 time, returning the zero time if it cannot
+func parseTime(value string) time.Time {
+	t, _ := time.Parse(time.RFC3339, value)
+	return t
+}
+
+func timeValue(t *time.Time) time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	return *t
+}
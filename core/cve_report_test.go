@@ -0,0 +1,104 @@
+/*
+   Pilot Host Controller
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNormaliseCVEReport(t *testing.T) {
+	cases := []struct {
+		file    string
+		source  cveSource
+		cve     string
+		pkg     string
+		fixed   bool
+		score   float64
+		skipped string
+	}{
+		{"cve/sample_cve_report.json", cveSource{CVEFormatVuls, "vuls", "v0.19.8"}, "CVE-2012-6655", "accountsservice", false, 0, ""},
+		{"testdata/cve/trivy.json", cveSource{CVEFormatTrivy, "trivy", "0.49.1"}, "CVE-2023-4911", "libc6", true, 7.8, ""},
+		{"testdata/cve/grype.json", cveSource{CVEFormatGrype, "grype", "0.74.7"}, "CVE-2022-3715", "bash", false, 7.8, ""},
+		{"testdata/cve/cyclonedx.json", cveSource{CVEFormatCycloneDX, "trivy", "0.49.1"}, "CVE-2023-5678", "openssl", false, 5.3, "CVE-2023-38546"},
+		{"testdata/cve/sarif.json", cveSource{CVEFormatSARIF, "trivy", "0.49.1"}, "CVE-2024-2511", "libssl3", true, 5.9, ""},
+	}
+	for _, c := range cases {
+		t.Run(filepath.Base(c.file), func(t *testing.T) {
+			content, source, err := readCVEReport(c.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if source != c.source {
+				t.Fatalf("expected source %+v, got %+v", c.source, source)
+			}
+			report := new(vulsReport)
+			if err = json.Unmarshal(content, report); err != nil {
+				t.Fatal(err)
+			}
+			if report.Scanner != c.source.Scanner || report.ScannerVersion != c.source.Version || report.ReportFormat != c.source.Format {
+				t.Fatalf("report not tagged with its scanner: %s %s %s", report.Scanner, report.ScannerVersion, report.ReportFormat)
+			}
+			cve := report.ScannedCves[c.cve]
+			if cve == nil || len(cve.AffectedPackages) == 0 || cve.AffectedPackages[0].Name != c.pkg {
+				t.Fatalf("%s affecting %s not found in %s", c.cve, c.pkg, content)
+			}
+			if cve.AffectedPackages[0].NotFixedYet == c.fixed {
+				t.Fatalf("unexpected fix state of %s: %+v", c.cve, cve.AffectedPackages[0])
+			}
+			if c.source.Format != CVEFormatVuls && cve.CveContents[c.source.Scanner][0].Cvss3Score != c.score {
+				t.Fatalf("unexpected %s score: %+v", c.cve, cve.CveContents)
+			}
+			if _, found := report.ScannedCves[c.skipped]; len(c.skipped) > 0 && found {
+				t.Fatalf("%s is not exploitable and should not be reported", c.skipped)
+			}
+		})
+	}
+}
+
+func TestNormaliseCVEReportInvalid(t *testing.T) {
+	for _, content := range []string{
+		`not json`,
+		`{"report":"unknown"}`,
+		`{"bomFormat":"CycloneDX","specVersion":"1.5","components":[]}`,
+		`{"SchemaVersion":2,"ArtifactName":"host","Results":[{"Target":"host","Vulnerabilities":[{"PkgName":"bash"}]}]}`,
+		// -1 is the SARIF default rule index, meaning the result has no rule
+		`{"version":"2.1.0","runs":[{"tool":{"driver":{"name":"scanner","rules":[{"id":"CVE-2024-0001"}]}},"results":[{"ruleIndex":-1,"message":{"text":"found"}}]}]}`,
+	} {
+		if _, _, err := normaliseCVEReport([]byte(content)); !invalidReport(err) {
+			t.Fatalf("expected %s to be invalid, got %v", content, err)
+		}
+	}
+	if _, _, err := readCVEReport(filepath.Join(t.TempDir(), "missing.json")); !os.IsNotExist(err) {
+		t.Fatalf("expected a missing report error, got %v", err)
+	}
+	// reports still being written and read errors are retried
+	for _, content := range []string{``, `{"jsonVersion":4,"scannedCves":{"CVE-2022`, "{\"runs\": [\n"} {
+		if _, _, err := normaliseCVEReport([]byte(content)); err == nil || invalidReport(err) {
+			t.Fatalf("expected %q to be incomplete, got %v", content, err)
+		}
+	}
+	dir := filepath.Join(t.TempDir(), "report.json")
+	_ = os.Mkdir(dir, dirPerm)
+	if _, _, err := readCVEReport(dir); err == nil || invalidReport(err) {
+		t.Fatalf("expected a read error, got %v", err)
+	}
+}
@@ -20,15 +20,63 @@ package core
 
 import (
 	"encoding/json"
+	"fmt"
+	"log/syslog"
 	"os"
 	"path/filepath"
 	ctl "southwinds.dev/pilotctl/types"
+	"time"
 )
 
+// event severities, as defined by syslog
+const (
+	SevError   = int(syslog.LOG_ERR)
+	SevWarning = int(syslog.LOG_WARNING)
+	SevNotice  = int(syslog.LOG_NOTICE)
+	SevInfo    = int(syslog.LOG_INFO)
+)
+
+// hostEvent an event raised by pilot itself, serialised in the same format as the syslog events
+// queued for submission to pilot control
+type hostEvent struct {
+	Client   string    `json:"client,omitempty"`
+	Hostname string    `json:"hostname,omitempty"`
+	Severity int       `json:"severity"`
+	Time     time.Time `json:"time"`
+	Content  string    `json:"content"`
+	Tag      string    `json:"tag"`
+	HostUUID string    `json:"host_uuid,omitempty"`
+}
+
+// raiseEvent queues an event raised by pilot to be sent to pilot control with the next ping
+func raiseEvent(state *StateDir, severity int, tag, format string, a ...interface{}) {
+	event := hostEvent{
+		Client:   "pilot",
+		Severity: severity,
+		Time:     time.Now().UTC(),
+		Content:  fmt.Sprintf(format, a...),
+		Tag:      tag,
+	}
+	if A != nil {
+		event.HostUUID = A.HostUUID
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		event.Hostname = hostname
+	}
+	bytes, err := json.Marshal(event)
+	if err != nil {
+		ErrorLogger.Printf("cannot marshal %s event: %s\n", tag, err)
+		return
+	}
+	name := fmt.Sprintf("pilot_%d.ev", event.Time.UnixNano())
+	if err = writeFile(state.Submit(name), bytes); err != nil {
+		ErrorLogger.Printf("cannot queue %s event: %s\n", tag, err)
+	}
+}
+
 // getEvents retrieve event log entries
-func getEvents(max int) (*ctl.Events, error) {
-	defer TRA(CE())
-	dir := submitDir("")
+func getEvents(state *StateDir, max int) (*ctl.Events, error) {
+	dir := state.Submit("")
 	files, err := lsJobs(dir)
 	if err != nil {
 		return nil, err
@@ -45,7 +93,7 @@ func getEvents(max int) (*ctl.Events, error) {
 			// append its name to the event list
 			names = append(names, file.Name())
 			// read the event bytes
-			bytes, err := os.ReadFile(submitDir(file.Name()))
+			bytes, err := os.ReadFile(state.Submit(file.Name()))
 			if err != nil {
 				return nil, err
 			}
@@ -73,7 +121,7 @@ func getEvents(max int) (*ctl.Events, error) {
 		return nil, err
 	}
 	// write to file
-	err = os.WriteFile(dataDir("events.json"), bytes, os.ModePerm)
+	err = writeFile(state.Path("events.json"), bytes)
 	if err != nil {
 		return nil, err
 	}
@@ -81,10 +129,9 @@ func getEvents(max int) (*ctl.Events, error) {
 }
 
 // remove events that have been submitted
-func removeEvents() error {
-	defer TRA(CE())
+func removeEvents(state *StateDir) error {
 	// work out the file path where events
-	dir := dataDir("events.json")
+	dir := state.Path("events.json")
 	bytes, err := os.ReadFile(dir)
 	if err != nil {
 		return nil
@@ -96,11 +143,11 @@ func removeEvents() error {
 	}
 	// remove the respective event files
 	for i := 0; i < len(names); i++ {
-		err = os.Remove(submitDir(names[i]))
+		err = os.Remove(state.Submit(names[i]))
 		if err != nil {
 			return err
 		}
 	}
 	// remove the events.json file marker
-	return os.Remove(dataDir("events.json"))
+	return os.Remove(state.Path("events.json"))
 }
@@ -20,18 +20,17 @@ package core
 
 import (
 	"fmt"
-	"os"
 	"testing"
 )
 
 func TestGetEvents(t *testing.T) {
-	os.Setenv("PILOT_HOME", "../")
-	events, err := getEvents(2)
+	state := NewStateDir("../data")
+	events, err := getEvents(state, 2)
 	if err != nil {
 		t.Fatal(err)
 	}
 	fmt.Printf("processing %d events\n", len(events.Events))
-	err = removeEvents()
+	err = removeEvents(state)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -0,0 +1,150 @@
+/*
+   Pilot Host Controller
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// permissions of the files and folders pilot writes, only the user running pilot can access them
+const (
+	filePerm os.FileMode = 0600
+	dirPerm  os.FileMode = 0700
+)
+
+// writeFile atomically writes a file readable only by the user running pilot
+// the content is written to a hidden temporary file in the same folder and then renamed, so that readers
+// never see a partially written file
+func writeFile(path string, data []byte) error {
+	dir, name := filepath.Split(path)
+	tmp, err := os.CreateTemp(dir, fmt.Sprintf(".%s.*.tmp", name))
+	if err != nil {
+		return fmt.Errorf("cannot create temporary file for %s: %s", path, err)
+	}
+	// clean up if anything fails before the rename
+	defer os.Remove(tmp.Name())
+	if err = tmp.Chmod(filePerm); err != nil {
+		tmp.Close()
+		return fmt.Errorf("cannot set permissions of %s: %s", path, err)
+	}
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("cannot write %s: %s", path, err)
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("cannot sync %s: %s", path, err)
+	}
+	if err = tmp.Close(); err != nil {
+		return fmt.Errorf("cannot close %s: %s", path, err)
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("cannot rename temporary file to %s: %s", path, err)
+	}
+	return nil
+}
+
+// ensureDir creates a folder accessible only by the user running pilot, if it does not exist
+func ensureDir(path string) error {
+	if err := os.MkdirAll(path, dirPerm); err != nil {
+		return fmt.Errorf("cannot create folder %s: %s", path, err)
+	}
+	return nil
+}
+
+// auditPath checks ownership and permissions of a pilot state folder, everything in it and the folders above it
+// permissions wider than the ones pilot uses are tightened where possible; an error is returned if anything in the
+// folder is owned by a different user, or if the folder or any folder above it can be written by other users, as
+// any local user could then plant jobs for pilot to execute
+func auditPath(root string) error {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return fmt.Errorf("cannot audit %s: %s", root, err)
+	}
+	if err = auditParents(root); err != nil {
+		return err
+	}
+	var foreign []string
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// do not follow or change symbolic links
+		if d.Type()&fs.ModeSymlink != 0 {
+			WarningLogger.Printf("unexpected symbolic link in pilot state folder: %s\n", path)
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		perm := filePerm
+		if d.IsDir() {
+			perm = dirPerm
+		}
+		if !ownedByCurrentUser(info) {
+			foreign = append(foreign, path)
+			return nil
+		}
+		if info.Mode().Perm()&^perm != 0 {
+			WarningLogger.Printf("tightening permissions of %s from %s to %s\n", path, info.Mode().Perm(), perm)
+			if err = os.Chmod(path, perm); err != nil {
+				WarningLogger.Printf("cannot change permissions of %s: %s\n", path, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("cannot audit %s: %s", root, err)
+	}
+	if len(foreign) > 0 {
+		return fmt.Errorf("%d file(s) not owned by the user running pilot, e.g. %s", len(foreign), foreign[0])
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		return fmt.Errorf("cannot audit %s: %s", root, err)
+	}
+	if info.Mode().Perm()&0022 != 0 {
+		return fmt.Errorf("%s is writable by other users (%s)", root, info.Mode().Perm())
+	}
+	return nil
+}
+
+// auditParents checks that the folders above the state folder cannot be written by other users, who could
+// otherwise replace the state folder with their own
+func auditParents(root string) error {
+	for dir := filepath.Dir(root); ; dir = filepath.Dir(dir) {
+		info, err := os.Stat(dir)
+		if err != nil {
+			return fmt.Errorf("cannot audit %s: %s", dir, err)
+		}
+		if !trustedOwner(info) {
+			return fmt.Errorf("%s is not owned by the user running pilot or root", dir)
+		}
+		if writableByOthers(info) {
+			return fmt.Errorf("%s is writable by other users (%s)", dir, info.Mode().Perm())
+		}
+		if parent := filepath.Dir(dir); parent == dir {
+			return nil
+		}
+	}
+}
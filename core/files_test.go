@@ -0,0 +1,85 @@
+/*
+   Pilot Host Controller
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAuditPath(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "data")
+	if err := ensureDir(root); err != nil {
+		t.Fatal(err)
+	}
+	job := filepath.Join(root, "job_1.job")
+	if err := writeFile(job, []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := os.Stat(job); info.Mode().Perm() != filePerm {
+		t.Fatalf("expected %s, got %s", filePerm, info.Mode().Perm())
+	}
+	// simulate state written by an earlier version
+	os.Chmod(job, 0777)
+	os.Chmod(root, 0777)
+	if err := auditPath(root); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := os.Stat(job); info.Mode().Perm() != filePerm {
+		t.Fatalf("job permissions not tightened: %s", info.Mode().Perm())
+	}
+	if info, _ := os.Stat(root); info.Mode().Perm() != dirPerm {
+		t.Fatalf("folder permissions not tightened: %s", info.Mode().Perm())
+	}
+}
+
+func TestAuditPathParents(t *testing.T) {
+	parent := filepath.Join(t.TempDir(), "shared")
+	root := filepath.Join(parent, "data")
+	if err := ensureDir(root); err != nil {
+		t.Fatal(err)
+	}
+	// any user could replace the state folder
+	os.Chmod(parent, 0777)
+	if err := auditPath(root); err == nil {
+		t.Fatal("state folder under a folder writable by other users accepted")
+	}
+	os.Chmod(parent, 0700)
+	if err := auditPath(root); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAuditPathForeignOwner(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("changing file ownership requires root")
+	}
+	root := filepath.Join(t.TempDir(), "data")
+	_ = ensureDir(root)
+	job := filepath.Join(root, "job_1.job")
+	_ = writeFile(job, []byte("{}"))
+	// a job planted by another user
+	if err := os.Chown(job, 65534, 65534); err != nil {
+		t.Fatal(err)
+	}
+	if err := auditPath(root); err == nil {
+		t.Fatal("file owned by another user accepted")
+	}
+}
@@ -0,0 +1,59 @@
+//go:build !windows
+
+/*
+   Pilot Host Controller
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"os"
+	"syscall"
+)
+
+// ownedByCurrentUser true if the file is owned by the user running pilot
+func ownedByCurrentUser(info os.FileInfo) bool {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return true
+	}
+	return int(stat.Uid) == os.Getuid()
+}
+
+// trustedOwner true if the file is owned by the user running pilot or by root
+func trustedOwner(info os.FileInfo) bool {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return true
+	}
+	return int(stat.Uid) == os.Getuid() || stat.Uid == 0
+}
+
+// writableByOthers true if users other than the owner can create, rename or remove files in the folder
+// folders with the sticky bit set, e.g. /tmp, only let users rename or remove their own files
+func writableByOthers(info os.FileInfo) bool {
+	return info.Mode().Perm()&0022 != 0 && info.Mode()&os.ModeSticky == 0
+}
+
+// fileId returns the inode of a file, so that a file replaced by another with the same name can be detected
+func fileId(info os.FileInfo) uint64 {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0
+	}
+	return uint64(stat.Ino)
+}
@@ -0,0 +1,43 @@
+//go:build windows
+
+/*
+   Pilot Host Controller
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import "os"
+
+// ownedByCurrentUser file ownership is governed by ACLs on windows and is not checked
+func ownedByCurrentUser(_ os.FileInfo) bool {
+	return true
+}
+
+// trustedOwner file ownership is governed by ACLs on windows and is not checked
+func trustedOwner(_ os.FileInfo) bool {
+	return true
+}
+
+// writableByOthers folder access is governed by ACLs on windows and is not checked
+func writableByOthers(_ os.FileInfo) bool {
+	return false
+}
+
+// fileId files are not identified by inode on windows, a replaced file is only detected if it is smaller
+func fileId(_ os.FileInfo) uint64 {
+	return 0
+}
@@ -0,0 +1,71 @@
+/*
+   Pilot Host Controller
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"fmt"
+	"os"
+)
+
+// HK the host key used to sign the payloads submitted to pilot control, loaded at activation
+var HK *PGP
+
+// hostKeyBits the RSA key size of the host key
+const hostKeyBits = 3072
+
+// loadHostKey loads the host key, creating it the first time the host is activated
+func loadHostKey(hostUUID string) (*PGP, error) {
+	path := HostKeyFile()
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		InfoLogger.Printf("creating host signing key\n")
+		key, err := NewPGP(hostUUID, "pilot host signing key", "", hostKeyBits)
+		if err != nil {
+			return nil, fmt.Errorf("cannot create host key: %s", err)
+		}
+		b, err := key.PrivateKey()
+		if err != nil {
+			return nil, err
+		}
+		if err = writeFile(path, b); err != nil {
+			return nil, fmt.Errorf("cannot write host key: %s", err)
+		}
+		return key, nil
+	}
+	key, err := LoadPGP(path, "")
+	if err != nil {
+		return nil, fmt.Errorf("cannot load host key: %s", err)
+	}
+	if !key.HasPrivate() {
+		return nil, fmt.Errorf("host key should be private, public key found")
+	}
+	return key, nil
+}
+
+// hostPublicKey returns the armored public host key or an empty string if the host key is not loaded
+func hostPublicKey() string {
+	if HK == nil {
+		return ""
+	}
+	pub, err := HK.PublicKey()
+	if err != nil {
+		ErrorLogger.Printf("cannot export host public key: %s\n", err)
+		return ""
+	}
+	return string(pub)
+}
@@ -0,0 +1,292 @@
+/*
+   Pilot Host Controller
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"fmt"
+	"github.com/shirou/gopsutil/cpu"
+	"github.com/shirou/gopsutil/disk"
+	"github.com/shirou/gopsutil/host"
+	"github.com/shirou/gopsutil/load"
+	"github.com/shirou/gopsutil/mem"
+	"github.com/shirou/gopsutil/net"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// HostCollector samples host metrics and writes them to a telemetry metrics channel, from where they are uploaded
+// to pilot control as any other metrics file
+// samples are written in OTLP JSON format, one file per sample
+type HostCollector struct {
+	// the metrics channel folder
+	path     string
+	interval time.Duration
+	// the spool the samples are written to
+	spool *Spool
+	quit  chan struct{}
+}
+
+func NewHostCollector(path string, interval time.Duration, spool *Spool) *HostCollector {
+	return &HostCollector{
+		path:     path,
+		interval: interval,
+		spool:    spool,
+		quit:     make(chan struct{}),
+	}
+}
+
+func (c *HostCollector) Start() {
+	logFor("telemetry").Info().Str("channel", filepath.Base(c.path)).Msgf("sampling host metrics every %v", c.interval)
+	go func() {
+		ticker := time.NewTicker(c.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.quit:
+				return
+			case <-ticker.C:
+				if err := c.collect(); err != nil {
+					logFor("telemetry").Error().Err(err).Str("channel", filepath.Base(c.path)).Msg("cannot collect host metrics")
+				}
+			}
+		}
+	}()
+}
+
+// Stop stops sampling host metrics
+func (c *HostCollector) Stop() {
+	close(c.quit)
+}
+
+// collect samples the host metrics and writes them to the channel folder
+func (c *HostCollector) collect() error {
+	metrics := sampleHostMetrics(time.Now())
+	content, err := (&pmetric.JSONMarshaler{}).MarshalMetrics(metrics)
+	if err != nil {
+		return fmt.Errorf("cannot marshal host metrics: %s", err)
+	}
+	return c.spool.write(c.path, "host", content)
+}
+
+// sampleHostMetrics reads cpu, memory, disk, filesystem, network and load metrics
+// a source that cannot be read on the host is skipped, so that the other metrics are still reported
+func sampleHostMetrics(now time.Time) pmetric.Metrics {
+	metrics := pmetric.NewMetrics()
+	rm := metrics.ResourceMetrics().AppendEmpty()
+	res := rm.Resource().Attributes()
+	res.PutStr("service.name", "pilot")
+	if hostname, err := os.Hostname(); err == nil {
+		res.PutStr("host.name", hostname)
+	}
+	if A != nil {
+		res.PutStr("host.id", A.HostUUID)
+	}
+	sm := rm.ScopeMetrics().AppendEmpty()
+	sm.Scope().SetName("southwinds.dev/piloth/hostmetrics")
+	sm.Scope().SetVersion(Version)
+	b := &metricsBuilder{
+		metrics: sm.Metrics(),
+		now:     pcommon.NewTimestampFromTime(now),
+	}
+	// cumulative counters read from /proc start at boot time
+	if boot, err := host.BootTime(); err == nil {
+		b.start = pcommon.NewTimestampFromTime(time.Unix(int64(boot), 0))
+	}
+	for _, source := range []struct {
+		name   string
+		sample func(b *metricsBuilder) error
+	}{
+		{"cpu", sampleCPU},
+		{"memory", sampleMemory},
+		{"disk", sampleDisk},
+		{"filesystem", sampleFilesystem},
+		{"network", sampleNetwork},
+		{"load", sampleLoad},
+	} {
+		if err := source.sample(b); err != nil {
+			DebugLogger.Printf("skipping %s host metrics: %s\n", source.name, err)
+		}
+	}
+	return metrics
+}
+
+func sampleCPU(b *metricsBuilder) error {
+	times, err := cpu.Times(false)
+	if err != nil {
+		return err
+	}
+	if len(times) > 0 {
+		t := times[0]
+		points := b.sum("system.cpu.time", "s", true)
+		for state, value := range map[string]float64{
+			"user":      t.User,
+			"system":    t.System,
+			"idle":      t.Idle,
+			"nice":      t.Nice,
+			"wait":      t.Iowait,
+			"interrupt": t.Irq,
+			"softirq":   t.Softirq,
+			"steal":     t.Steal,
+		} {
+			b.double(points, value, "state", state)
+		}
+	}
+	// the utilization since the previous sample
+	percent, err := cpu.Percent(0, false)
+	if err != nil {
+		return err
+	}
+	if len(percent) > 0 {
+		b.double(b.gauge("system.cpu.utilization", "1"), percent[0]/100)
+	}
+	return nil
+}
+
+func sampleMemory(b *metricsBuilder) error {
+	m, err := mem.VirtualMemory()
+	if err != nil {
+		return err
+	}
+	points := b.sum("system.memory.usage", "By", false)
+	b.int(points, m.Used, "state", "used")
+	b.int(points, m.Free, "state", "free")
+	b.int(points, m.Buffers, "state", "buffered")
+	b.int(points, m.Cached, "state", "cached")
+	b.double(b.gauge("system.memory.utilization", "1"), m.UsedPercent/100)
+	return nil
+}
+
+func sampleDisk(b *metricsBuilder) error {
+	counters, err := disk.IOCounters()
+	if err != nil {
+		return err
+	}
+	bytes := b.sum("system.disk.io", "By", true)
+	ops := b.sum("system.disk.operations", "{operations}", true)
+	for device, c := range counters {
+		b.int(bytes, c.ReadBytes, "device", device, "direction", "read")
+		b.int(bytes, c.WriteBytes, "device", device, "direction", "write")
+		b.int(ops, c.ReadCount, "device", device, "direction", "read")
+		b.int(ops, c.WriteCount, "device", device, "direction", "write")
+	}
+	return nil
+}
+
+func sampleFilesystem(b *metricsBuilder) error {
+	partitions, err := disk.Partitions(false)
+	if err != nil {
+		return err
+	}
+	usage := b.sum("system.filesystem.usage", "By", false)
+	utilization := b.gauge("system.filesystem.utilization", "1")
+	for _, p := range partitions {
+		u, err := disk.Usage(p.Mountpoint)
+		if err != nil || u.Total == 0 {
+			continue
+		}
+		attrs := []string{"device", p.Device, "mountpoint", p.Mountpoint, "type", p.Fstype}
+		b.int(usage, u.Used, append(attrs, "state", "used")...)
+		b.int(usage, u.Free, append(attrs, "state", "free")...)
+		b.double(utilization, u.UsedPercent/100, attrs...)
+	}
+	return nil
+}
+
+func sampleNetwork(b *metricsBuilder) error {
+	counters, err := net.IOCounters(true)
+	if err != nil {
+		return err
+	}
+	bytes := b.sum("system.network.io", "By", true)
+	packets := b.sum("system.network.packets", "{packets}", true)
+	errs := b.sum("system.network.errors", "{errors}", true)
+	for _, c := range counters {
+		// the loopback interface is not relevant to the host traffic
+		if c.Name == "lo" || strings.HasPrefix(c.Name, "lo:") {
+			continue
+		}
+		b.int(bytes, c.BytesRecv, "device", c.Name, "direction", "receive")
+		b.int(bytes, c.BytesSent, "device", c.Name, "direction", "transmit")
+		b.int(packets, c.PacketsRecv, "device", c.Name, "direction", "receive")
+		b.int(packets, c.PacketsSent, "device", c.Name, "direction", "transmit")
+		b.int(errs, c.Errin, "device", c.Name, "direction", "receive")
+		b.int(errs, c.Errout, "device", c.Name, "direction", "transmit")
+	}
+	return nil
+}
+
+func sampleLoad(b *metricsBuilder) error {
+	avg, err := load.Avg()
+	if err != nil {
+		return err
+	}
+	b.double(b.gauge("system.cpu.load_average.1m", "1"), avg.Load1)
+	b.double(b.gauge("system.cpu.load_average.5m", "1"), avg.Load5)
+	b.double(b.gauge("system.cpu.load_average.15m", "1"), avg.Load15)
+	return nil
+}
+
+// metricsBuilder adds metrics and data points sampled at the same time
+type metricsBuilder struct {
+	metrics    pmetric.MetricSlice
+	now, start pcommon.Timestamp
+}
+
+func (b *metricsBuilder) gauge(name, unit string) pmetric.NumberDataPointSlice {
+	m := b.metrics.AppendEmpty()
+	m.SetName(name)
+	m.SetUnit(unit)
+	return m.SetEmptyGauge().DataPoints()
+}
+
+func (b *metricsBuilder) sum(name, unit string, monotonic bool) pmetric.NumberDataPointSlice {
+	m := b.metrics.AppendEmpty()
+	m.SetName(name)
+	m.SetUnit(unit)
+	sum := m.SetEmptySum()
+	sum.SetIsMonotonic(monotonic)
+	sum.SetAggregationTemporality(pmetric.AggregationTemporalityCumulative)
+	return sum.DataPoints()
+}
+
+// int adds a data point with the attributes passed as key value pairs
+func (b *metricsBuilder) int(points pmetric.NumberDataPointSlice, value uint64, attrs ...string) {
+	b.point(points, attrs).SetIntValue(int64(value))
+}
+
+// double adds a data point with the attributes passed as key value pairs
+func (b *metricsBuilder) double(points pmetric.NumberDataPointSlice, value float64, attrs ...string) {
+	b.point(points, attrs).SetDoubleValue(value)
+}
+
+func (b *metricsBuilder) point(points pmetric.NumberDataPointSlice, attrs []string) pmetric.NumberDataPoint {
+	p := points.AppendEmpty()
+	p.SetTimestamp(b.now)
+	if b.start > 0 {
+		p.SetStartTimestamp(b.start)
+	}
+	for i := 0; i+1 < len(attrs); i += 2 {
+		p.Attributes().PutStr(attrs[i], attrs[i+1])
+	}
+	return p
+}
@@ -0,0 +1,59 @@
+/*
+   Pilot Host Controller
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"go.opentelemetry.io/collector/pdata/pmetric"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHostCollector(t *testing.T) {
+	dir := t.TempDir()
+	c := NewHostCollector(dir, 0, nil)
+	if err := c.collect(); err != nil {
+		t.Fatal(err)
+	}
+	files, err := getFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("expected 1 metrics file, got %d", len(files))
+	}
+	content, err := os.ReadFile(filepath.Join(dir, files[0].Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics, err := (&pmetric.JSONUnmarshaler{}).UnmarshalMetrics(content)
+	if err != nil {
+		t.Fatalf("host metrics are not in OTLP JSON format: %s", err)
+	}
+	names := map[string]bool{}
+	ms := metrics.ResourceMetrics().At(0).ScopeMetrics().At(0).Metrics()
+	for i := 0; i < ms.Len(); i++ {
+		names[ms.At(i).Name()] = true
+	}
+	for _, name := range []string{"system.cpu.time", "system.memory.usage", "system.cpu.load_average.1m"} {
+		if !names[name] {
+			t.Fatalf("metric %s not sampled, got %v", name, names)
+		}
+	}
+}
@@ -24,16 +24,46 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
-	"path/filepath"
 	"regexp"
 	"sort"
 	ctl "southwinds.dev/pilotctl/types"
 	"strconv"
+	"time"
 )
 
 type Job struct {
 	file os.FileInfo
 	cmd  *ctl.CmdInfo
+	// the envelope exactly as signed by pilot control
+	envelope json.RawMessage
+	// the pilot control signature of the envelope, empty if the job was queued unsigned
+	signature string
+}
+
+// queuedJob the content of a job file in the process queue
+// the signed envelope is kept so that the job can be verified again before it is executed
+type queuedJob struct {
+	Envelope  json.RawMessage `json:"envelope"`
+	Signature string          `json:"signature,omitempty"`
+}
+
+// command extracts the command from the envelope
+func (q queuedJob) command() (*ctl.CmdInfo, error) {
+	var resp ctl.PingResponse
+	if err := json.Unmarshal(q.Envelope, &resp.Envelope); err != nil {
+		return nil, err
+	}
+	return &resp.Envelope.Command, nil
+}
+
+// newSignedJob creates a job from the envelope and signature received from pilot control
+func newSignedJob(resp ctl.PingResponse) (*Job, error) {
+	envelope, err := json.Marshal(resp.Envelope)
+	if err != nil {
+		return nil, fmt.Errorf("cannot marshal job envelope: %s", err)
+	}
+	cmd := resp.Envelope.Command
+	return &Job{cmd: &cmd, envelope: envelope, signature: resp.Signature}, nil
 }
 
 // peekJob return the oldest job waiting to be processing without removing it from the queue
@@ -42,25 +72,42 @@ type Job struct {
 //	to pilot control in this case, add a job result to the submit queue warning job might have not been completed
 //	The start mark is removed when the job result has been submitted
 //	If a submitted mark is found, the remove job is called and the next jon is peeked
-func peekJob() (job *Job, err error) {
-	defer TRA(CE())
+func peekJob(state *StateDir) (job *Job, err error) {
 	var bytes []byte
-	dir := processDir("")
+	dir := state.Process("")
 	files, err := lsJobs(dir)
 	if err != nil {
 		return nil, err
 	}
 	for _, file := range files {
 		if !file.IsDir() && path.Ext(file.Name()) == ".job" {
-			bytes, err = ioutil.ReadFile(processDir(file.Name()))
+			bytes, err = ioutil.ReadFile(state.Process(file.Name()))
 			if err != nil {
 				return nil, fmt.Errorf("cannot read job file %s: %s", file.Name(), err)
 			}
 			if len(bytes) == 0 {
 				return nil, fmt.Errorf("job file %s is empty: %s", file.Name(), err)
 			}
-			var cmdInfo ctl.CmdInfo
-			err = json.Unmarshal(bytes, &cmdInfo)
+			bytes, err = openData(bytes)
+			if err != nil {
+				return &Job{file: file}, fmt.Errorf("cannot read job file %s: %s", file.Name(), err)
+			}
+			var (
+				queued  queuedJob
+				cmdInfo ctl.CmdInfo
+			)
+			err = json.Unmarshal(bytes, &queued)
+			if err == nil {
+				if len(queued.Envelope) > 0 {
+					var cmd *ctl.CmdInfo
+					if cmd, err = queued.command(); err == nil {
+						cmdInfo = *cmd
+					}
+				} else {
+					// job file written by a previous version, only containing the command
+					err = json.Unmarshal(bytes, &cmdInfo)
+				}
+			}
 			if err != nil {
 				// try and extract job Id from the file name with the following regex
 				re := regexp.MustCompile(`\d[\d,]*`)
@@ -80,21 +127,23 @@ func peekJob() (job *Job, err error) {
 				}, fmt.Errorf("cannot unmarhsal file '%s', possibly due to a corruption: %s; the file content was '%s'\n", file.Name(), err, string(bytes))
 			}
 			job = &Job{
-				file: file,
-				cmd:  &cmdInfo,
+				file:      file,
+				cmd:       &cmdInfo,
+				envelope:  queued.Envelope,
+				signature: queued.Signature,
 			}
-			if submittedMarkerExists(job.cmd.JobId) {
+			if submittedMarkerExists(state, job.cmd.JobId) {
 				// it means that the host halted after submitting job result but could not remove job from the queue
 				// therefore removes job from the queue
-				err = removeJob(job.cmd.JobId)
+				err = removeJob(state, job.cmd.JobId)
 				if err != nil {
 					return nil, err
 				}
 				// peek next job
-				return peekJob()
+				return peekJob(state)
 			}
 			// returns the found job and creates a started marker for the job in the file system
-			return job, startedMarker(job)
+			return job, startedMarker(state, job)
 		}
 	}
 	// no job found
@@ -103,33 +152,46 @@ func peekJob() (job *Job, err error) {
 
 // removeJob remove the specified job from the directory it is in
 // failsafe: removes the submitted marker
-func removeJob(jobId int64) error {
-	defer TRA(CE())
-	dir := dataDir(fmt.Sprintf("job_%d.submitted", jobId))
+func removeJob(state *StateDir, jobId int64) error {
+	dir := state.Path(fmt.Sprintf("job_%d.submitted", jobId))
 	// remove submitted marker
 	err := os.Remove(dir)
 	if err != nil {
 		return err
 	}
 	// remove job from queue
-	dir = processDir(fmt.Sprintf("job_%d.job", jobId))
+	dir = state.Process(fmt.Sprintf("job_%d.job", jobId))
 	return os.Remove(dir)
 }
 
 // addJob add a new job to the process queue
-func addJob(job Job) error {
-	defer TRA(CE())
-	bytes, err := json.Marshal(job.cmd)
+func addJob(state *StateDir, job Job) error {
+	envelope := job.envelope
+	// an unsigned job only has the command, wrap it in an envelope
+	if len(envelope) == 0 {
+		var resp ctl.PingResponse
+		resp.Envelope.Command = *job.cmd
+		e, err := json.Marshal(resp.Envelope)
+		if err != nil {
+			return err
+		}
+		envelope = e
+	}
+	bytes, err := json.Marshal(queuedJob{Envelope: envelope, Signature: job.signature})
+	if err != nil {
+		return err
+	}
+	// the job is stored encrypted, sensitive values also stay encrypted with the host key until execution
+	bytes, err = sealData(bytes)
 	if err != nil {
 		return err
 	}
-	dir := processDir(fmt.Sprintf("job_%d.job", job.cmd.JobId))
-	return os.WriteFile(dir, bytes, os.ModePerm)
+	dir := state.Process(fmt.Sprintf("job_%d.job", job.cmd.JobId))
+	return writeFile(dir, bytes)
 }
 
 // ls files in a folder by date (oldest modified time first)
 func lsJobs(dirname string) ([]os.FileInfo, error) {
-	defer TRA(CE())
 	// read files from folder
 	files, err := ioutil.ReadDir(dirname)
 	if err != nil {
@@ -143,41 +205,39 @@ func lsJobs(dirname string) ([]os.FileInfo, error) {
 	return files, nil
 }
 
-func startedMarker(job *Job) error {
-	defer TRA(CE())
-	if job == nil {
-		return nil
+// verifyJob checks the job file was queued with a valid pilot control signature
+// the check is repeated before execution as anyone able to write to the process folder could otherwise
+// get pilot to execute arbitrary commands
+func verifyJob(job *Job) error {
+	if len(job.signature) == 0 || len(job.envelope) == 0 {
+		return fmt.Errorf("job is not signed")
 	}
-	dir := dataDir(fmt.Sprintf("job_%d.started", job.cmd.JobId))
-	return ioutil.WriteFile(dir, []byte{}, os.ModePerm)
-}
-
-func processDir(file string) string {
-	defer TRA(CE())
-	fp := os.Getenv("PILOT_HOME")
-	fp, _ = filepath.Abs(fp)
-	if len(fp) == 0 {
-		fp, _ = os.Executable()
+	if err := Verify(job.envelope, job.signature); err != nil {
+		return err
 	}
-	return filepath.Join(fp, "data", "process", file)
+	return nil
 }
 
-func dataDir(file string) string {
-	defer TRA(CE())
-	fp := os.Getenv("PILOT_HOME")
-	fp, _ = filepath.Abs(fp)
-	if len(fp) == 0 {
-		fp, _ = os.Executable()
+// quarantineJob moves a job file out of the process queue so that it is never executed
+func quarantineJob(state *StateDir, job *Job) error {
+	if err := ensureDir(state.Quarantine("")); err != nil {
+		return err
+	}
+	dst := state.Quarantine(fmt.Sprintf("%s.%d", job.file.Name(), time.Now().UnixNano()))
+	if err := os.Rename(state.Process(job.file.Name()), dst); err != nil {
+		return fmt.Errorf("cannot quarantine job file %s: %s", job.file.Name(), err)
 	}
-	return filepath.Join(fp, "data", file)
+	// the started marker was created when the job was peeked
+	if job.cmd != nil {
+		_ = os.Remove(state.Path(fmt.Sprintf("job_%d.started", job.cmd.JobId)))
+	}
+	return nil
 }
 
-func submitDir(file string) string {
-	defer TRA(CE())
-	fp := os.Getenv("PILOT_HOME")
-	fp, _ = filepath.Abs(fp)
-	if len(fp) == 0 {
-		fp, _ = os.Executable()
+func startedMarker(state *StateDir, job *Job) error {
+	if job == nil {
+		return nil
 	}
-	return filepath.Join(fp, "data", "submit", file)
+	dir := state.Path(fmt.Sprintf("job_%d.started", job.cmd.JobId))
+	return writeFile(dir, []byte{})
 }
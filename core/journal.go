@@ -0,0 +1,439 @@
+/*
+   Pilot Host Controller
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/plog"
+	"io"
+	"os"
+	"os/exec"
+	ctl "southwinds.dev/pilotctl/types"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the outputs journal entries are converted to
+const (
+	// entries are written to a logs channel
+	JournalOutputLogs = "logs"
+	// entries are queued as events, sent to pilot control with the next ping
+	JournalOutputEvents = "events"
+)
+
+// how long pilot waits before restarting journalctl if it exits
+const journalRestartDelay = 10 * time.Second
+
+// how often pilot checks whether pings sent the queued journal events, while the queue is full
+const journalQueueCheck = 5 * time.Second
+
+// the name prefix of the queued journal event files
+const journalEventPrefix = "journal_"
+
+// errJournalStopped returned when the reader is stopped while it waits to queue events
+var errJournalStopped = errors.New("journal reader stopped")
+
+// the largest journal field pilot reads, larger fields mean the stream is corrupted
+const journalMaxField = 16 << 20
+
+// the syslog priority names, indexed by priority
+var journalPriorities = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+
+// JournalReader follows the systemd journal using journalctl and converts its entries to logs or events
+// the cursor of the last entry converted is persisted, so that pilot resumes where it stopped after a restart
+type JournalReader struct {
+	settings JournalSettings
+	// the logs channel folder
+	dir   string
+	state *StateDir
+	spool *Spool
+	// the file the cursor is persisted to, the cursor is not persisted if empty
+	cursorFile string
+	cursor     string
+	cmd        *exec.Cmd
+	quit       chan struct{}
+	done       chan struct{}
+}
+
+// journalEntry the fields of a journal entry
+type journalEntry map[string]string
+
+func NewJournalReader(settings JournalSettings, dir string, state *StateDir, spool *Spool) (*JournalReader, error) {
+	if settings.Output == JournalOutputEvents && state == nil {
+		return nil, fmt.Errorf("journal events require a state folder")
+	}
+	r := &JournalReader{
+		settings: settings,
+		dir:      dir,
+		state:    state,
+		spool:    spool,
+		quit:     make(chan struct{}),
+	}
+	if state != nil {
+		if err := ensureDir(state.Checkpoints("")); err != nil {
+			return nil, fmt.Errorf("cannot create checkpoints folder: %s", err)
+		}
+		r.cursorFile = state.Checkpoints("journal.cursor")
+		content, err := os.ReadFile(r.cursorFile)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("cannot read journal cursor: %s", err)
+		}
+		r.cursor = strings.TrimSpace(string(content))
+	}
+	return r, nil
+}
+
+// Start runs journalctl, restarting it if it exits until the reader is stopped
+func (r *JournalReader) Start() {
+	logFor("telemetry").Info().Str("output", r.settings.Output).Strs("units", r.settings.Units).Msg("reading the systemd journal")
+	r.done = make(chan struct{})
+	go func() {
+		defer close(r.done)
+		for {
+			if err := r.follow(); err != nil {
+				logFor("telemetry").Error().Err(err).Msgf("journal reader stopped, restarting in %v", journalRestartDelay)
+			}
+			select {
+			case <-r.quit:
+				return
+			case <-time.After(journalRestartDelay):
+			}
+		}
+	}()
+}
+
+// Stop stops following the journal
+func (r *JournalReader) Stop() {
+	close(r.quit)
+	if r.done != nil {
+		<-r.done
+	}
+}
+
+// follow runs journalctl until it exits or the reader is stopped, converting the entries it exports
+func (r *JournalReader) follow() error {
+	cmd := exec.Command("journalctl", r.args()...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("cannot read journalctl output: %s", err)
+	}
+	if err = cmd.Start(); err != nil {
+		return fmt.Errorf("cannot start journalctl: %s", err)
+	}
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-r.quit:
+			_ = cmd.Process.Kill()
+		case <-stopped:
+		}
+	}()
+	readErr := r.read(stdout)
+	if readErr != nil {
+		// journalctl keeps running until it is killed, as nothing reads its output anymore
+		_ = cmd.Process.Kill()
+	}
+	waitErr := cmd.Wait()
+	select {
+	case <-r.quit:
+		return nil
+	default:
+	}
+	if readErr != nil {
+		return readErr
+	}
+	if waitErr != nil {
+		return fmt.Errorf("journalctl exited: %s", waitErr)
+	}
+	return fmt.Errorf("journalctl exited")
+}
+
+// args returns the journalctl arguments following the journal from the cursor using the configured filters
+func (r *JournalReader) args() []string {
+	args := []string{"--follow", "--output=export", "--no-pager"}
+	if len(r.cursor) > 0 {
+		args = append(args, fmt.Sprintf("--after-cursor=%s", r.cursor), "--lines=all")
+	} else {
+		// without a cursor, only new entries are read
+		args = append(args, "--lines=0")
+	}
+	if len(r.settings.Directory) > 0 {
+		args = append(args, fmt.Sprintf("--directory=%s", r.settings.Directory))
+	}
+	for _, unit := range r.settings.Units {
+		args = append(args, fmt.Sprintf("--unit=%s", unit))
+	}
+	if priority, ok := journalPriority(r.settings.Priority); ok {
+		args = append(args, fmt.Sprintf("--priority=0..%d", priority))
+	}
+	return append(args, r.settings.Matches...)
+}
+
+// read converts the entries of a journal export stream, in batches of the entries available without waiting
+func (r *JournalReader) read(export io.Reader) error {
+	in := bufio.NewReader(export)
+	var batch []journalEntry
+	for {
+		entry, err := readJournalEntry(in)
+		if entry != nil {
+			batch = append(batch, entry)
+		}
+		// the batch is converted when no more entries are buffered, so that entries are not held back
+		if len(batch) > 0 && (err != nil || in.Buffered() == 0 || len(batch) >= 1000) {
+			if convErr := r.convert(batch); convErr != nil {
+				return convErr
+			}
+			batch = nil
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// convert writes journal entries to the logs channel or as events, then persists the cursor of the last one
+// written, so that entries written before a failure are not written again
+func (r *JournalReader) convert(entries []journalEntry) error {
+	var (
+		written int
+		err     error
+	)
+	if r.settings.Output == JournalOutputEvents {
+		written, err = r.writeEvents(entries)
+	} else if err = r.writeLogs(entries); err == nil {
+		written = len(entries)
+	}
+	if written == 0 {
+		return err
+	}
+	r.cursor = entries[written-1]["__CURSOR"]
+	if len(r.cursorFile) > 0 && len(r.cursor) > 0 {
+		if cursorErr := writeFile(r.cursorFile, []byte(r.cursor)); cursorErr != nil && err == nil {
+			err = fmt.Errorf("cannot save journal cursor: %s", cursorErr)
+		}
+	}
+	return err
+}
+
+func (r *JournalReader) writeLogs(entries []journalEntry) error {
+	logs := plog.NewLogs()
+	rl := logs.ResourceLogs().AppendEmpty()
+	res := rl.Resource().Attributes()
+	if hostname, err := os.Hostname(); err == nil {
+		res.PutStr("host.name", hostname)
+	}
+	if A != nil {
+		res.PutStr("host.id", A.HostUUID)
+	}
+	sl := rl.ScopeLogs().AppendEmpty()
+	sl.Scope().SetName("southwinds.dev/piloth/journal")
+	observed := pcommon.NewTimestampFromTime(time.Now())
+	for _, entry := range entries {
+		lr := sl.LogRecords().AppendEmpty()
+		lr.SetTimestamp(pcommon.NewTimestampFromTime(entry.time()))
+		lr.SetObservedTimestamp(observed)
+		if priority, ok := entry.priority(); ok {
+			lr.SetSeverityNumber(journalSeverities[priority])
+			lr.SetSeverityText(journalPriorities[priority])
+		}
+		lr.Body().SetStr(entry["MESSAGE"])
+		attrs := lr.Attributes()
+		for field, attr := range map[string]string{
+			"_SYSTEMD_UNIT":     "systemd.unit",
+			"SYSLOG_IDENTIFIER": "syslog.identifier",
+			"_PID":              "process.pid",
+			"_COMM":             "process.executable.name",
+		} {
+			if value, exists := entry[field]; exists {
+				attrs.PutStr(attr, value)
+			}
+		}
+	}
+	content, err := (&plog.JSONMarshaler{}).MarshalLogs(logs)
+	if err != nil {
+		return fmt.Errorf("cannot marshal journal entries: %s", err)
+	}
+	return r.spool.write(r.dir, "journal", content)
+}
+
+// writeEvents queues journal entries as events, up to telemetry.journal.max_events waiting to be sent, and
+// returns the number of entries queued
+// when the queue is full, it waits for pings to send the events, so that journalctl blocks and entries are read
+// later rather than lost; it returns errJournalStopped if the reader is stopped in the meantime
+func (r *JournalReader) writeEvents(entries []journalEntry) (int, error) {
+	queued := countJournalEvents(r.state)
+	for i, entry := range entries {
+		for queued >= r.settings.MaxEvents {
+			select {
+			case <-r.quit:
+				return i, errJournalStopped
+			case <-time.After(journalQueueCheck):
+			}
+			queued = countJournalEvents(r.state)
+		}
+		event := ctl.Event{
+			Client:   "journald",
+			Hostname: entry["_HOSTNAME"],
+			Time:     entry.time().UTC(),
+			Content:  entry["MESSAGE"],
+			Tag:      entry.tag(),
+		}
+		if priority, ok := entry.priority(); ok {
+			event.Severity = priority
+			facility, _ := strconv.Atoi(entry["SYSLOG_FACILITY"])
+			event.Facility = facility
+			event.Priority = facility*8 + priority
+		}
+		if A != nil {
+			event.HostUUID = A.HostUUID
+		}
+		bytes, err := json.Marshal(event)
+		if err != nil {
+			return i, fmt.Errorf("cannot marshal journal event: %s", err)
+		}
+		name := fmt.Sprintf("%s%d_%d.ev", journalEventPrefix, time.Now().UnixNano(), i)
+		if err = writeFile(r.state.Submit(name), bytes); err != nil {
+			return i, fmt.Errorf("cannot queue journal event: %s", err)
+		}
+		queued++
+	}
+	return len(entries), nil
+}
+
+// countJournalEvents returns the number of journal events waiting to be sent to pilot control
+func countJournalEvents(state *StateDir) int {
+	entries, err := os.ReadDir(state.Submit(""))
+	if err != nil {
+		return 0
+	}
+	count := 0
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), journalEventPrefix) && strings.HasSuffix(entry.Name(), ".ev") {
+			count++
+		}
+	}
+	return count
+}
+
+// time returns the time the entry was received by the journal
+func (e journalEntry) time() time.Time {
+	usec, err := strconv.ParseInt(e["__REALTIME_TIMESTAMP"], 10, 64)
+	if err != nil {
+		return time.Now()
+	}
+	return time.UnixMicro(usec)
+}
+
+// priority returns the syslog priority of the entry, if it has one
+func (e journalEntry) priority() (int, bool) {
+	p, err := strconv.Atoi(e["PRIORITY"])
+	if err != nil || p < 0 || p >= len(journalPriorities) {
+		return 0, false
+	}
+	return p, true
+}
+
+// tag returns the program that logged the entry
+func (e journalEntry) tag() string {
+	if tag := e["SYSLOG_IDENTIFIER"]; len(tag) > 0 {
+		return tag
+	}
+	if unit := e["_SYSTEMD_UNIT"]; len(unit) > 0 {
+		return unit
+	}
+	return e["_COMM"]
+}
+
+// journalSeverities the OpenTelemetry severity of each syslog priority
+var journalSeverities = []plog.SeverityNumber{
+	plog.SeverityNumberFatal4,
+	plog.SeverityNumberFatal3,
+	plog.SeverityNumberFatal,
+	plog.SeverityNumberError,
+	plog.SeverityNumberWarn,
+	plog.SeverityNumberInfo2,
+	plog.SeverityNumberInfo,
+	plog.SeverityNumberDebug,
+}
+
+// journalPriority returns the priority of a syslog priority name or number and false if it is not valid
+func journalPriority(value string) (int, bool) {
+	for i, name := range journalPriorities {
+		if strings.EqualFold(value, name) {
+			return i, true
+		}
+	}
+	if p, err := strconv.Atoi(value); err == nil && p >= 0 && p < len(journalPriorities) {
+		return p, true
+	}
+	return len(journalPriorities) - 1, false
+}
+
+// readJournalEntry reads the next entry of a stream in the journal export format, i.e. the output of
+// journalctl --output=export: one FIELD=value line per field, or the field name followed by the length of the
+// value as a 64-bit little endian integer and the value for binary values, and an empty line after each entry
+// it returns io.EOF when the stream ends
+func readJournalEntry(in *bufio.Reader) (journalEntry, error) {
+	entry := journalEntry{}
+	for {
+		line, err := in.ReadString('\n')
+		if err != nil {
+			if err == io.EOF && len(entry) > 0 {
+				return entry, nil
+			}
+			if err == io.EOF && len(line) > 0 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if len(line) == 0 {
+			if len(entry) > 0 {
+				return entry, nil
+			}
+			continue
+		}
+		if i := strings.IndexByte(line, '='); i >= 0 {
+			entry[line[:i]] = line[i+1:]
+			continue
+		}
+		var size uint64
+		if err = binary.Read(in, binary.LittleEndian, &size); err != nil {
+			return nil, fmt.Errorf("cannot read size of journal field %s: %s", line, err)
+		}
+		if size > journalMaxField {
+			return nil, fmt.Errorf("journal field %s is too large: %d bytes", line, size)
+		}
+		value := make([]byte, size+1)
+		if _, err = io.ReadFull(in, value); err != nil {
+			return nil, fmt.Errorf("cannot read journal field %s: %s", line, err)
+		}
+		entry[line] = string(value[:size])
+	}
+}
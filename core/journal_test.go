@@ -0,0 +1,198 @@
+/*
+   Pilot Host Controller
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"bufio"
+	"encoding/json"
+	"go.opentelemetry.io/collector/pdata/plog"
+	"io"
+	"os"
+	"path/filepath"
+	ctl "southwinds.dev/pilotctl/types"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testdata/journal.export was exported using journalctl --output=export, the second entry has a binary message
+func TestReadJournalEntry(t *testing.T) {
+	f, err := os.Open("testdata/journal.export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	in := bufio.NewReader(f)
+	var entries []journalEntry
+	for {
+		entry, err := readJournalEntry(in)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(entries))
+	}
+	if msg := entries[1]["MESSAGE"]; msg != "panic: out of memory\ngoroutine 1 [running]" {
+		t.Fatalf("unexpected binary message %q", msg)
+	}
+	if tag := entries[1].tag(); tag != "app.service" {
+		t.Fatalf("unexpected tag %s", tag)
+	}
+}
+
+func TestJournalLogs(t *testing.T) {
+	state := NewStateDir(t.TempDir())
+	channel := filepath.Join(t.TempDir(), "journal")
+	_ = ensureDir(channel)
+	r, err := NewJournalReader(JournalSettings{Output: JournalOutputLogs}, channel, state, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readExport(t, r)
+	files, _ := getFiles(channel)
+	if len(files) != 1 {
+		t.Fatalf("expected a single logs file, got %d", len(files))
+	}
+	content, _ := os.ReadFile(filepath.Join(channel, files[0].Name()))
+	logs, err := (&plog.JSONUnmarshaler{}).UnmarshalLogs(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := logs.ResourceLogs().At(0).ScopeLogs().At(0).LogRecords()
+	if records.Len() != 3 {
+		t.Fatalf("expected 3 log records, got %d", records.Len())
+	}
+	if lr := records.At(1); lr.SeverityNumber() != plog.SeverityNumberError || lr.SeverityText() != "err" {
+		t.Fatalf("unexpected severity %v %s", lr.SeverityNumber(), lr.SeverityText())
+	}
+	if unit, _ := records.At(0).Attributes().Get("systemd.unit"); unit.Str() != "nginx.service" {
+		t.Fatalf("unexpected unit %s", unit.Str())
+	}
+	// the cursor of the last entry is persisted
+	cursor, _ := os.ReadFile(state.Checkpoints("journal.cursor"))
+	if string(cursor) != "s=1;i=3" {
+		t.Fatalf("unexpected cursor %s", cursor)
+	}
+	r, _ = NewJournalReader(JournalSettings{Output: JournalOutputLogs, Units: []string{"app.service"}, Priority: "warning"}, channel, state, nil)
+	if args := strings.Join(r.args(), " "); !strings.Contains(args, "--after-cursor=s=1;i=3 --lines=all") ||
+		!strings.Contains(args, "--unit=app.service --priority=0..4") {
+		t.Fatalf("unexpected journalctl arguments %s", args)
+	}
+}
+
+func TestJournalEvents(t *testing.T) {
+	state := NewStateDir(t.TempDir())
+	_ = ensureDir(state.Submit(""))
+	r, err := NewJournalReader(JournalSettings{Output: JournalOutputEvents, MaxEvents: 100}, "", state, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readExport(t, r)
+	events, err := getEvents(state, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if events == nil || len(events.Events) != 3 {
+		t.Fatalf("expected 3 events, got %v", events)
+	}
+	var found ctl.Event
+	for _, e := range events.Events {
+		if e.Tag == "kernel" {
+			found = e
+		}
+	}
+	b, _ := json.Marshal(found)
+	if found.Severity != 4 || found.Content != "disk almost full" || found.Hostname != "host1" || found.Time.Unix() != 1666000002 {
+		t.Fatalf("unexpected event %s", b)
+	}
+}
+
+func TestJournalEventsQuota(t *testing.T) {
+	state := NewStateDir(t.TempDir())
+	_ = ensureDir(state.Submit(""))
+	r, err := NewJournalReader(JournalSettings{Output: JournalOutputEvents, MaxEvents: 2}, "", state, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, _ := os.Open("testdata/journal.export")
+	defer f.Close()
+	done := make(chan error, 1)
+	go func() { done <- r.read(f) }()
+	// the reader waits for pings to send the queued events
+	for i := 0; i < 50 && countJournalEvents(state) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case err = <-done:
+		t.Fatalf("expected the reader to wait, it returned %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if n := countJournalEvents(state); n != 2 {
+		t.Fatalf("expected 2 queued events, got %d", n)
+	}
+	// the cursor of the last event queued is kept when the reader stops
+	close(r.quit)
+	if err = <-done; err != errJournalStopped {
+		t.Fatalf("expected the reader to stop, got %v", err)
+	}
+	if cursor, _ := os.ReadFile(state.Checkpoints("journal.cursor")); string(cursor) != "s=1;i=2" {
+		t.Fatalf("unexpected cursor %s", cursor)
+	}
+}
+
+func TestJournalFollowConvertError(t *testing.T) {
+	// a journalctl that exports an entry and keeps running
+	bin := t.TempDir()
+	script := "#!/bin/sh\nprintf '__CURSOR=s=1;i=1\\nMESSAGE=hello\\n\\n'\nexec sleep 60\n"
+	if err := os.WriteFile(filepath.Join(bin, "journalctl"), []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	// the logs channel does not exist, so the entry cannot be written
+	r, err := NewJournalReader(JournalSettings{Output: JournalOutputLogs}, filepath.Join(t.TempDir(), "missing"), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- r.follow() }()
+	select {
+	case err = <-done:
+		if err == nil || !strings.Contains(err.Error(), "cannot create telemetry file") {
+			t.Fatalf("expected a write error, got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("journalctl was not stopped after the entries could not be converted")
+	}
+}
+
+func readExport(t *testing.T, r *JournalReader) {
+	f, err := os.Open("testdata/journal.export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err = r.read(f); err != nil {
+		t.Fatal(err)
+	}
+}
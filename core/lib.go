@@ -21,7 +21,6 @@ package core
 import (
 	"encoding/base64"
 	"fmt"
-	"log"
 	"math"
 	"net/http"
 	"net/url"
@@ -34,17 +33,15 @@ import (
 
 // HomeDir pilot's home directory
 func HomeDir() string {
-	defer TRA(CE())
 	usr, err := user.Current()
 	if err != nil {
-		log.Fatal(err)
+		Log.Fatal().Err(err).Msg("cannot determine the current user")
 	}
 	return usr.HomeDir
 }
 
 // reverse the passed-in string
 func reverse(str string) (result string) {
-	defer TRA(CE())
 	for _, v := range str {
 		result = string(v) + result
 	}
@@ -52,7 +49,6 @@ func reverse(str string) (result string) {
 }
 
 func newToken(hostUUID, hostIP, hostName string) string {
-	defer TRA(CE())
 	// create an authentication token as follows:
 	// 1. takes host uuid (i.e. machine Id + hostname hash), host ip, name and unix time
 	// 2. base 64 encode
@@ -63,7 +59,6 @@ func newToken(hostUUID, hostIP, hostName string) string {
 }
 
 func commandExists(cmd string) bool {
-	defer TRA(CE())
 	_, err := exec.LookPath(cmd)
 	return err == nil
 }
@@ -75,12 +70,11 @@ func commandExists(cmd string) bool {
 //   - n is the number of failures that have occurred
 //   - multiplier is an arbitrary multiplier that can be replaced with any suitable value
 func nextInterval(failureCount float64) time.Duration {
-	defer TRA(CE())
 	// multiplier 2.0 yields 15s, 60s, 135s, 240s, 375s, 540s, etc
 	interval := 15 * math.Pow(2.0, failureCount)
-	// puts a maximum limit of 1 hour
-	if interval > 3600 {
-		interval = 3600
+	// puts a maximum limit, 1 hour by default
+	if max := CurrentSettings().Limits.MaxRetryInterval.Duration().Seconds(); interval > max {
+		interval = max
 	}
 	duration, err := time.ParseDuration(fmt.Sprintf("%fs", interval))
 	if err != nil {
@@ -89,14 +83,24 @@ func nextInterval(failureCount float64) time.Duration {
 	return duration
 }
 
+// backoffTime exponentially increase backoff time until reaching 1 hour
+// used to retry telemetry and CVE report uploads
+func backoffTime(attempts int) time.Duration {
+	var exponentialBackoffCeilingSecs int64 = 3600 // 1 hour
+	delaySecs := int64(math.Floor((math.Pow(2, float64(attempts)) - 1) * 0.5))
+	if delaySecs > exponentialBackoffCeilingSecs {
+		delaySecs = exponentialBackoffCeilingSecs
+	}
+	return time.Duration(delaySecs) * time.Second
+}
+
 func (p *Pilot) debug(msg string, a ...interface{}) {
-	if len(os.Getenv("PILOT_DEBUG")) > 0 {
+	if IsDebug() {
 		DebugLogger.Printf(msg, a...)
 	}
 }
 
 func Abs(path string) string {
-	defer TRA(CE())
 	if !filepath.IsAbs(path) {
 		p, err := filepath.Abs(path)
 		if err != nil {
@@ -108,24 +112,24 @@ func Abs(path string) string {
 	return path
 }
 
-// Proxy returns a proxy func or nil if PILOT_HTTP_PROXY is not set
-// Nil value means no proxy used in http.Transport
+// Proxy returns a proxy func using the proxy configured in tls.proxy or PILOT_HTTP_PROXY
+// the proxy is looked up on every request so that a configuration reload applies to existing clients;
+// a nil URL means no proxy is used
 func Proxy() func(*http.Request) (*url.URL, error) {
-	// constructs a proxy func if a proxy URL has been defined
-	var proxy func(*http.Request) (*url.URL, error)
-	// if a proxy url is set
-	if v := os.Getenv("PILOT_HTTP_PROXY"); len(v) > 0 {
+	return func(*http.Request) (*url.URL, error) {
+		v := CurrentSettings().TLS.Proxy
+		if len(v) == 0 {
+			return nil, nil
+		}
 		proxyURL, err := url.Parse(v)
 		if err != nil {
-			log.Printf("invalid proxy URL: %s, proxy will be disabled\n", err)
-		} else {
-			// set the value of proxy function
-			proxy = http.ProxyURL(proxyURL)
+			WarningLogger.Printf("invalid proxy URL: %s, proxy will be disabled\n", err)
+			return nil, nil
 		}
+		return proxyURL, nil
 	}
-	return proxy
 }
 
 func IsDebug() bool {
-	return len(os.Getenv("PILOT_DEBUG")) > 0
+	return CurrentSettings().Log.Debug
 }
@@ -19,11 +19,21 @@
 package core
 
 import (
+	"fmt"
+	"github.com/rs/zerolog"
+	"io"
 	"log"
 	"log/syslog"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
+// Log the structured logger all pilot output goes through
+// messages logged with the standard loggers below are written through it, so levels and format apply everywhere
+var Log = newLogger(splitWriter{out: textWriter(os.Stdout), err: textWriter(os.Stderr)})
+
 var (
 	WarningLogger *log.Logger
 	InfoLogger    *log.Logger
@@ -32,9 +42,112 @@ var (
 	SyslogWriter  *syslog.Writer
 )
 
+// log output formats
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
 func init() {
-	InfoLogger = log.New(os.Stdout, "PILOT INFO: ", log.Ldate|log.Ltime|log.Lmsgprefix|log.LUTC|log.Lmicroseconds)
-	WarningLogger = log.New(os.Stdout, "PILOT WARNING: ", log.Ldate|log.Ltime|log.Lmsgprefix|log.LUTC|log.Lmicroseconds)
-	ErrorLogger = log.New(os.Stderr, "PILOT ERROR: ", log.Ldate|log.Ltime|log.Lmsgprefix|log.LUTC|log.Lmicroseconds)
-	DebugLogger = log.New(os.Stdout, "PILOT DEBUG: ", log.Ldate|log.Ltime|log.Lmsgprefix|log.LUTC|log.Lmicroseconds)
+	InfoLogger = log.New(levelWriter(zerolog.InfoLevel), "", 0)
+	WarningLogger = log.New(levelWriter(zerolog.WarnLevel), "", 0)
+	ErrorLogger = log.New(levelWriter(zerolog.ErrorLevel), "", 0)
+	DebugLogger = log.New(levelWriter(zerolog.DebugLevel), "", 0)
+	zerolog.TimeFieldFormat = time.RFC3339Nano
+}
+
+func newLogger(w io.Writer) zerolog.Logger {
+	return zerolog.New(w).With().Timestamp().Logger()
+}
+
+// logFor returns the logger of a pilot component, e.g. worker or telemetry
+func logFor(component string) *zerolog.Logger {
+	l := Log.With().Str("component", component).Logger()
+	return &l
+}
+
+// ConfigureLogging sets the level, format and destination of the pilot logs
+func ConfigureLogging(s *Settings) error {
+	var w io.Writer
+	if len(s.Log.File) > 0 {
+		if err := ensureDir(filepath.Dir(Abs(s.Log.File))); err != nil {
+			return fmt.Errorf("cannot create log folder: %s", err)
+		}
+		fr, err := newLogFileRotator(Abs(s.Log.File), int64(s.Log.MaxDays))
+		if err != nil {
+			return fmt.Errorf("cannot open log file: %s", err)
+		}
+		w = fr
+		if s.Log.Format != LogFormatJSON {
+			w = textWriter(fr)
+		}
+	} else if s.Log.Format == LogFormatJSON {
+		w = splitWriter{out: os.Stdout, err: os.Stderr}
+	} else {
+		w = splitWriter{out: textWriter(os.Stdout), err: textWriter(os.Stderr)}
+	}
+	Log = newLogger(w)
+	if A != nil {
+		setLogHostUUID(A.HostUUID)
+	}
+	setLogLevel(s.Log.Level, s.Log.Debug)
+	return nil
+}
+
+// setLogHostUUID adds the host UUID to every log entry
+func setLogHostUUID(hostUUID string) {
+	Log = Log.With().Str("host_uuid", hostUUID).Logger()
+}
+
+// setLogLevel sets the minimum level of the entries logged, debug entries are also logged if log.debug is set
+func setLogLevel(level string, debug bool) {
+	logLevel, err := zerolog.ParseLevel(strings.ToLower(level))
+	if err != nil || len(level) == 0 {
+		Log.Warn().Msgf("invalid log level '%s', defaulting log level to INFO", level)
+		logLevel = zerolog.InfoLevel
+	}
+	if debug && logLevel > zerolog.DebugLevel {
+		logLevel = zerolog.DebugLevel
+	}
+	zerolog.SetGlobalLevel(logLevel)
+}
+
+// textWriter writes log entries in a human-readable format
+func textWriter(out io.Writer) io.Writer {
+	return zerolog.ConsoleWriter{
+		Out:        out,
+		NoColor:    true,
+		TimeFormat: "2006/01/02 15:04:05.000000",
+		FormatLevel: func(i interface{}) string {
+			level := strings.ToUpper(fmt.Sprintf("%s", i))
+			if level == "WARN" {
+				level = "WARNING"
+			}
+			return fmt.Sprintf("PILOT %s:", level)
+		},
+	}
+}
+
+// splitWriter writes error entries and above to a separate writer, usually stderr
+type splitWriter struct {
+	out, err io.Writer
+}
+
+func (w splitWriter) Write(p []byte) (int, error) {
+	return w.out.Write(p)
+}
+
+func (w splitWriter) WriteLevel(level zerolog.Level, p []byte) (int, error) {
+	if level >= zerolog.ErrorLevel && level != zerolog.NoLevel {
+		return w.err.Write(p)
+	}
+	return w.out.Write(p)
+}
+
+// levelWriter adapts a standard logger to write entries of the specified level to the structured logger
+type levelWriter zerolog.Level
+
+func (l levelWriter) Write(p []byte) (int, error) {
+	Log.WithLevel(zerolog.Level(l)).Msg(strings.TrimRight(string(p), "\n"))
+	return len(p), nil
 }
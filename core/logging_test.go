@@ -0,0 +1,65 @@
+/*
+   Pilot Host Controller
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestJSONLogging(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "pilot.log")
+	s := DefaultSettings()
+	s.Log.Format = LogFormatJSON
+	s.Log.File = file
+	if err := ConfigureLogging(s); err != nil {
+		t.Fatal(err)
+	}
+	defer ConfigureLogging(DefaultSettings())
+	logFor("worker").Info().Int64("job_id", 42).Msg("starting job")
+	InfoLogger.Printf("legacy message\n")
+	DebugLogger.Printf("not logged at info level\n")
+
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var entries []map[string]interface{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		entry := map[string]interface{}{}
+		if err = json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("log entry is not JSON: %s", scanner.Text())
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(entries))
+	}
+	if entries[0]["level"] != "info" || entries[0]["component"] != "worker" || entries[0]["job_id"] != float64(42) {
+		t.Fatalf("unexpected entry: %v", entries[0])
+	}
+	if entries[1]["message"] != "legacy message" {
+		t.Fatalf("unexpected entry: %v", entries[1])
+	}
+}
@@ -0,0 +1,206 @@
+/*
+   Pilot Host Controller
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"time"
+)
+
+// metricsRegistry the registry of the metrics pilot exposes about itself
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	pingDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "pilot_ping_duration_seconds",
+		Help:    "The latency of ping requests to pilot control.",
+		Buckets: prometheus.DefBuckets,
+	})
+	pingFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "pilot_ping_failures_total",
+		Help: "The number of failed ping requests to pilot control.",
+	})
+	registrationAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pilot_registration_attempts_total",
+		Help: "The number of host registration attempts by result.",
+	}, []string{"result"})
+	jobsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pilot_jobs_total",
+		Help: "The number of jobs by outcome: success, failure or rejected.",
+	}, []string{"outcome"})
+	jobDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "pilot_job_duration_seconds",
+		Help:    "The duration of job executions by outcome.",
+		Buckets: []float64{1, 5, 15, 30, 60, 120, 300, 600, 1800, 3600},
+	}, []string{"outcome"})
+	telemetrySubmitted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pilot_telemetry_files_submitted_total",
+		Help: "The number of telemetry files submitted to pilot control by type and channel.",
+	}, []string{"type", "channel"})
+	cveUploads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pilot_cve_uploads_total",
+		Help: "The number of CVE report uploads by result.",
+	}, []string{"result"})
+	spoolDiscardedFiles = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pilot_telemetry_discarded_files_total",
+		Help: "The number of telemetry files discarded by the spool by type, channel and reason.",
+	}, []string{"type", "channel", "reason"})
+	spoolDiscardedBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pilot_telemetry_discarded_bytes_total",
+		Help: "The size of the telemetry files discarded by the spool by type, channel and reason.",
+	}, []string{"type", "channel", "reason"})
+	spoolSize = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pilot_telemetry_spool_bytes",
+		Help: "The size of the telemetry files waiting to be uploaded or in quarantine by state.",
+	}, []string{"state"})
+	telemetryQuarantined = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pilot_telemetry_quarantined_files_total",
+		Help: "The number of telemetry files quarantined because they could not be read or were rejected by type and channel.",
+	}, []string{"type", "channel"})
+	uploadRawBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pilot_upload_raw_bytes_total",
+		Help: "The size of the bodies uploaded to pilot control before compression by kind and encoding.",
+	}, []string{"kind", "encoding"})
+	uploadSentBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pilot_upload_sent_bytes_total",
+		Help: "The size of the bodies uploaded to pilot control after compression by kind and encoding.",
+	}, []string{"kind", "encoding"})
+	uploadCompressionRatio = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "pilot_upload_compression_ratio",
+		Help:    "The ratio of the uncompressed to the compressed size of the bodies uploaded to pilot control.",
+		Buckets: []float64{1, 1.5, 2, 3, 5, 10, 20, 50},
+	}, []string{"kind", "encoding"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		pingDuration,
+		pingFailures,
+		registrationAttempts,
+		jobsTotal,
+		jobDuration,
+		telemetrySubmitted,
+		cveUploads,
+		spoolDiscardedFiles,
+		spoolDiscardedBytes,
+		spoolSize,
+		telemetryQuarantined,
+		uploadRawBytes,
+		uploadSentBytes,
+		uploadCompressionRatio,
+	)
+}
+
+// resultLabel returns the result label of an operation
+func resultLabel(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+// pilotCollector collects the metrics read from the pilot state when scraped
+type pilotCollector struct {
+	p                  *Pilot
+	queueFiles         *prometheus.Desc
+	telemetryBacklog   *prometheus.Desc
+	telemetryHealthy   *prometheus.Desc
+	cveReports         *prometheus.Desc
+	activationDaysLeft *prometheus.Desc
+}
+
+func newPilotCollector(p *Pilot) *pilotCollector {
+	return &pilotCollector{
+		p: p,
+		queueFiles: prometheus.NewDesc("pilot_queue_files",
+			"The number of files in the local queues: process (jobs) and submit (results and events).",
+			[]string{"queue"}, nil),
+		telemetryBacklog: prometheus.NewDesc("pilot_telemetry_backlog_files",
+			"The number of telemetry files waiting to be submitted by type and channel.",
+			[]string{"type", "channel"}, nil),
+		telemetryHealthy: prometheus.NewDesc("pilot_telemetry_channel_healthy",
+			"1 if the telemetry channel is submitting its files, 0 if submissions are failing or the channel failed.",
+			[]string{"type", "channel"}, nil),
+		cveReports: prometheus.NewDesc("pilot_cve_reports",
+			"The number of CVE reports by state: pending upload, retrying after a failed upload or failed permanently.",
+			[]string{"state"}, nil),
+		activationDaysLeft: prometheus.NewDesc("pilot_activation_days_remaining",
+			"The number of days until the activation key expires.",
+			nil, nil),
+	}
+}
+
+func (c *pilotCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.queueFiles
+	ch <- c.telemetryBacklog
+	ch <- c.telemetryHealthy
+	ch <- c.cveReports
+	ch <- c.activationDaysLeft
+}
+
+func (c *pilotCollector) Collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(c.queueFiles, prometheus.GaugeValue, float64(countFiles(c.p.state.Process(""), "")), "process")
+	ch <- prometheus.MustNewConstMetric(c.queueFiles, prometheus.GaugeValue, float64(countFiles(c.p.state.Submit(""), "")), "submit")
+	c.p.reloadMu.Lock()
+	if c.p.telem != nil {
+		for _, channel := range c.p.telem.Backlog() {
+			ch <- prometheus.MustNewConstMetric(c.telemetryBacklog, prometheus.GaugeValue, float64(channel.Backlog), channel.Type, channel.Channel)
+			healthy := 0.0
+			if channel.Health == HealthPass {
+				healthy = 1
+			}
+			ch <- prometheus.MustNewConstMetric(c.telemetryHealthy, prometheus.GaugeValue, healthy, channel.Type, channel.Channel)
+		}
+	}
+	if c.p.cveExporter != nil {
+		s := c.p.cveExporter.Status()
+		ch <- prometheus.MustNewConstMetric(c.cveReports, prometheus.GaugeValue, float64(s.Pending), "pending")
+		ch <- prometheus.MustNewConstMetric(c.cveReports, prometheus.GaugeValue, float64(s.Retrying), "retrying")
+		ch <- prometheus.MustNewConstMetric(c.cveReports, prometheus.GaugeValue, float64(s.Failed), "failed")
+	}
+	c.p.reloadMu.Unlock()
+	if A != nil {
+		ch <- prometheus.MustNewConstMetric(c.activationDaysLeft, prometheus.GaugeValue, time.Until(A.Expiry).Hours()/24)
+	}
+}
+
+// serveMetrics starts the prometheus metrics listener, if enabled
+func (p *Pilot) serveMetrics() {
+	settings := CurrentSettings().Metrics
+	if !settings.Enabled {
+		return
+	}
+	if err := metricsRegistry.Register(newPilotCollector(p)); err != nil {
+		WarningLogger.Printf("cannot register pilot metrics: %s\n", err)
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+	go func() {
+		if err := http.ListenAndServe(settings.Address, mux); err != nil {
+			ErrorLogger.Printf("metrics listener stopped: %s\n", err)
+		}
+	}()
+	InfoLogger.Printf("serving metrics at http://%s/metrics\n", settings.Address)
+}
@@ -0,0 +1,53 @@
+/*
+   Pilot Host Controller
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"os"
+	"testing"
+)
+
+func TestPilotCollector(t *testing.T) {
+	state := NewStateDir(t.TempDir())
+	if err := state.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(state.Process("job_1.job"), []byte("{}"), filePerm)
+	os.WriteFile(state.Submit("job_2.result"), []byte("{}"), filePerm)
+	os.WriteFile(state.Submit("pilot_1.ev"), []byte("{}"), filePerm)
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(newPilotCollector(&Pilot{state: state}))
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	queues := map[string]float64{}
+	for _, f := range families {
+		if f.GetName() != "pilot_queue_files" {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			queues[m.GetLabel()[0].GetValue()] = m.GetGauge().GetValue()
+		}
+	}
+	if queues["process"] != 1 || queues["submit"] != 2 {
+		t.Fatalf("unexpected queue sizes %v", queues)
+	}
+}
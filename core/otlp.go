@@ -0,0 +1,271 @@
+/*
+   Pilot Host Controller
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"go.opentelemetry.io/collector/pdata/plog"
+	"go.opentelemetry.io/collector/pdata/plog/plogotlp"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+	"go.opentelemetry.io/collector/pdata/pmetric/pmetricotlp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	_ "google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/status"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"time"
+)
+
+// the maximum size of an OTLP request
+const otlpMaxRequestBytes = 8 << 20
+
+// OTLPReceiver receives metrics and logs pushed by local applications using OTLP over HTTP and gRPC, and writes
+// them to the telemetry channel folders, from where processors upload them to pilot control
+type OTLPReceiver struct {
+	metricsPath string
+	logsPath    string
+	settings    OTLPSettings
+	// the spool received telemetry is written to
+	spool      *Spool
+	httpServer *http.Server
+	grpcServer *grpc.Server
+}
+
+func NewOTLPReceiver(metricsPath, logsPath string, settings OTLPSettings, spool *Spool) *OTLPReceiver {
+	return &OTLPReceiver{
+		metricsPath: metricsPath,
+		logsPath:    logsPath,
+		settings:    settings,
+		spool:       spool,
+	}
+}
+
+// Start starts the HTTP listener and, if an address is set, the gRPC listener
+func (r *OTLPReceiver) Start() error {
+	httpListener, err := net.Listen("tcp", r.settings.HTTPAddress)
+	if err != nil {
+		return fmt.Errorf("cannot listen on %s: %s", r.settings.HTTPAddress, err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/metrics", r.serveMetrics)
+	mux.HandleFunc("/v1/logs", r.serveLogs)
+	r.httpServer = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := r.httpServer.Serve(httpListener); err != nil && err != http.ErrServerClosed {
+			ErrorLogger.Printf("OTLP/HTTP receiver stopped: %s\n", err)
+		}
+	}()
+	InfoLogger.Printf("OTLP/HTTP receiver listening on %s\n", r.settings.HTTPAddress)
+	if len(r.settings.GRPCAddress) == 0 {
+		return nil
+	}
+	grpcListener, err := net.Listen("tcp", r.settings.GRPCAddress)
+	if err != nil {
+		_ = r.httpServer.Close()
+		return fmt.Errorf("cannot listen on %s: %s", r.settings.GRPCAddress, err)
+	}
+	r.grpcServer = grpc.NewServer(grpc.MaxRecvMsgSize(otlpMaxRequestBytes))
+	pmetricotlp.RegisterGRPCServer(r.grpcServer, otlpMetricsServer{r})
+	plogotlp.RegisterGRPCServer(r.grpcServer, otlpLogsServer{r})
+	go func() {
+		if err := r.grpcServer.Serve(grpcListener); err != nil {
+			ErrorLogger.Printf("OTLP/gRPC receiver stopped: %s\n", err)
+		}
+	}()
+	InfoLogger.Printf("OTLP/gRPC receiver listening on %s\n", r.settings.GRPCAddress)
+	return nil
+}
+
+// Stop closes the listeners, telemetry already accepted is kept in the channel folders
+func (r *OTLPReceiver) Stop() {
+	if r.httpServer != nil {
+		_ = r.httpServer.Close()
+	}
+	if r.grpcServer != nil {
+		r.grpcServer.Stop()
+	}
+}
+
+// exportMetrics writes received metrics to the metrics channel
+func (r *OTLPReceiver) exportMetrics(md pmetric.Metrics) error {
+	if md.DataPointCount() == 0 {
+		return nil
+	}
+	content, err := (&pmetric.JSONMarshaler{}).MarshalMetrics(md)
+	if err != nil {
+		return fmt.Errorf("cannot marshal metrics: %s", err)
+	}
+	return r.spool.write(r.metricsPath, "otlp", content)
+}
+
+// exportLogs writes received logs to the logs channel
+func (r *OTLPReceiver) exportLogs(ld plog.Logs) error {
+	if ld.LogRecordCount() == 0 {
+		return nil
+	}
+	content, err := (&plog.JSONMarshaler{}).MarshalLogs(ld)
+	if err != nil {
+		return fmt.Errorf("cannot marshal logs: %s", err)
+	}
+	return r.spool.write(r.logsPath, "otlp", content)
+}
+
+func (r *OTLPReceiver) serveMetrics(w http.ResponseWriter, req *http.Request) {
+	body, isJSON, ok := readOTLPRequest(w, req)
+	if !ok {
+		return
+	}
+	request := pmetricotlp.NewRequest()
+	var err error
+	if isJSON {
+		err = request.UnmarshalJSON(body)
+	} else {
+		err = request.UnmarshalProto(body)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("cannot decode metrics: %s", err), http.StatusBadRequest)
+		return
+	}
+	if err = r.exportMetrics(request.Metrics()); err != nil {
+		ErrorLogger.Printf("cannot accept OTLP metrics: %s\n", err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	writeOTLPResponse(w, isJSON, pmetricotlp.NewResponse())
+}
+
+func (r *OTLPReceiver) serveLogs(w http.ResponseWriter, req *http.Request) {
+	body, isJSON, ok := readOTLPRequest(w, req)
+	if !ok {
+		return
+	}
+	request := plogotlp.NewRequest()
+	var err error
+	if isJSON {
+		err = request.UnmarshalJSON(body)
+	} else {
+		err = request.UnmarshalProto(body)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("cannot decode logs: %s", err), http.StatusBadRequest)
+		return
+	}
+	if err = r.exportLogs(request.Logs()); err != nil {
+		ErrorLogger.Printf("cannot accept OTLP logs: %s\n", err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	writeOTLPResponse(w, isJSON, plogotlp.NewResponse())
+}
+
+// readOTLPRequest reads the body of an OTLP/HTTP request, which can be protobuf or JSON and gzip compressed
+// if the request is not valid, an error response is written and ok is false
+func readOTLPRequest(w http.ResponseWriter, req *http.Request) (body []byte, isJSON bool, ok bool) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil, false, false
+	}
+	contentType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	switch contentType {
+	case "application/json":
+		isJSON = true
+	case "application/x-protobuf":
+	default:
+		http.Error(w, fmt.Sprintf("unsupported content type '%s'", contentType), http.StatusUnsupportedMediaType)
+		return nil, false, false
+	}
+	var reader io.Reader = http.MaxBytesReader(w, req.Body, otlpMaxRequestBytes)
+	switch req.Header.Get("Content-Encoding") {
+	case "", "identity":
+	case "gzip":
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("cannot decompress request: %s", err), http.StatusBadRequest)
+			return nil, false, false
+		}
+		defer gz.Close()
+		reader = io.LimitReader(gz, otlpMaxRequestBytes)
+	default:
+		http.Error(w, fmt.Sprintf("unsupported content encoding '%s'", req.Header.Get("Content-Encoding")), http.StatusUnsupportedMediaType)
+		return nil, false, false
+	}
+	body, err := io.ReadAll(reader)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("cannot read request: %s", err), http.StatusBadRequest)
+		return nil, false, false
+	}
+	return body, isJSON, true
+}
+
+// otlpResponse an OTLP export response
+type otlpResponse interface {
+	MarshalJSON() ([]byte, error)
+	MarshalProto() ([]byte, error)
+}
+
+func writeOTLPResponse(w http.ResponseWriter, isJSON bool, resp otlpResponse) {
+	var (
+		b   []byte
+		err error
+	)
+	if isJSON {
+		w.Header().Set("Content-Type", "application/json")
+		b, err = resp.MarshalJSON()
+	} else {
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		b, err = resp.MarshalProto()
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, _ = w.Write(b)
+}
+
+// otlpMetricsServer the OTLP/gRPC metrics service
+type otlpMetricsServer struct {
+	r *OTLPReceiver
+}
+
+func (s otlpMetricsServer) Export(_ context.Context, req pmetricotlp.Request) (pmetricotlp.Response, error) {
+	if err := s.r.exportMetrics(req.Metrics()); err != nil {
+		ErrorLogger.Printf("cannot accept OTLP metrics: %s\n", err)
+		return pmetricotlp.NewResponse(), status.Error(codes.Unavailable, err.Error())
+	}
+	return pmetricotlp.NewResponse(), nil
+}
+
+// otlpLogsServer the OTLP/gRPC logs service
+type otlpLogsServer struct {
+	r *OTLPReceiver
+}
+
+func (s otlpLogsServer) Export(_ context.Context, req plogotlp.Request) (plogotlp.Response, error) {
+	if err := s.r.exportLogs(req.Logs()); err != nil {
+		ErrorLogger.Printf("cannot accept OTLP logs: %s\n", err)
+		return plogotlp.NewResponse(), status.Error(codes.Unavailable, err.Error())
+	}
+	return plogotlp.NewResponse(), nil
+}
@@ -0,0 +1,102 @@
+/*
+   Pilot Host Controller
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"bytes"
+	"compress/gzip"
+	"go.opentelemetry.io/collector/pdata/plog"
+	"go.opentelemetry.io/collector/pdata/plog/plogotlp"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+	"go.opentelemetry.io/collector/pdata/pmetric/pmetricotlp"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOTLPReceiver(t *testing.T) {
+	dir := t.TempDir()
+	r := NewOTLPReceiver(filepath.Join(dir, "metrics"), filepath.Join(dir, "logs"), DefaultSettings().Telemetry.OTLP, nil)
+	_ = os.MkdirAll(r.metricsPath, dirPerm)
+	_ = os.MkdirAll(r.logsPath, dirPerm)
+
+	// metrics in JSON format
+	md := pmetric.NewMetrics()
+	m := md.ResourceMetrics().AppendEmpty().ScopeMetrics().AppendEmpty().Metrics().AppendEmpty()
+	m.SetName("app.requests")
+	m.SetEmptyGauge().DataPoints().AppendEmpty().SetIntValue(3)
+	body, _ := pmetricotlp.NewRequestFromMetrics(md).MarshalJSON()
+	req := httptest.NewRequest(http.MethodPost, "/v1/metrics", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	r.serveMetrics(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", w.Code, w.Body.String())
+	}
+	if files, _ := getFiles(r.metricsPath); len(files) != 1 {
+		t.Fatalf("expected 1 metrics file, got %d", len(files))
+	}
+
+	// logs in gzip compressed protobuf format
+	ld := plog.NewLogs()
+	ld.ResourceLogs().AppendEmpty().ScopeLogs().AppendEmpty().LogRecords().AppendEmpty().Body().SetStr("started")
+	proto, _ := plogotlp.NewRequestFromLogs(ld).MarshalProto()
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	_, _ = zw.Write(proto)
+	_ = zw.Close()
+	req = httptest.NewRequest(http.MethodPost, "/v1/logs", &gz)
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "gzip")
+	w = httptest.NewRecorder()
+	r.serveLogs(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", w.Code, w.Body.String())
+	}
+	files, _ := getFiles(r.logsPath)
+	if len(files) != 1 {
+		t.Fatalf("expected 1 logs file, got %d", len(files))
+	}
+	content, _ := os.ReadFile(filepath.Join(r.logsPath, files[0].Name()))
+	if !strings.Contains(string(content), "started") {
+		t.Fatalf("unexpected logs file content: %s", content)
+	}
+
+	// unsupported content type
+	req = httptest.NewRequest(http.MethodPost, "/v1/logs", strings.NewReader("started"))
+	req.Header.Set("Content-Type", "text/plain")
+	w = httptest.NewRecorder()
+	r.serveLogs(w, req)
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("expected status 415, got %d", w.Code)
+	}
+}
+
+func TestOTLPReceiverLoopback(t *testing.T) {
+	s := DefaultSettings()
+	s.Telemetry.OTLP.Enabled = true
+	s.Telemetry.OTLP.HTTPAddress = "0.0.0.0:4318"
+	err := s.Validate()
+	if err == nil || !strings.Contains(err.Error(), "telemetry.otlp.http_address") {
+		t.Fatalf("expected a loopback address error, got %v", err)
+	}
+}
@@ -19,14 +19,15 @@
 package core
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/pkg/profile"
 	"os"
-	"path"
 	"southwinds.dev/artisan/core"
 	ctl "southwinds.dev/pilotctl/types"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -40,20 +41,36 @@ type Pilot struct {
 	worker       *Worker
 	connected    bool
 	pingInterval time.Duration
-	options      PilotOptions
-	cveExporter  *CVEExporter
+	// the time of the last successful ping
+	lastPing time.Time
+	// when pilot started
+	started time.Time
+	// guards the connection state read by the status API
+	statusMu    sync.RWMutex
+	options     PilotOptions
+	cveExporter *CVEExporter
+	telem       *TelemCtl
+	state       *StateDir
+	// serialises configuration reloads
+	reloadMu sync.Mutex
+	// the last time verification keys were requested from pilot control
+	keysRefreshed time.Time
 }
 
 type PilotOptions struct {
 	UseHwId            bool
 	Telemetry          bool
-	Tracing            bool
 	Info               *ctl.HostInfo
 	CPU                bool
 	MEM                bool
 	InsecureSkipVerify bool
 	CVEPath            string
 	CVEUploadDelay     int
+	// loads the settings when the configuration is reloaded, applying the same overrides used at launch
+	// if nil, the settings are loaded from the configuration file and environment
+	LoadSettings func() (*Settings, error)
+	// the folder where pilot keeps its local state, if nil it is resolved from the settings
+	State *StateDir
 }
 
 func NewPilot(options PilotOptions) (*Pilot, error) {
@@ -66,21 +83,36 @@ func NewPilot(options PilotOptions) (*Pilot, error) {
 |  _/        _/_/_/  _/_/_/_/    _/_/        _/           |
 |                     Host Controller                     | 
 +---------------------------------------------------------+`)
-	// configure code execution trace
-	TRA, CE = NewTracer(options.Tracing)
+	if options.State == nil {
+		options.State = DefaultStateDir()
+	}
+	state := options.State
+	if err := ConfigureLogging(CurrentSettings()); err != nil {
+		return nil, err
+	}
 	InfoLogger.Printf("launching pilot version %s\n", Version)
 	info := options.Info
-	checkPaths()
+	checkState(state)
+	// open the audit log
+	audit, err := OpenAuditLog(state.Audit())
+	if err != nil {
+		return nil, err
+	}
+	Audit = audit
 	activate(options)
 	InfoLogger.Printf("using Host UUID = '%s'\n", info.HostUUID)
+	// export spans, pilot runs until the process exits, so pending spans are not flushed
+	if _, err = StartTracing(CurrentSettings(), state); err != nil {
+		return nil, err
+	}
 	// read configuration
 	cfg := &Config{}
-	err := cfg.Load()
+	err = cfg.Load()
 	if err != nil {
 		return nil, err
 	}
 	// create a new job worker
-	worker := NewCmdRequestWorker()
+	worker := NewCmdRequestWorker(state)
 	// create proxy to talk to pilotctl
 	r, err := NewPilotCtl(worker, options)
 	if err != nil {
@@ -92,38 +124,40 @@ func NewPilot(options PilotOptions) (*Pilot, error) {
 		ctl:     r,
 		worker:  worker,
 		options: options,
+		state:   state,
+		started: time.Now(),
 	}
 	// configure cpu or memory profiling
 	if options.CPU && !options.MEM {
 		// cpu profiling
-		core.InfoLogger.Printf("enabling CPU profiling\n")
+		InfoLogger.Printf("enabling CPU profiling\n")
 		defer profile.Start(profile.CPUProfile).Stop()
 	} else if options.MEM && !options.CPU {
 		// memory profiling
-		core.InfoLogger.Printf("enabling MEMORY profiling\n")
+		InfoLogger.Printf("enabling MEMORY profiling\n")
 		defer profile.Start(profile.MemProfile).Stop()
 	} else if options.MEM && options.CPU {
 		core.RaiseErr("cannot profile cpu and memory at the same time")
 	}
 	// configure CVE exporter if enabled
 	if len(options.CVEPath) > 0 {
-		p.cveExporter = NewCVEExporter(p.ctl, options.CVEPath)
+		p.cveExporter = NewCVEExporter(p.ctl, options.CVEPath, p.state)
 	}
 	// return a new pilot
 	return p, nil
 }
 
 func (p *Pilot) Start() {
-	defer TRA(CE())
 	// starts the collector service
 	if p.options.Telemetry {
 		// creates a new telemetry collector
-		collector, err := NewTelemCtl()
+		collector, err := NewTelemCtl(p.state)
 		if err != nil {
 			ErrorLogger.Printf("cannot create pilot telemetry loop: %s\n", err)
 			os.Exit(1)
 		}
 		collector.Start(p.ctl)
+		p.telem = collector
 	} else {
 		InfoLogger.Printf("telemetry loop has been disabled\n")
 	}
@@ -139,23 +173,37 @@ func (p *Pilot) Start() {
 			os.Exit(1)
 		}
 	}
+	// serves the local status API
+	p.serveStatus()
+	// serves prometheus metrics, if enabled
+	p.serveMetrics()
+	// reloads the configuration on SIGHUP and, if enabled, when the configuration file changes
+	p.watchConfig()
 	// registers the host
 	p.register()
 	// starts the jobs worker
 	p.worker.Start()
+	// checks for verification key rotations
+	p.refreshKeys()
 	// initiates the ping loop
 	p.ping()
 }
 
 // register the host, keep retrying indefinitely until a registration is successful
 func (p *Pilot) register() {
-	defer TRA(CE())
 	var failures float64 = 0
 	// starts a loop
 	for {
-		op, err := p.ctl.Register()
+		ctx, span := startSpan(context.Background(), "register")
+		op, err := p.ctl.Register(ctx)
+		endSpan(span, err)
+		registrationAttempts.WithLabelValues(resultLabel(err)).Inc()
 		// if no error then exit the loop
 		if err == nil {
+			audit(AuditRegistration, map[string]interface{}{
+				"uri":       p.ctl.cfg.BaseURI,
+				"operation": op.Operation,
+			})
 			switch strings.ToUpper(op.Operation) {
 			case "I":
 				InfoLogger.Printf("new host registration created successfully\n")
@@ -166,7 +214,9 @@ func (p *Pilot) register() {
 			}
 
 			// set the fallback ping interval, this will be automatically adjusted with the first ping response
-			p.pingInterval, _ = time.ParseDuration("15s")
+			p.statusMu.Lock()
+			p.pingInterval = CurrentSettings().Intervals.Ping.Duration()
+			p.statusMu.Unlock()
 
 			// break the loop
 			break
@@ -187,23 +237,31 @@ func (p *Pilot) register() {
 }
 
 func (p *Pilot) ping() {
-	defer TRA(CE())
 	for {
-		resp, err := p.ctl.Ping()
+		start := time.Now()
+		ctx, span := startSpan(context.Background(), "ping")
+		resp, err := p.ctl.Ping(ctx)
+		pingDuration.Observe(time.Since(start).Seconds())
 		if err != nil {
+			pingFailures.Inc()
 			// write to the console output
 			WarningLogger.Printf("ping failed: %s\n", err)
+			p.statusMu.Lock()
 			p.connected = false
+			p.statusMu.Unlock()
 		} else {
 			if !p.connected {
 				InfoLogger.Printf("ping loop operational\n")
 			}
+			p.statusMu.Lock()
 			p.connected = true
-			// verify the host identity and response integrity using Pretty Good Privacy (PGP)
-			// TODO: use verify() instead
-			err = verify2(resp.Envelope, resp.Signature)
+			p.lastPing = time.Now()
+			p.statusMu.Unlock()
+			// verify the host identity and response integrity using the trusted verification keys
+			var signer string
+			signer, err = VerifySigner(resp.Envelope, resp.Signature)
 			// if debug is enabled shows commands sent by pilot control
-			if len(p.cfg.Get(PilotDebug)) > 0 {
+			if IsDebug() {
 				respBytes, err2 := json.Marshal(resp)
 				if err2 != nil {
 					WarningLogger.Printf("cannot marshal pilotctl response: %s", err)
@@ -214,49 +272,85 @@ func (p *Pilot) ping() {
 			// if the verification fails, it is likely spoofing of pilotctl has happened
 			if err != nil {
 				WarningLogger.Printf("invalid host signature, cannot trust the pilot control service => %s\n", err)
+				if resp.Envelope.Command.JobId > 0 {
+					audit(AuditPolicy, map[string]interface{}{
+						"job_id":   resp.Envelope.Command.JobId,
+						"decision": "reject",
+						"reason":   err.Error(),
+					})
+				}
 			} else { // if the host can be trusted
 				cmd := resp.Envelope.Command
 				// do we have a command to process?
 				if cmd.JobId > 0 {
+					span.SetAttributes(attrJobId.Int64(cmd.JobId))
+					audit(AuditEnvelope, map[string]interface{}{
+						"job_id":   cmd.JobId,
+						"package":  cmd.Package,
+						"function": cmd.Function,
+						"signer":   signer,
+					})
 					// execute the job
-					InfoLogger.Printf("starting execution of job #%v, package => '%s', fx => '%s'\n", cmd.JobId, cmd.Package, cmd.Function)
-					p.worker.AddJob(cmd)
+					logFor("ping").Info().Int64("job_id", cmd.JobId).Msgf("starting execution of job #%v, package => '%s', fx => '%s'", cmd.JobId, cmd.Package, cmd.Function)
+					p.worker.AddSignedJob(resp)
 				}
 			}
 		}
+		endSpan(span, err)
 		// if the  pilot interval is different from the interval requested by pilot control
 		if resp.Envelope.Interval.Seconds() > 0 && p.pingInterval != resp.Envelope.Interval {
 			// issue a notice about the ping interval adjustment
 			InfoLogger.Printf("adjusting ping interval to %.0f seconds\n", resp.Envelope.Interval.Seconds())
 			// update the local interval value
+			p.statusMu.Lock()
 			p.pingInterval = resp.Envelope.Interval
+			p.statusMu.Unlock()
+		}
+		// periodically checks for verification key rotations
+		if p.connected && time.Since(p.keysRefreshed) > CurrentSettings().Intervals.KeyRefresh.Duration() {
+			p.refreshKeys()
 		}
 		// waits for the requested interval
 		time.Sleep(p.pingInterval)
 	}
 }
 
-// checkPaths check all required local folders used by the pilot to cache data exist and if not creates them
-func checkPaths() {
-	_, err := os.Stat(DataPath())
+// refreshKeys fetches and applies any verification key rotation available in pilot control
+func (p *Pilot) refreshKeys() {
+	p.keysRefreshed = time.Now()
+	env, err := p.ctl.GetVerifyKeys()
 	if err != nil {
-		err = os.MkdirAll(DataPath(), os.ModePerm)
-		if err != nil {
-			panic(err)
-		}
+		WarningLogger.Printf("cannot retrieve verification keys: %s\n", err)
+		return
+	}
+	if env == nil {
+		return
 	}
-	_, err = os.Stat(path.Join(DataPath(), "submit"))
+	updated, err := applyKeyRotation(*env)
 	if err != nil {
-		err = os.MkdirAll(path.Join(DataPath(), "submit"), os.ModePerm)
-		if err != nil {
-			panic(err)
-		}
+		WarningLogger.Printf("verification key rotation rejected: %s\n", err)
+		return
+	}
+	if updated {
+		InfoLogger.Printf("verification keys updated, %d key(s) received\n", len(env.Rotation.Keys))
 	}
-	_, err = os.Stat(path.Join(DataPath(), "process"))
+}
+
+// checkState validates the state folder, pilot cannot start if it cannot use it safely, then moves into it any
+// state left by previous versions in other folders
+func checkState(state *StateDir) {
+	// files are migrated first, so that the files moved are audited with the rest of the state folder
+	moved, err := state.Migrate(legacyStateRoots())
 	if err != nil {
-		err = os.MkdirAll(path.Join(DataPath(), "process"), os.ModePerm)
-		if err != nil {
-			panic(err)
-		}
+		ErrorLogger.Printf("cannot launch pilot, state migration failed: %s\n", err)
+		os.Exit(1)
+	}
+	if err = state.Validate(); err != nil {
+		ErrorLogger.Printf("cannot launch pilot: %s\n", err)
+		os.Exit(1)
+	}
+	InfoLogger.Printf("using state folder %s\n", state.Root())
+	if moved > 0 {
+		InfoLogger.Printf("moved %d file(s) left by a previous version into the state folder\n", moved)
 	}
 }
@@ -20,28 +20,48 @@ package core
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"go.opentelemetry.io/otel/trace"
 	"io"
 	"net/http"
-	"southwinds.dev/artisan/core"
 	ctlCore "southwinds.dev/pilotctl/core"
 	ctl "southwinds.dev/pilotctl/types"
 	"strings"
+)
 
-	// "strings"
-	"time"
+// headers used to send the host signature of a submitted payload
+const (
+	signatureHeader = "Pilot-Signature"
+	keyIdHeader     = "Pilot-Key-Id"
 )
 
+// hostRegistration the registration request including the public key pilot control uses to verify host signatures
+// the signature formats the host can verify, the encodings it can compress uploads with and the formats it can
+// batch telemetry with, so that pilot control can choose one of each
+type hostRegistration struct {
+	ctl.RegistrationRequest
+	HostKey    string   `json:"host_key,omitempty"`
+	Signatures []string `json:"signatures,omitempty"`
+	Encodings  []string `json:"encodings,omitempty"`
+	Batches    []string `json:"batches,omitempty"`
+}
+
 type PilotCtl struct {
 	client *ctlCore.Client
 	cfg    *ctlCore.ClientConf
 	host   *ctl.HostInfo
 	worker *Worker
+	state  *StateDir
+	// the encoding of uploaded bodies chosen by pilot control
+	encoding negotiatedEncoding
+	// whether pilot control accepts batched telemetry uploads
+	batch negotiatedBatch
 }
 
 func NewPilotCtl(worker *Worker, options PilotOptions) (*PilotCtl, error) {
-	defer TRA(CE())
 	conf := &Config{}
 	err := conf.Load()
 	if err != nil {
@@ -61,14 +81,14 @@ func NewPilotCtl(worker *Worker, options PilotOptions) (*PilotCtl, error) {
 			Username:           "_",
 			Password:           "_",
 			InsecureSkipVerify: options.InsecureSkipVerify,
-			Timeout:            5 * time.Minute,
+			Timeout:            CurrentSettings().Limits.RequestTimeout.Duration(),
 			Proxy:              Proxy(),
 		}
 		client, clientErr := ctlCore.NewClient(cfg)
 		if clientErr != nil {
 			return nil, fmt.Errorf("failed to create PilotCtl http client: %s", clientErr)
 		}
-		core.InfoLogger.Printf("trying to connect to control URI %s\n", uri)
+		InfoLogger.Printf("trying to connect to control URI %s\n", uri)
 		// issue a http get to the unauthenticated root to check for a valid response
 		var resp *http.Response
 		resp, err = client.Get(uri, nil)
@@ -80,8 +100,8 @@ func NewPilotCtl(worker *Worker, options PilotOptions) (*PilotCtl, error) {
 			// and the response is OK
 			if resp.StatusCode == 200 {
 				// return a client ready  to connect to such endpoint
-				core.InfoLogger.Printf("connected to control URI %s\n", uri)
-				return &PilotCtl{client: client, cfg: cfg, host: options.Info, worker: worker}, nil
+				InfoLogger.Printf("connected to control URI %s\n", uri)
+				return &PilotCtl{client: client, cfg: cfg, host: options.Info, worker: worker, state: options.State}, nil
 			} else {
 				// otherwise, return the error
 				return nil, fmt.Errorf("endpoint found but could not connect, reason: %s", resp.Status)
@@ -93,29 +113,51 @@ func NewPilotCtl(worker *Worker, options PilotOptions) (*PilotCtl, error) {
 }
 
 // Register the host
-func (r *PilotCtl) Register() (*ctl.RegistrationResponse, error) {
-	defer TRA(CE())
+func (r *PilotCtl) Register(ctx context.Context) (*ctl.RegistrationResponse, error) {
 	i := r.host
 	// set the machine id
-	reg := &ctl.RegistrationRequest{
-		Hostname:    i.HostName,
-		MachineId:   i.HostUUID,
-		OS:          i.OS,
-		Platform:    fmt.Sprintf("%s, %s, %s", i.Platform, i.PlatformFamily, i.PlatformVersion),
-		Virtual:     i.Virtual,
-		TotalMemory: i.TotalMemory,
-		CPUs:        i.CPUs,
-		HostIP:      i.HostIP,
-		MacAddress:  i.MacAddress,
+	reg := &hostRegistration{
+		RegistrationRequest: ctl.RegistrationRequest{
+			Hostname:    i.HostName,
+			MachineId:   i.HostUUID,
+			OS:          i.OS,
+			Platform:    fmt.Sprintf("%s, %s, %s", i.Platform, i.PlatformFamily, i.PlatformVersion),
+			Virtual:     i.Virtual,
+			TotalMemory: i.TotalMemory,
+			CPUs:        i.CPUs,
+			HostIP:      i.HostIP,
+			MacAddress:  i.MacAddress,
+		},
+		HostKey:    hostPublicKey(),
+		Signatures: SupportedSignatures,
+		Encodings:  acceptedEncodings(),
+		Batches:    SupportedBatches,
 	}
 	uri := fmt.Sprintf("%s/register", r.cfg.BaseURI)
-	resp, err := r.client.Post(uri, reg, r.addToken)
+	body, err := json.Marshal(reg)
+	if err != nil {
+		return nil, fmt.Errorf("cannot marshal registration request: %s", err)
+	}
+	req, err := http.NewRequest(http.MethodPost, uri, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if err = r.addToken(req, nil); err != nil {
+		return nil, err
+	}
+	if err = r.signRequest(req, reg); err != nil {
+		return nil, err
+	}
+	injectTrace(ctx, req)
+	resp, err := r.client.Do(req)
 	if err != nil {
 		return nil, err
 	}
 	if resp.StatusCode > 299 {
 		return nil, fmt.Errorf("the request failed with error: %d - %s", resp.StatusCode, resp.Status)
 	}
+	r.encoding.set(resp)
+	r.batch.set(resp)
 	var result ctl.RegistrationResponse
 	op, err := io.ReadAll(resp.Body)
 	err = json.Unmarshal(op, &result)
@@ -126,13 +168,13 @@ func (r *PilotCtl) Register() (*ctl.RegistrationResponse, error) {
 }
 
 // Ping send a ping to the remote server
-func (r *PilotCtl) Ping() (ctl.PingResponse, error) {
-	defer TRA(CE())
+func (r *PilotCtl) Ping(ctx context.Context) (ctl.PingResponse, error) {
 	// is there a result from a job ready?
 	var (
 		payload ctlCore.Serializable
 		result  *ctl.JobResult
 		events  *ctl.Events
+		kind    string
 	)
 	// check if the worker has a job result to be sent to pilot control
 	result, err := r.worker.Result()
@@ -142,34 +184,59 @@ func (r *PilotCtl) Ping() (ctl.PingResponse, error) {
 	if result != nil {
 		// send the job result in the ping request
 		payload = &ctl.PingRequest{Result: result}
+		kind = uploadJobResult
+		var span trace.Span
+		ctx, span = startSpan(ctx, "job.submit", attrJobId.Int64(result.JobId))
+		defer func() { endSpan(span, err) }()
 	} else {
 		// if we do not have any job result to post, can post event information
 		// try and get up to a maximum of 5 events
-		events, err = getEvents(5)
+		events, err = getEvents(r.state, 5)
 		// if there is an error retrieving events
 		if err != nil {
 			// return the error
 			return ctl.PingResponse{}, err
 		}
+		if events != nil {
+			// send the events in the ping request
+			payload = &ctl.PingRequest{Events: events}
+			kind = uploadEvents
+		}
 	}
 	uri := fmt.Sprintf("%s/ping", r.cfg.BaseURI)
-	resp, err := r.client.Post(uri, payload, r.addToken)
+	var resp *http.Response
+	if payload != nil {
+		resp, err = r.post(ctx, uri, payload, kind)
+	} else {
+		resp, err = r.client.Post(uri, payload, r.traced(ctx))
+	}
 	if err != nil {
 		return ctl.PingResponse{}, err
 	}
 	if resp.StatusCode > 299 {
-		return ctl.PingResponse{}, fmt.Errorf("call to the remote service failed: %d - %s", resp.StatusCode, resp.Status)
+		err = fmt.Errorf("call to the remote service failed: %d - %s", resp.StatusCode, resp.Status)
+		return ctl.PingResponse{}, err
 	}
+	r.encoding.set(resp)
+	r.batch.set(resp)
 	// if a result was posted to control, remove it from the local cache
 	if result != nil {
-		err = r.worker.RemoveResult(result)
-		if err != nil {
-			ErrorLogger.Printf("failed to remove job result from local queue: %s\n", err)
+		audit(AuditSubmission, map[string]interface{}{
+			"type":    "job result",
+			"job_id":  result.JobId,
+			"success": result.Success,
+		})
+		if rmErr := r.worker.RemoveResult(result); rmErr != nil {
+			ErrorLogger.Printf("failed to remove job result from local queue: %s\n", rmErr)
 		}
 	}
 	// if syslog events were posted to control, remove the marker from the local cache
 	if events != nil {
-		err = removeEvents()
+		audit(AuditSubmission, map[string]interface{}{
+			"type":  "events",
+			"count": len(events.Events),
+		})
+		err = removeEvents(r.state)
 		if err != nil {
 			ErrorLogger.Printf("failed to remove events marker from local cache: %s\n", err)
 		}
@@ -184,47 +251,171 @@ func (r *PilotCtl) Ping() (ctl.PingResponse, error) {
 	return pingResponse, nil
 }
 
+// GetVerifyKeys retrieves the current verification key rotation envelope, if pilot control has one
+func (r *PilotCtl) GetVerifyKeys() (*KeyRotationEnvelope, error) {
+	uri := fmt.Sprintf("%s/verify-keys", r.cfg.BaseURI)
+	resp, err := r.client.Get(uri, r.addToken)
+	if err != nil {
+		return nil, err
+	}
+	// no key rotation is available
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusNoContent {
+		return nil, nil
+	}
+	if resp.StatusCode > 299 {
+		return nil, fmt.Errorf("call to the remote service failed: %d - %s", resp.StatusCode, resp.Status)
+	}
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read verification keys response: %s", err)
+	}
+	env := new(KeyRotationEnvelope)
+	if err = json.Unmarshal(b, env); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal verification keys response: %s", err)
+	}
+	return env, nil
+}
+
+// traced returns a function that adds the authentication token and the trace context in ctx to a request
+func (r *PilotCtl) traced(ctx context.Context) func(req *http.Request, payload ctlCore.Serializable) error {
+	return func(req *http.Request, payload ctlCore.Serializable) error {
+		injectTrace(ctx, req)
+		return r.addToken(req, payload)
+	}
+}
+
 func (r *PilotCtl) addToken(req *http.Request, payload ctlCore.Serializable) error {
-	defer TRA(CE())
-	payload = nil
 	// add an authentication token to the request
 	req.Header.Set("Authorization", newToken(r.host.HostUUID, r.host.HostIP, r.host.HostName))
 	// all content type should be in JSON format
 	req.Header.Set("Content-Type", "application/json")
+	// advertise the encodings pilot can compress uploads with
+	if encodings := acceptedEncodings(); len(encodings) > 0 {
+		req.Header.Set(encodingsHeader, strings.Join(encodings, ", "))
+	}
+	// advertise the formats pilot can batch telemetry with
+	req.Header.Set(acceptBatchHeader, strings.Join(SupportedBatches, ", "))
+	// sign the payload so that pilot control can prove which host produced it
+	if payload != nil {
+		return r.signRequest(req, payload)
+	}
 	return nil
 }
 
-func (r *PilotCtl) SubmitCveReport(report []byte) error {
+// signRequest adds the host signature of the passed-in object checksum to the request
+func (r *PilotCtl) signRequest(req *http.Request, obj interface{}) error {
+	// the host key is only available after activation
+	if HK == nil {
+		return nil
+	}
+	sig, err := sign(HK, obj)
+	if err != nil {
+		return fmt.Errorf("cannot sign request payload: %s", err)
+	}
+	req.Header.Set(signatureHeader, sig)
+	req.Header.Set(keyIdHeader, HK.Fingerprint())
+	return nil
+}
+
+// signRequestBytes adds the host signature of the raw request content to the request
+func (r *PilotCtl) signRequestBytes(req *http.Request, content []byte) error {
+	if HK == nil {
+		return nil
+	}
+	sig, err := signBytes(HK, content)
+	if err != nil {
+		return fmt.Errorf("cannot sign request content: %s", err)
+	}
+	req.Header.Set(signatureHeader, sig)
+	req.Header.Set(keyIdHeader, HK.Fingerprint())
+	return nil
+}
+
+// post sends a payload to pilot control, compressed with the negotiated encoding
+func (r *PilotCtl) post(ctx context.Context, uri string, payload ctlCore.Serializable, kind string) (*http.Response, error) {
+	content, err := payload.Bytes()
+	if err != nil {
+		return nil, fmt.Errorf("cannot serialize %s payload: %s", kind, err)
+	}
+	return r.send(ctx, uri, *content, kind, func(req *http.Request) error {
+		return r.addToken(req, payload)
+	})
+}
+
+// send posts content to pilot control, compressed with the negotiated encoding; add sets the authentication and
+// signature headers of the request
+// if pilot control rejects the compressed body, it is sent again uncompressed and pilot falls back to uncompressed
+// uploads of this kind until pilot control chooses another encoding; only the body sent last is measured
+func (r *PilotCtl) send(ctx context.Context, uri string, content []byte, kind string, add func(req *http.Request) error) (*http.Response, error) {
+	encoding := r.encoding.get(kind)
+	for {
+		body, used, err := encodeBody(kind, encoding, content)
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequest(http.MethodPost, uri, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		if err = add(req); err != nil {
+			return nil, err
+		}
+		if used != EncodingIdentity {
+			req.Header.Set("Content-Encoding", used)
+		}
+		injectTrace(ctx, req)
+		resp, err := r.client.Do(req)
+		if err == nil && used != EncodingIdentity && resp.StatusCode == http.StatusUnsupportedMediaType {
+			WarningLogger.Printf("pilot control rejected a %s compressed %s upload, sending %s uploads uncompressed\n", used, kind, kind)
+			_ = resp.Body.Close()
+			r.encoding.reject(kind, used)
+			encoding = EncodingIdentity
+			continue
+		}
+		observeUpload(kind, used, len(content), len(body))
+		return resp, err
+	}
+}
+
+func (r *PilotCtl) SubmitCveReport(ctx context.Context, report []byte) error {
 	var payload ctlCore.Serializable
 	payload = &ctl.CveRequest{
 		HostUUID: r.host.HostUUID,
 		Report:   report,
 	}
 	uri := fmt.Sprintf("%s/cve/upload", r.cfg.BaseURI)
-	resp, err := r.client.Post(uri, payload, r.addToken)
+	resp, err := r.post(ctx, uri, payload, uploadCVE)
 	if err != nil {
 		return fmt.Errorf("cannot submit CVE report: %s", err)
 	}
 	if resp.StatusCode > 299 {
-		return fmt.Errorf("cannot submit CVE report: call to the remote service failed, %d - %s", resp.StatusCode, resp.Status)
+		return &RequestError{StatusCode: resp.StatusCode, Status: resp.Status, Op: "submit CVE report"}
 	}
+	audit(AuditSubmission, map[string]interface{}{
+		"type":  "cve report",
+		"bytes": len(report),
+	})
 	return nil
 }
 
-func (r *PilotCtl) SubmitTelemetry(channel string, content []byte, telemType string) (*ConnResult, error) {
+// Batching returns true if pilot control accepts several telemetry files in a single request
+func (r *PilotCtl) Batching() bool {
+	return r != nil && r.batch.get()
+}
+
+func (r *PilotCtl) SubmitTelemetry(ctx context.Context, channel string, content []byte, telemType string) (*ConnResult, error) {
 	uri := fmt.Sprintf("%s/%s/%s", r.cfg.BaseURI, telemType, channel)
-	req, err := http.NewRequest(http.MethodPost, uri, bytes.NewReader(content))
-	if err != nil {
-		return nil, err
-	}
-	// add an authentication token to the request
-	req.Header.Set("Authorization", newToken(r.host.HostUUID, r.host.HostIP, r.host.HostName))
-	resp, err := r.client.Do(req)
+	resp, err := r.send(ctx, uri, content, uploadTelemetry, func(req *http.Request) error {
+		// add an authentication token to the request
+		req.Header.Set("Authorization", newToken(r.host.HostUUID, r.host.HostIP, r.host.HostName))
+		// the signature covers the uncompressed content
+		return r.signRequestBytes(req, content)
+	})
 	if err != nil {
 		return nil, fmt.Errorf("cannot submit metrics data: %s", err)
 	}
 	if resp.StatusCode > 299 {
-		return nil, fmt.Errorf("cannot submit metrics data: %d, %s", resp.StatusCode, resp.Status)
+		return nil, &RequestError{StatusCode: resp.StatusCode, Status: resp.Status, Op: "submit metrics data"}
 	}
 	resultBytes, err := io.ReadAll(resp.Body)
 	if err != nil {
@@ -238,6 +429,35 @@ func (r *PilotCtl) SubmitTelemetry(channel string, content []byte, telemType str
 	return result, nil
 }
 
+// RequestError a request pilot control answered with an error status
+type RequestError struct {
+	StatusCode int
+	Status     string
+	// what the request did, e.g. submit metrics data
+	Op string
+}
+
+func (e *RequestError) Error() string {
+	return fmt.Sprintf("cannot %s: %d, %s", e.Op, e.StatusCode, e.Status)
+}
+
+// Rejected returns true if pilot control rejected the content of the request, so that sending it again cannot
+// succeed: a 4xx status other than authentication, unknown endpoint, timeout and rate limiting errors, which
+// depend on the host or pilot control rather than the content
+func (e *RequestError) Rejected() bool {
+	switch e.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound, http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return false
+	}
+	return e.StatusCode >= 400 && e.StatusCode < 500
+}
+
+// rejected returns true if err is a request whose content pilot control rejected
+func rejected(err error) bool {
+	var reqErr *RequestError
+	return errors.As(err, &reqErr) && reqErr.Rejected()
+}
+
 type ConnResult struct {
 	Error             string `json:"e"`
 	TotalEntries      int    `json:"t"`
@@ -0,0 +1,41 @@
+/*
+   Pilot Host Controller
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"net/http"
+	"net/http/httptest"
+	ctlCore "southwinds.dev/pilotctl/core"
+	ctl "southwinds.dev/pilotctl/types"
+	"testing"
+)
+
+// newTestPilotCtl returns a client of a test Pilot C'trol server answering requests with handler, the server is
+// closed when the test ends
+func newTestPilotCtl(t *testing.T, handler http.HandlerFunc) *PilotCtl {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	cfg := &ctlCore.ClientConf{BaseURI: srv.URL}
+	client, err := ctlCore.NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &PilotCtl{client: client, cfg: cfg, host: &ctl.HostInfo{}}
+}
@@ -19,114 +19,339 @@
 package core
 
 import (
+	"context"
 	"fmt"
-	"log"
-	"math"
+	"github.com/rs/zerolog"
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
+	"sync"
 	"time"
 )
 
+// the time a processor waits for a change notification before checking its channel folder anyway
+const processorIdleCheck = time.Minute
+
 type Processor struct {
 	path      string
 	api       *PilotCtl
 	telemType string
+	// where files that cannot be read or that pilot control rejects are moved to
+	quarantinePath string
+	// where events about failures are raised, no events are raised if nil
+	state *StateDir
+	quit  chan struct{}
+	// signals that new files were written to the channel folder
+	notify chan struct{}
+	// the health of the channel, see Health
+	mu       sync.Mutex
+	health   string
+	lastErr  string
+	restarts int
+	// the consecutive failures of the processor, reset when a batch is submitted
+	failures int
 }
 
-func NewProcessor(path string, api *PilotCtl, telemType string) (*Processor, error) {
+func NewProcessor(path string, api *PilotCtl, telemType string, state *StateDir) (*Processor, error) {
 	absPath, err := filepath.Abs(path)
 	if err != nil {
 		return nil, err
 	}
 	return &Processor{
-		path:      absPath,
-		api:       api,
-		telemType: telemType,
+		path:           absPath,
+		api:            api,
+		telemType:      telemType,
+		quarantinePath: filepath.Join(filepath.Dir(filepath.Dir(absPath)), telemQuarantineDir, telemType, filepath.Base(absPath)),
+		state:          state,
+		quit:           make(chan struct{}),
+		notify:         make(chan struct{}, 1),
+		health:         HealthPass,
 	}, nil
 }
 
+// Start processes the channel in a goroutine that is restarted with backoff if it fails, so that a faulty channel
+// does not affect the other channels or the rest of pilot
 func (p *Processor) Start() {
-	go p.run()
+	go p.supervise()
+}
+
+// Stop stops the processor after the batch being submitted, if any
+func (p *Processor) Stop() {
+	close(p.quit)
+}
+
+// Notify wakes up the processor if it is waiting for new files
+func (p *Processor) Notify() {
+	select {
+	case p.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Health returns the health of the channel: pass, warn if submissions are failing or fail if the processor failed
+// and is waiting to be restarted, the last error, and the number of times the processor was restarted
+func (p *Processor) Health() (string, string, int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.health, p.lastErr, p.restarts
+}
+
+func (p *Processor) setHealth(health string, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.health = health
+	p.lastErr = ""
+	if err != nil {
+		p.lastErr = err.Error()
+	}
+	if health == HealthPass {
+		p.failures = 0
+	}
+}
+
+// log returns the logger of the processor channel
+func (p *Processor) log() *zerolog.Logger {
+	l := logFor("telemetry").With().Str("type", p.telemType).Str("channel", filepath.Base(p.path)).Logger()
+	return &l
+}
+
+// wait pauses the processor, returning false if it was stopped in the meantime
+func (p *Processor) wait(d time.Duration) bool {
+	select {
+	case <-p.quit:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// idle waits until new files are written to the channel folder, returning false if the processor was stopped in
+// the meantime; the folder is checked periodically in case a notification was missed
+func (p *Processor) idle() bool {
+	select {
+	case <-p.quit:
+		return false
+	case <-p.notify:
+		return true
+	case <-time.After(processorIdleCheck):
+		return true
+	}
+}
+
+// supervise runs the processor until it is stopped, restarting it with backoff when it fails
+func (p *Processor) supervise() {
+	for {
+		err := p.safeRun()
+		if err == nil {
+			return
+		}
+		p.mu.Lock()
+		p.restarts++
+		p.failures++
+		waitTime := backoffTime(p.failures + 1)
+		p.mu.Unlock()
+		p.setHealth(HealthFail, err)
+		p.log().Error().Err(err).Msgf("%s channel failed, restarting it in %v", p.telemType, waitTime)
+		if p.state != nil {
+			raiseEvent(p.state, SevError, "telemetry", "%s channel '%s' failed, restarting it in %v: %s", p.telemType, filepath.Base(p.path), waitTime, err)
+		}
+		if !p.wait(waitTime) {
+			return
+		}
+	}
 }
 
-func (p *Processor) run() {
+// safeRun runs the processor, returning a panic as an error
+func (p *Processor) safeRun() (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("processor panic: %v", r)
+		}
+	}()
+	return p.run()
+}
+
+// run submits the files of the channel until the processor is stopped, returning nil, or fails
+func (p *Processor) run() error {
 	var count = 0
+	// the number of files to submit one at a time, to find which files of a rejected batch are faulty
+	isolate := 0
 	// working loop
 	for {
+		select {
+		case <-p.quit:
+			return nil
+		default:
+		}
 		files, err := getFiles(p.path)
 		if err != nil {
-			log.Fatalf("cannot read files in path '%s': %s", p.path, err)
+			return err
 		}
 		// if there are no files
 		if len(files) == 0 {
-			// sleeps a bit
-			time.Sleep(30 * time.Second)
+			// waits for new files
+			if !p.idle() {
+				return nil
+			}
 			// then restart the loop
 			continue
 		}
-		// picks the oldest file
-		file := filepath.Join(p.path, files[0].Name())
-		if err != nil {
-			log.Fatalf("cannot figure absolute path for '%s': %s", files[0].Name(), err)
+		// picks the oldest files, one at a time unless pilot control accepts batches
+		maxBytes := CurrentSettings().Telemetry.BatchBytes
+		if isolate > 0 || !p.api.Batching() {
+			maxBytes = 0
 		}
-		c, err := os.ReadFile(file)
+		batch, c, err := p.batch(files, maxBytes)
 		if err != nil {
-			log.Fatalf("cannot read file '%s': %s", files[0].Name(), err)
+			return err
+		}
+		if len(batch) == 0 {
+			// the files were removed or quarantined in the meantime
+			continue
+		}
+		ctx, span := startSpan(context.Background(), "telemetry.submit",
+			attrTelemType.String(p.telemType),
+			attrTelemChan.String(filepath.Base(p.path)),
+			attrTelemFiles.Int(len(batch)))
+		result, err := p.api.SubmitTelemetry(ctx, filepath.Base(p.path), c, p.telemType)
+		if err == nil && len(result.Error) > 0 {
+			endSpan(span, fmt.Errorf("%s", result.Error))
+		} else {
+			endSpan(span, err)
+		}
+		if rejected(err) {
+			if len(batch) > 1 {
+				// submits the files of the batch one at a time to find the faulty ones
+				p.log().Warn().Err(err).Msgf("%s batch rejected, submitting its files one at a time", p.telemType)
+				isolate = len(batch)
+				continue
+			}
+			if err = p.quarantine(batch[0], err); err != nil {
+				return err
+			}
+			if isolate > 0 {
+				isolate--
+			}
+			continue
 		}
-		result, err := p.api.SubmitTelemetry(filepath.Base(p.path), c, p.telemType)
 		if err != nil {
 			waitTime := backoffTime(count)
-			log.Printf("ERROR: cannot submit %s: %s; waiting %v...\n", p.telemType, err, waitTime)
+			p.setHealth(HealthWarn, err)
+			p.log().Error().Err(err).Msgf("cannot submit %s; waiting %v...", p.telemType, waitTime)
 			count++
-			time.Sleep(waitTime)
+			if !p.wait(waitTime) {
+				return nil
+			}
 		} else if len(result.Error) > 0 {
 			waitTime := backoffTime(count)
-			log.Printf("ERROR: cannot submit %s: %s; waiting %v...\n", p.telemType, result.Error, waitTime)
+			p.setHealth(HealthWarn, fmt.Errorf("%s", result.Error))
+			p.log().Error().Str("error", result.Error).Msgf("cannot submit %s; waiting %v...", p.telemType, waitTime)
 			count++
-			time.Sleep(waitTime)
+			if !p.wait(waitTime) {
+				return nil
+			}
 		} else {
 			count = 0
-			if err = os.Remove(file); err != nil {
-				log.Printf("ERROR: cannot delete %s file after submition: %s\n", p.telemType, err)
+			if isolate > 0 {
+				isolate--
+			}
+			p.setHealth(HealthPass, nil)
+			telemetrySubmitted.WithLabelValues(p.telemType, filepath.Base(p.path)).Add(float64(len(batch)))
+			for _, file := range batch {
+				// the file might have been discarded by the spool while it was uploaded
+				if err = os.Remove(file); err != nil && !os.IsNotExist(err) {
+					p.log().Error().Err(err).Msgf("cannot delete %s file after submition", p.telemType)
+				}
 			}
 		}
 	}
 }
 
-func getFiles(path string) ([]os.DirEntry, error) {
-	f, err := os.Open(path)
-	defer f.Close()
-	if err != nil {
-		fmt.Errorf("cannot open path: %s", err)
+// quarantine moves a faulty file out of the channel folder, so that the files after it can be submitted
+func (p *Processor) quarantine(file string, reason error) error {
+	if err := ensureDir(p.quarantinePath); err != nil {
+		return fmt.Errorf("cannot create telemetry quarantine folder: %s", err)
+	}
+	if err := os.Rename(file, filepath.Join(p.quarantinePath, filepath.Base(file))); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("cannot quarantine telemetry file %s: %s", filepath.Base(file), err)
+	}
+	telemetryQuarantined.WithLabelValues(p.telemType, filepath.Base(p.path)).Inc()
+	p.log().Warn().Err(reason).Str("file", filepath.Base(file)).Msgf("%s file quarantined in %s", p.telemType, p.quarantinePath)
+	if p.state != nil {
+		raiseEvent(p.state, SevWarning, "telemetry", "%s file %s of channel '%s' quarantined in %s: %s", p.telemType, filepath.Base(file), filepath.Base(p.path), p.quarantinePath, reason)
+	}
+	return nil
+}
+
+// Quarantined returns the number of files of the channel in quarantine
+func (p *Processor) Quarantined() int {
+	return countFiles(p.quarantinePath, "")
+}
+
+// batch reads the oldest files in the channel folder, up to maxBytes in total, and returns their paths and content
+// the content of each file is terminated by a new line, so that the entries of several files can be sent in a
+// single request; a file larger than maxBytes is sent on its own
+// files that cannot be read are quarantined
+func (p *Processor) batch(files []os.DirEntry, maxBytes int) ([]string, []byte, error) {
+	var (
+		paths   []string
+		content []byte
+	)
+	for _, f := range files {
+		file := filepath.Join(p.path, f.Name())
+		c, err := os.ReadFile(file)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			// an unreadable file is quarantined, so that it does not block the channel
+			if err = p.quarantine(file, fmt.Errorf("cannot read file: %s", err)); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		if len(c) > 0 && c[len(c)-1] != '\n' {
+			c = append(c, '\n')
+		}
+		if len(paths) > 0 && len(content)+len(c) > maxBytes {
+			break
+		}
+		paths = append(paths, file)
+		content = append(content, c...)
 	}
-	dirs, err := f.ReadDir(-1)
+	return paths, content, nil
+}
+
+// getFiles returns the files in a channel folder ordered by modification time, oldest first
+// hidden files, being written, and folders are ignored
+func getFiles(path string) ([]os.DirEntry, error) {
+	entries, err := os.ReadDir(path)
 	if err != nil {
-		fmt.Errorf("cannot read path: %s", err)
+		return nil, fmt.Errorf("cannot read channel folder: %s", err)
 	}
-	// filter hidden files
-	var files []os.DirEntry
-	for _, dir := range dirs {
-		ff, _ := dir.Info()
-		if ff.Name()[0] != '.' {
-			files = append(files, dir)
+	var (
+		files    []os.DirEntry
+		modTimes = map[string]time.Time{}
+	)
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
 		}
+		info, err := entry.Info()
+		if err != nil {
+			// the file was removed in the meantime
+			continue
+		}
+		files = append(files, entry)
+		modTimes[entry.Name()] = info.ModTime()
 	}
 	// sort the directory entries by modification time
 	sort.SliceStable(files, func(i, j int) bool {
-		iInfo, _ := files[i].Info()
-		jInfo, _ := files[j].Info()
-		return iInfo.ModTime().Before(jInfo.ModTime())
+		return modTimes[files[i].Name()].Before(modTimes[files[j].Name()])
 	})
-	return files, err
-}
-
-// backoffTime exponentially increase backoff time until reaching 1 hour
-func backoffTime(attempts int) time.Duration {
-	var exponentialBackoffCeilingSecs int64 = 3600 // 1 hour
-	delaySecs := int64(math.Floor((math.Pow(2, float64(attempts)) - 1) * 0.5))
-	if delaySecs > exponentialBackoffCeilingSecs {
-		delaySecs = exponentialBackoffCeilingSecs
-	}
-	return time.Duration(delaySecs) * time.Second
+	return files, nil
 }
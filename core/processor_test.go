@@ -19,19 +19,195 @@
 package core
 
 import (
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestProcessor(t *testing.T) {
-	c, err := NewPilotCtl(nil, PilotOptions{
-		Tracing: false,
-	})
+	c, err := NewPilotCtl(nil, PilotOptions{})
 	if err != nil {
 		t.Fatalf(err.Error())
 	}
-	p, err := NewTelemCtl()
+	p, err := NewTelemCtl(nil)
 	if err != nil {
 		t.Fatalf(err.Error())
 	}
 	p.Start(c)
 }
+
+func TestProcessorBatch(t *testing.T) {
+	dir := t.TempDir()
+	for i, content := range []string{"a1\na2", "b1\n", "c1\n"} {
+		file := filepath.Join(dir, string(rune('a'+i))+".log")
+		_ = os.WriteFile(file, []byte(content), filePerm)
+		// getFiles orders files by modification time
+		_ = os.Chtimes(file, time.Now(), time.Now().Add(time.Duration(i)*time.Second))
+	}
+	p, _ := NewProcessor(dir, nil, "logs", nil)
+	files, err := getFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch, content, err := p.batch(files, 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batch) != 2 || string(content) != "a1\na2\nb1\n" {
+		t.Fatalf("unexpected batch %v: %q", batch, content)
+	}
+	// a file larger than the limit is sent on its own
+	batch, _, _ = p.batch(files, 1)
+	if len(batch) != 1 {
+		t.Fatalf("expected a single file batch, got %v", batch)
+	}
+}
+
+func TestTelemCtlChannels(t *testing.T) {
+	s := DefaultSettings()
+	s.Paths.Telemetry = t.TempDir()
+	SetSettings(s)
+	defer SetSettings(DefaultSettings())
+	_ = os.MkdirAll(filepath.Join(s.Paths.Telemetry, "metrics", "app"), dirPerm)
+	c, err := NewTelemCtl(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = c.Start(nil)
+	defer c.Stop()
+	channels := func() string {
+		var names []string
+		for _, ch := range c.Backlog() {
+			names = append(names, ch.Type+"/"+ch.Channel)
+		}
+		return strings.Join(names, ",")
+	}
+	waitFor := func(expected string) {
+		for i := 0; i < 50 && channels() != expected; i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+		if channels() != expected {
+			t.Fatalf("expected channels %s, got %s", expected, channels())
+		}
+	}
+	waitFor("metrics/app")
+	// a channel created after start is picked up
+	_ = os.MkdirAll(filepath.Join(s.Paths.Telemetry, "logs", "web"), dirPerm)
+	waitFor("logs/web,metrics/app")
+	// a removed channel is stopped
+	_ = os.RemoveAll(filepath.Join(s.Paths.Telemetry, "metrics", "app"))
+	waitFor("logs/web")
+}
+
+func TestProcessorQuarantine(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		received []string
+	)
+	api := newTestPilotCtl(t, func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		// pilot control rejects batches with a faulty entry
+		if strings.Contains(string(body), "bad") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		received = append(received, strings.TrimSpace(string(body)))
+		mu.Unlock()
+		_, _ = w.Write([]byte(`{"t":1,"s":1}`))
+	})
+	dir := t.TempDir()
+	channel := filepath.Join(dir, "logs", "app")
+	_ = os.MkdirAll(channel, dirPerm)
+	for i, content := range []string{"good1", "bad", "good2"} {
+		file := filepath.Join(channel, content+".log")
+		_ = os.WriteFile(file, []byte(content), filePerm)
+		_ = os.Chtimes(file, time.Now(), time.Now().Add(time.Duration(i)*time.Second))
+	}
+	state := NewStateDir(dir)
+	_ = ensureDir(state.Submit(""))
+	p, _ := NewProcessor(channel, api, "logs", state)
+	p.Start()
+	defer p.Stop()
+	for i := 0; i < 50; i++ {
+		if files, _ := getFiles(channel); len(files) == 0 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	mu.Lock()
+	got := strings.Join(received, ",")
+	mu.Unlock()
+	if got != "good1,good2" {
+		t.Fatalf("unexpected submissions %q", got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "quarantine", "logs", "app", "bad.log")); err != nil {
+		t.Fatalf("faulty file not quarantined: %s", err)
+	}
+	if health, _, _ := p.Health(); health != HealthPass || p.Quarantined() != 1 {
+		t.Fatalf("unexpected health %s with %d quarantined files", health, p.Quarantined())
+	}
+	if events := countFiles(state.Submit(""), ".ev"); events != 1 {
+		t.Fatalf("expected a quarantine event, got %d", events)
+	}
+	// a channel that cannot be read fails and is restarted
+	_ = os.RemoveAll(channel)
+	p.Notify()
+	for i := 0; i < 50; i++ {
+		if health, _, _ := p.Health(); health == HealthFail {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if health, lastErr, restarts := p.Health(); health != HealthFail || restarts == 0 || len(lastErr) == 0 {
+		t.Fatalf("expected a failed channel, got %s after %d restarts", health, restarts)
+	}
+}
+
+func TestProcessorBatchNegotiation(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests int
+	)
+	api := newTestPilotCtl(t, func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		requests++
+		mu.Unlock()
+		_, _ = w.Write([]byte(`{"t":1,"s":1}`))
+	})
+	submit := func(batch string) int {
+		mu.Lock()
+		requests = 0
+		mu.Unlock()
+		api.batch.set(&http.Response{Header: http.Header{batchHeader: []string{batch}}})
+		channel := filepath.Join(t.TempDir(), "logs", "app")
+		_ = os.MkdirAll(channel, dirPerm)
+		for _, name := range []string{"a", "b", "c"} {
+			_ = os.WriteFile(filepath.Join(channel, name+".log"), []byte(name), filePerm)
+		}
+		p, _ := NewProcessor(channel, api, "logs", nil)
+		p.Start()
+		defer p.Stop()
+		for i := 0; i < 50; i++ {
+			if files, _ := getFiles(channel); len(files) == 0 {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		return requests
+	}
+	// control planes that do not negotiate batching receive one file per request
+	if n := submit(""); n != 3 {
+		t.Fatalf("expected 3 requests without batching, got %d", n)
+	}
+	if n := submit(BatchNewline); n != 1 {
+		t.Fatalf("expected 1 request with batching, got %d", n)
+	}
+}
@@ -0,0 +1,206 @@
+/*
+   Pilot Host Controller
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/radovskyb/watcher"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// withReloadable returns a copy of the current settings updated with the loaded values that can change
+// without restarting pilot; any other value requires a restart to take effect
+// the spool eviction policy is reloaded with the telemetry settings; pilot has no policy or window files of its own
+func withReloadable(current, loaded *Settings) *Settings {
+	s := *current
+	s.Log.Level = loaded.Log.Level
+	s.Log.Debug = loaded.Log.Debug
+	s.TLS.Proxy = loaded.TLS.Proxy
+	s.Telemetry = loaded.Telemetry
+	s.Paths.Telemetry = loaded.Paths.Telemetry
+	s.Paths.CVE = loaded.Paths.CVE
+	s.Intervals = loaded.Intervals
+	s.Limits.MaxRetryInterval = loaded.Limits.MaxRetryInterval
+	s.Compression = loaded.Compression
+	s.file = loaded.file
+	return &s
+}
+
+// watchConfig reloads the configuration when pilot receives SIGHUP or, if reload.watch is set, when the
+// configuration file changes
+func (p *Pilot) watchConfig() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			InfoLogger.Printf("SIGHUP received, reloading configuration\n")
+			p.reload()
+		}
+	}()
+	file := CurrentSettings().File()
+	if !CurrentSettings().Reload.Watch || len(file) == 0 {
+		return
+	}
+	w := watcher.New()
+	w.SetMaxEvents(1)
+	w.FilterOps(watcher.Write, watcher.Create)
+	if err := w.Add(filepath.Dir(file)); err != nil {
+		WarningLogger.Printf("cannot watch configuration file: %s\n", err)
+		return
+	}
+	go func() {
+		for {
+			select {
+			case event := <-w.Event:
+				if event.Path == file {
+					InfoLogger.Printf("configuration file changed, reloading configuration\n")
+					p.reload()
+				}
+			case err := <-w.Error:
+				WarningLogger.Printf("configuration file watch: %s\n", err)
+			case <-w.Closed:
+				return
+			}
+		}
+	}()
+	go func() {
+		if err := w.Start(10 * time.Second); err != nil {
+			WarningLogger.Printf("cannot watch configuration file: %s\n", err)
+		}
+	}()
+}
+
+// reload loads and validates the configuration and applies the values that can change at runtime
+// if the configuration is not valid, the current configuration is kept
+func (p *Pilot) reload() {
+	p.reloadMu.Lock()
+	defer p.reloadMu.Unlock()
+	load := p.options.LoadSettings
+	if load == nil {
+		load = func() (*Settings, error) {
+			s, err := LoadSettings(CurrentSettings().File())
+			if err != nil {
+				return nil, err
+			}
+			return s, s.Validate()
+		}
+	}
+	loaded, err := load()
+	if err != nil {
+		ErrorLogger.Printf("configuration reload failed, keeping the current configuration: %s\n", err)
+		raiseEvent(p.state, SevWarning, "config", "configuration reload failed, keeping the current configuration: %s", err)
+		return
+	}
+	current := CurrentSettings()
+	next := withReloadable(current, loaded)
+	changes := settingsDiff(current, next)
+	pending := settingsDiff(next, loaded)
+	if len(pending) > 0 {
+		WarningLogger.Printf("restart pilot to apply: %s\n", strings.Join(pending, ", "))
+	}
+	if len(changes) == 0 {
+		InfoLogger.Printf("configuration reloaded, no changes to apply\n")
+		return
+	}
+	SetSettings(next)
+	if next.Log.Level != current.Log.Level || next.Log.Debug != current.Log.Debug {
+		setLogLevel(next.Log.Level, next.Log.Debug)
+	}
+	if !reflect.DeepEqual(next.Telemetry, current.Telemetry) || next.Paths.Telemetry != current.Paths.Telemetry {
+		p.restartTelemetry(next)
+	}
+	if next.Paths.CVE != current.Paths.CVE || next.Intervals.CVEUploadDelay != current.Intervals.CVEUploadDelay {
+		p.restartCVEExporter(next)
+	}
+	InfoLogger.Printf("configuration reloaded: %s\n", strings.Join(changes, ", "))
+	msg := fmt.Sprintf("configuration reloaded: %s", strings.Join(changes, ", "))
+	if len(pending) > 0 {
+		msg = fmt.Sprintf("%s; restart required for: %s", msg, strings.Join(pending, ", "))
+	}
+	raiseEvent(p.state, SevNotice, "config", "%s", msg)
+}
+
+func (p *Pilot) restartTelemetry(s *Settings) {
+	if p.telem != nil {
+		p.telem.Stop()
+		p.telem = nil
+	}
+	if !s.Telemetry.Enabled {
+		InfoLogger.Printf("telemetry loop has been disabled\n")
+		return
+	}
+	collector, err := NewTelemCtl(p.state)
+	if err != nil {
+		ErrorLogger.Printf("cannot restart pilot telemetry loop: %s\n", err)
+		return
+	}
+	collector.Start(p.ctl)
+	p.telem = collector
+}
+
+func (p *Pilot) restartCVEExporter(s *Settings) {
+	if p.cveExporter != nil {
+		p.cveExporter.Close()
+		p.cveExporter = nil
+	}
+	if len(s.Paths.CVE) == 0 {
+		InfoLogger.Printf("CVE exporter has been disabled\n")
+		return
+	}
+	exporter := NewCVEExporter(p.ctl, s.Paths.CVE, p.state)
+	if err := exporter.Start(int(s.Intervals.CVEUploadDelay.Duration() / time.Minute)); err != nil {
+		ErrorLogger.Printf("cannot restart CVE exporter: %s\n", err)
+		return
+	}
+	p.cveExporter = exporter
+}
+
+// settingsDiff describes the values that differ between two settings, e.g. log.level: info -> debug
+func settingsDiff(a, b *Settings) []string {
+	fa, fb := flattenSettings(a), flattenSettings(b)
+	var diff []string
+	for key, va := range fa {
+		if vb := fb[key]; va != vb {
+			diff = append(diff, fmt.Sprintf("%s: %s -> %s", key, va, vb))
+		}
+	}
+	sort.Strings(diff)
+	return diff
+}
+
+func flattenSettings(s *Settings) map[string]string {
+	var sections map[string]map[string]interface{}
+	b, _ := json.Marshal(s)
+	_ = json.Unmarshal(b, &sections)
+	flat := make(map[string]string)
+	for section, values := range sections {
+		for key, value := range values {
+			flat[fmt.Sprintf("%s.%s", section, key)] = fmt.Sprintf("%v", value)
+		}
+	}
+	return flat
+}
@@ -0,0 +1,43 @@
+/*
+   Pilot Host Controller
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestWithReloadable(t *testing.T) {
+	current := DefaultSettings()
+	loaded := DefaultSettings()
+	loaded.Log.Level = "debug"
+	loaded.TLS.Proxy = "http://proxy:3128"
+	loaded.Syslog.Port = 2514
+	next := withReloadable(current, loaded)
+	changes := settingsDiff(current, next)
+	expected := []string{"log.level: info -> debug", "tls.proxy:  -> http://proxy:3128"}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Fatalf("expected %v, got %v", expected, changes)
+	}
+	// the syslog port can only change on restart
+	pending := settingsDiff(next, loaded)
+	if len(pending) != 1 || pending[0] != "syslog.port: 1514 -> 2514" {
+		t.Fatalf("unexpected pending changes %v", pending)
+	}
+}
@@ -0,0 +1,145 @@
+/*
+   Pilot Host Controller
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"os"
+	ctl "southwinds.dev/pilotctl/types"
+	"strings"
+	"sync"
+)
+
+// encryptedPrefix marks a command value encrypted by pilot control with the host public key
+// the rest of the value is the base64 encoded, armored PGP message
+const encryptedPrefix = "pgp:"
+
+// atRestPrefix marks a file under the data folder encrypted with the host-bound data key
+var atRestPrefix = []byte("PILOT1:")
+
+var (
+	dataKeyOnce sync.Once
+	dataKeyErr  error
+	dataKeyVal  []byte
+)
+
+// openValue decrypts a command value if it was encrypted by pilot control, otherwise returns it as is
+func openValue(value string) (string, error) {
+	if !strings.HasPrefix(value, encryptedPrefix) {
+		return value, nil
+	}
+	if HK == nil {
+		return "", fmt.Errorf("cannot decrypt value: host key not loaded")
+	}
+	armored, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, encryptedPrefix))
+	if err != nil {
+		return "", fmt.Errorf("cannot decode encrypted value: %s", err)
+	}
+	plain, err := HK.Decrypt(armored)
+	if err != nil {
+		return "", fmt.Errorf("cannot decrypt value: %s", err)
+	}
+	return string(plain), nil
+}
+
+// openCmd returns a copy of the command with decrypted registry credentials
+// it must only be called just before execution and the result never persisted
+func openCmd(cmd ctl.CmdInfo) (ctl.CmdInfo, error) {
+	var err error
+	if cmd.User, err = openValue(cmd.User); err != nil {
+		return cmd, fmt.Errorf("registry user: %s", err)
+	}
+	if cmd.Pwd, err = openValue(cmd.Pwd); err != nil {
+		return cmd, fmt.Errorf("registry password: %s", err)
+	}
+	return cmd, nil
+}
+
+// openEnv decrypts the values of NAME=VALUE environment entries encrypted by pilot control
+func openEnv(env []string) ([]string, error) {
+	result := make([]string, 0, len(env))
+	for _, entry := range env {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) == 2 && strings.HasPrefix(parts[1], encryptedPrefix) {
+			value, err := openValue(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("variable %s: %s", parts[0], err)
+			}
+			entry = fmt.Sprintf("%s=%s", parts[0], value)
+		}
+		result = append(result, entry)
+	}
+	return result, nil
+}
+
+// dataKey returns the key used to encrypt files under the data folder
+// it is bound to the host, i.e. derived from the host signing key and the host UUID, so files copied
+// to another host cannot be read
+func dataKey() ([]byte, error) {
+	dataKeyOnce.Do(func() {
+		if HK == nil || A == nil {
+			dataKeyErr = fmt.Errorf("host is not activated")
+			return
+		}
+		keyBytes, err := os.ReadFile(HostKeyFile())
+		if err != nil {
+			dataKeyErr = fmt.Errorf("cannot read host key: %s", err)
+			return
+		}
+		sum := sha256.Sum256(append(append([]byte("pilot data key|"), keyBytes...), []byte(A.HostUUID)...))
+		dataKeyVal = sum[:]
+	})
+	return dataKeyVal, dataKeyErr
+}
+
+// sealData encrypts content to be written under the data folder
+// content is never written unencrypted, so it fails if the data key is not available
+func sealData(plain []byte) ([]byte, error) {
+	key, err := dataKey()
+	if err != nil {
+		return nil, fmt.Errorf("cannot encrypt data: %s", err)
+	}
+	c := AesCrypto{CipherMode: GCM}
+	sealed, err := c.Encrypt(string(plain), key)
+	if err != nil {
+		return nil, fmt.Errorf("cannot encrypt data: %s", err)
+	}
+	return append(append([]byte{}, atRestPrefix...), []byte(sealed)...), nil
+}
+
+// openData decrypts content read from the data folder
+// unencrypted content, e.g. written by a previous pilot version, is returned as is
+func openData(content []byte) ([]byte, error) {
+	if !bytes.HasPrefix(content, atRestPrefix) {
+		return content, nil
+	}
+	key, err := dataKey()
+	if err != nil {
+		return nil, fmt.Errorf("cannot decrypt data: %s", err)
+	}
+	c := AesCrypto{CipherMode: GCM}
+	plain, err := c.Decrypt(string(content[len(atRestPrefix):]), key)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decrypt data: %s", err)
+	}
+	return []byte(plain), nil
+}
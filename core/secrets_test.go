@@ -0,0 +1,83 @@
+/*
+   Pilot Host Controller
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"testing"
+)
+
+// useTestDataKey makes a data key available to tests running on a host that is not activated
+func useTestDataKey() {
+	dataKeyOnce.Do(func() {})
+	dataKeyVal, dataKeyErr = bytes.Repeat([]byte{7}, 32), nil
+}
+
+func TestSealData(t *testing.T) {
+	useTestDataKey()
+	sealed, err := sealData([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(sealed, atRestPrefix) || bytes.Contains(sealed, []byte("secret")) {
+		t.Fatalf("data not sealed: %s", sealed)
+	}
+	plain, err := openData(sealed)
+	if err != nil || string(plain) != "secret" {
+		t.Fatalf("cannot open sealed data: %v", err)
+	}
+	// truncated or corrupted files return an error instead of panicking
+	for _, corrupted := range [][]byte{
+		sealed[:len(atRestPrefix)],
+		sealed[:len(atRestPrefix)+4],
+		append(append([]byte{}, atRestPrefix...), base64.StdEncoding.EncodeToString([]byte{12})...),
+		append(append([]byte{}, atRestPrefix...), base64.StdEncoding.EncodeToString([]byte{200, 16, 1, 2})...),
+		append(append([]byte{}, atRestPrefix...), base64.StdEncoding.EncodeToString([]byte{4, 16, 1, 2, 3, 4, 5})...),
+	} {
+		if _, err = openData(corrupted); err == nil {
+			t.Fatalf("corrupted data %q opened", corrupted)
+		}
+	}
+}
+
+func TestSealDataWithoutKey(t *testing.T) {
+	useTestDataKey()
+	defer useTestDataKey()
+	dataKeyVal, dataKeyErr = nil, os.ErrNotExist
+	// content is never written unencrypted
+	if sealed, err := sealData([]byte("secret")); err == nil || sealed != nil {
+		t.Fatal("data sealed without a key")
+	}
+}
+
+func TestPeekCorruptedJobResult(t *testing.T) {
+	useTestDataKey()
+	state := NewStateDir(t.TempDir())
+	_ = ensureDir(state.Submit(""))
+	_ = os.WriteFile(state.Submit("job_1.result"), append(append([]byte{}, atRestPrefix...), "AQ=="...), filePerm)
+	result, err := peekJobResult(state)
+	if err != nil || result != nil {
+		t.Fatalf("unexpected result %v: %v", result, err)
+	}
+	if countFiles(state.Quarantine(""), "") != 1 || countFiles(state.Submit(""), ".ev") != 1 {
+		t.Fatal("corrupted job result not quarantined")
+	}
+}
@@ -0,0 +1,728 @@
+/*
+   Pilot Host Controller
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/rs/zerolog"
+	"gopkg.in/yaml.v3"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Settings the typed pilot configuration
+// values are resolved in the following order, each source overriding the previous one:
+//  1. built-in defaults
+//  2. the configuration file: the file in PILOT_CONFIG (or --config) if set, otherwise the first of
+//     pilot.yaml, pilot.yml or pilot.toml found in the configuration path (PILOT_CFG_PATH or the current folder)
+//  3. environment variables
+//  4. flags passed to the launch command
+type Settings struct {
+	Log         LogSettings         `yaml:"log" toml:"log" json:"log"`
+	Identity    IdentitySettings    `yaml:"identity" toml:"identity" json:"identity"`
+	Paths       PathSettings        `yaml:"paths" toml:"paths" json:"paths"`
+	Intervals   IntervalSettings    `yaml:"intervals" toml:"intervals" json:"intervals"`
+	Limits      LimitSettings       `yaml:"limits" toml:"limits" json:"limits"`
+	TLS         TLSSettings         `yaml:"tls" toml:"tls" json:"tls"`
+	Telemetry   TelemetrySettings   `yaml:"telemetry" toml:"telemetry" json:"telemetry"`
+	Syslog      SyslogSettings      `yaml:"syslog" toml:"syslog" json:"syslog"`
+	Reload      ReloadSettings      `yaml:"reload" toml:"reload" json:"reload"`
+	Metrics     MetricsSettings     `yaml:"metrics" toml:"metrics" json:"metrics"`
+	Tracing     TracingSettings     `yaml:"tracing" toml:"tracing" json:"tracing"`
+	Compression CompressionSettings `yaml:"compression" toml:"compression" json:"compression"`
+	// the configuration file the settings were loaded from, if any
+	file string
+}
+
+type LogSettings struct {
+	Level string `yaml:"level" toml:"level" json:"level"`
+	Debug bool   `yaml:"debug" toml:"debug" json:"debug"`
+	// the output format: text or json
+	Format string `yaml:"format" toml:"format" json:"format"`
+	// if set, logs are written to this file instead of stdout and stderr
+	File string `yaml:"file" toml:"file" json:"file"`
+	// the number of days rotated log files are kept
+	MaxDays int `yaml:"max_days" toml:"max_days" json:"max_days"`
+}
+
+type CompressionSettings struct {
+	// offers pilot control to compress telemetry, CVE report and job result uploads
+	Enabled bool `yaml:"enabled" toml:"enabled" json:"enabled"`
+	// bodies smaller than this are uploaded uncompressed
+	MinBytes int `yaml:"min_bytes" toml:"min_bytes" json:"min_bytes"`
+}
+
+type IdentitySettings struct {
+	// use the hardware uuid to identify the device instead of the primary mac address
+	UseHwId bool `yaml:"use_hw_id" toml:"use_hw_id" json:"use_hw_id"`
+}
+
+type PathSettings struct {
+	// the pilot home folder, where the data folder is located
+	Home string `yaml:"home" toml:"home" json:"home"`
+	// the folder telemetry data is read from
+	Telemetry string `yaml:"telemetry" toml:"telemetry" json:"telemetry"`
+	// if set, CVE reports in this folder are uploaded to pilot control
+	CVE         string `yaml:"cve" toml:"cve" json:"cve"`
+	TrustAnchor string `yaml:"trust_anchor" toml:"trust_anchor" json:"trust_anchor"`
+	TenantKey   string `yaml:"tenant_key" toml:"tenant_key" json:"tenant_key"`
+	LegacyKey   string `yaml:"legacy_key" toml:"legacy_key" json:"legacy_key"`
+	// the unix socket of the local status API, pilot.sock in the state folder by default
+	Socket string `yaml:"socket" toml:"socket" json:"socket"`
+}
+
+type IntervalSettings struct {
+	// the ping interval used until pilot control sets one
+	Ping Duration `yaml:"ping" toml:"ping" json:"ping"`
+	// how often pilot checks for a verification key rotation
+	KeyRefresh Duration `yaml:"key_refresh" toml:"key_refresh" json:"key_refresh"`
+	// the maximum random delay applied before uploading a CVE report
+	CVEUploadDelay Duration `yaml:"cve_upload_delay" toml:"cve_upload_delay" json:"cve_upload_delay"`
+}
+
+type LimitSettings struct {
+	// the timeout of requests to pilot control
+	RequestTimeout Duration `yaml:"request_timeout" toml:"request_timeout" json:"request_timeout"`
+	// the timeout of activation key requests
+	ActivationTimeout Duration `yaml:"activation_timeout" toml:"activation_timeout" json:"activation_timeout"`
+	// the maximum wait between retries of a failed registration or activation
+	MaxRetryInterval Duration `yaml:"max_retry_interval" toml:"max_retry_interval" json:"max_retry_interval"`
+}
+
+type TLSSettings struct {
+	// if true, certificates presented by the server are not verified; TLS is then susceptible to machine-in-the-middle attacks
+	InsecureSkipVerify bool `yaml:"insecure_skip_verify" toml:"insecure_skip_verify" json:"insecure_skip_verify"`
+	// the URL of the http proxy used to connect to pilot control
+	Proxy string `yaml:"proxy" toml:"proxy" json:"proxy"`
+}
+
+type TelemetrySettings struct {
+	// enables the upload of telemetry information to pilot control
+	Enabled bool `yaml:"enabled" toml:"enabled" json:"enabled"`
+	// the maximum size of the files of a channel sent to pilot control in a single request
+	BatchBytes  int                 `yaml:"batch_bytes" toml:"batch_bytes" json:"batch_bytes"`
+	HostMetrics HostMetricsSettings `yaml:"host_metrics" toml:"host_metrics" json:"host_metrics"`
+	OTLP        OTLPSettings        `yaml:"otlp" toml:"otlp" json:"otlp"`
+	Spool       SpoolSettings       `yaml:"spool" toml:"spool" json:"spool"`
+	// the log files followed and written to logs channels
+	Tail    []TailSettings  `yaml:"tail" toml:"tail" json:"tail"`
+	Journal JournalSettings `yaml:"journal" toml:"journal" json:"journal"`
+}
+
+type JournalSettings struct {
+	// follows the systemd journal, if telemetry is enabled
+	Enabled bool `yaml:"enabled" toml:"enabled" json:"enabled"`
+	// what journal entries are converted to: logs, written to a logs channel, or events, sent to pilot control
+	// with the next ping
+	Output string `yaml:"output" toml:"output" json:"output"`
+	// the logs channel entries are written to
+	Channel string `yaml:"channel" toml:"channel" json:"channel"`
+	// only reads the entries of these systemd units, all units if empty
+	Units []string `yaml:"units" toml:"units" json:"units"`
+	// only reads the entries of this priority or higher: emerg, alert, crit, err, warning, notice, info or debug
+	Priority string `yaml:"priority" toml:"priority" json:"priority"`
+	// journalctl match expressions, FIELD=value or + to combine matches with OR
+	Matches []string `yaml:"matches" toml:"matches" json:"matches"`
+	// reads the journal files in this folder instead of the system journal
+	Directory string `yaml:"directory" toml:"directory" json:"directory"`
+	// the number of journal events waiting to be sent to pilot control above which pilot stops reading the journal
+	MaxEvents int `yaml:"max_events" toml:"max_events" json:"max_events"`
+}
+
+type TailSettings struct {
+	// the log files to follow, paths or glob patterns
+	Paths []string `yaml:"paths" toml:"paths" json:"paths"`
+	// the logs channel the entries are written to
+	Channel string `yaml:"channel" toml:"channel" json:"channel"`
+	// a regular expression matching the first line of an entry, following lines not matching it are part of the
+	// same entry; if empty every line is an entry
+	Multiline string `yaml:"multiline" toml:"multiline" json:"multiline"`
+	// reads files found when pilot starts without a checkpoint from the start, instead of only new entries
+	FromStart bool `yaml:"from_start" toml:"from_start" json:"from_start"`
+}
+
+type SpoolSettings struct {
+	// the maximum size of all telemetry files waiting to be uploaded, 0 for no limit
+	MaxBytes int64 `yaml:"max_bytes" toml:"max_bytes" json:"max_bytes"`
+	// the maximum size of the telemetry files waiting to be uploaded in a single channel, 0 for no limit
+	ChannelMaxBytes int64 `yaml:"channel_max_bytes" toml:"channel_max_bytes" json:"channel_max_bytes"`
+	// telemetry files older than this are discarded, 0 to keep them until they are uploaded
+	MaxAge Duration `yaml:"max_age" toml:"max_age" json:"max_age"`
+	// what to do when a size quota is exceeded: drop-oldest, drop-newest or stop-producers
+	Policy string `yaml:"policy" toml:"policy" json:"policy"`
+}
+
+type HostMetricsSettings struct {
+	// samples host metrics and writes them to a metrics channel, if telemetry is enabled
+	Enabled bool `yaml:"enabled" toml:"enabled" json:"enabled"`
+	// how often host metrics are sampled
+	Interval Duration `yaml:"interval" toml:"interval" json:"interval"`
+	// the metrics channel host metrics are written to
+	Channel string `yaml:"channel" toml:"channel" json:"channel"`
+}
+
+type SyslogSettings struct {
+	Port int `yaml:"port" toml:"port" json:"port"`
+}
+
+type ReloadSettings struct {
+	// reloads the configuration when the configuration file changes, in addition to SIGHUP
+	Watch bool `yaml:"watch" toml:"watch" json:"watch"`
+}
+
+type MetricsSettings struct {
+	// serves prometheus metrics about pilot itself at /metrics
+	Enabled bool `yaml:"enabled" toml:"enabled" json:"enabled"`
+	// the address the metrics listener binds to
+	Address string `yaml:"address" toml:"address" json:"address"`
+}
+
+type TracingSettings struct {
+	// where spans are exported: none, otlp or file
+	Exporter string `yaml:"exporter" toml:"exporter" json:"exporter"`
+	// the host:port of the OpenTelemetry collector receiving spans over OTLP/HTTP
+	Endpoint string `yaml:"endpoint" toml:"endpoint" json:"endpoint"`
+	// sends spans to the collector over plain HTTP, usually for a collector running on the host
+	Insecure bool `yaml:"insecure" toml:"insecure" json:"insecure"`
+	// the file the file exporter writes spans to, spans.json in the trace folder by default
+	File string `yaml:"file" toml:"file" json:"file"`
+}
+
+type OTLPSettings struct {
+	// receives metrics and logs pushed by local applications using OTLP, if telemetry is enabled
+	Enabled bool `yaml:"enabled" toml:"enabled" json:"enabled"`
+	// the loopback address of the OTLP/HTTP listener
+	HTTPAddress string `yaml:"http_address" toml:"http_address" json:"http_address"`
+	// the loopback address of the OTLP/gRPC listener, gRPC is disabled if empty
+	GRPCAddress string `yaml:"grpc_address" toml:"grpc_address" json:"grpc_address"`
+	// the metrics and logs channel received telemetry is written to
+	Channel string `yaml:"channel" toml:"channel" json:"channel"`
+}
+
+// Duration a time.Duration written as a string in configuration files, e.g. 15s or 6h
+type Duration time.Duration
+
+func (d Duration) Duration() time.Duration {
+	return time.Duration(d)
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return fmt.Errorf("invalid duration '%s', use a value such as 30s, 5m or 6h", text)
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// configFileNames the names of the configuration files pilot looks for, in order of precedence
+var configFileNames = []string{"pilot.yaml", "pilot.yml", "pilot.toml"}
+
+// DefaultSettings returns the built-in defaults
+func DefaultSettings() *Settings {
+	return &Settings{
+		Log: LogSettings{
+			Level:   "info",
+			Format:  LogFormatText,
+			MaxDays: 7,
+		},
+		Paths: PathSettings{
+			Telemetry: "telemetry",
+		},
+		Intervals: IntervalSettings{
+			Ping:           Duration(15 * time.Second),
+			KeyRefresh:     Duration(6 * time.Hour),
+			CVEUploadDelay: Duration(5 * time.Minute),
+		},
+		Limits: LimitSettings{
+			RequestTimeout:    Duration(5 * time.Minute),
+			ActivationTimeout: Duration(60 * time.Second),
+			MaxRetryInterval:  Duration(time.Hour),
+		},
+		Telemetry: TelemetrySettings{
+			BatchBytes: 1 << 20,
+			HostMetrics: HostMetricsSettings{
+				Interval: Duration(time.Minute),
+				Channel:  "host",
+			},
+			OTLP: OTLPSettings{
+				HTTPAddress: "127.0.0.1:4318",
+				GRPCAddress: "127.0.0.1:4317",
+				Channel:     "otlp",
+			},
+			Journal: JournalSettings{
+				Output:    JournalOutputLogs,
+				Channel:   "journal",
+				MaxEvents: 100,
+			},
+			Spool: SpoolSettings{
+				MaxBytes: 1 << 30,
+				Policy:   SpoolDropOldest,
+			},
+		},
+		Syslog: SyslogSettings{
+			Port: 1514,
+		},
+		Metrics: MetricsSettings{
+			Address: "127.0.0.1:9911",
+		},
+		Tracing: TracingSettings{
+			Exporter: TraceExporterNone,
+			Endpoint: "localhost:4318",
+			Insecure: true,
+		},
+		Compression: CompressionSettings{
+			Enabled:  true,
+			MinBytes: 1024,
+		},
+	}
+}
+
+// LoadSettings resolves the settings from the defaults, the configuration file and the environment
+// if file is empty, the file is looked up as described in Settings
+func LoadSettings(file string) (*Settings, error) {
+	s := DefaultSettings()
+	if len(file) == 0 {
+		file = ConfigFile()
+	}
+	if len(file) > 0 {
+		if err := s.loadFile(file); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.loadEnv(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// ConfigFile returns the path of the configuration file in use or an empty string if there is none
+func ConfigFile() string {
+	if file := os.Getenv(PilotConfigFile.String()); len(file) > 0 {
+		return Abs(file)
+	}
+	for _, name := range configFileNames {
+		file := filepath.Join(CurrentPath(), name)
+		if _, err := os.Stat(file); err == nil {
+			return file
+		}
+	}
+	return ""
+}
+
+// File returns the configuration file the settings were loaded from or an empty string if none was used
+func (s *Settings) File() string {
+	return s.file
+}
+
+func (s *Settings) loadFile(file string) error {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("cannot read configuration file: %s", err)
+	}
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(content))
+		// reject misspelled or unsupported keys rather than silently ignoring them
+		dec.KnownFields(true)
+		// an empty file decodes to io.EOF and leaves the defaults in place
+		if err = dec.Decode(s); err != nil && err != io.EOF {
+			return fmt.Errorf("invalid configuration file %s: %s", file, err)
+		}
+	case ".toml":
+		md, err := toml.Decode(string(content), s)
+		if err != nil {
+			return fmt.Errorf("invalid configuration file %s: %s", file, err)
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			keys := make([]string, len(undecoded))
+			for i, key := range undecoded {
+				keys[i] = key.String()
+			}
+			return fmt.Errorf("invalid configuration file %s: unknown keys %s", file, strings.Join(keys, ", "))
+		}
+	default:
+		return fmt.Errorf("unsupported configuration file %s, use a .yaml, .yml or .toml file", file)
+	}
+	s.file = file
+	return nil
+}
+
+// envOverride binds an environment variable to a setting
+type envOverride struct {
+	key ConfigKey
+	set func(value string) error
+}
+
+func (s *Settings) envOverrides() []envOverride {
+	return []envOverride{
+		{PilotLogLevel, stringSetting(&s.Log.Level)},
+		{PilotDebug, flagSetting(&s.Log.Debug)},
+		{PilotLogFormat, stringSetting(&s.Log.Format)},
+		{PilotLogFile, stringSetting(&s.Log.File)},
+		{PilotUseHwId, boolSetting(&s.Identity.UseHwId)},
+		{PilotHome, stringSetting(&s.Paths.Home)},
+		{PilotTelemPath, stringSetting(&s.Paths.Telemetry)},
+		{PilotCVEPath, stringSetting(&s.Paths.CVE)},
+		{PilotTrustAnchor, stringSetting(&s.Paths.TrustAnchor)},
+		{PilotTenantKey, stringSetting(&s.Paths.TenantKey)},
+		{PilotLegacyKey, stringSetting(&s.Paths.LegacyKey)},
+		{PilotStatusSocket, stringSetting(&s.Paths.Socket)},
+		{PilotPingInterval, durationSetting(&s.Intervals.Ping)},
+		{PilotKeyRefreshInterval, durationSetting(&s.Intervals.KeyRefresh)},
+		{PilotCVEUploadDelay, durationSetting(&s.Intervals.CVEUploadDelay)},
+		{PilotRequestTimeout, durationSetting(&s.Limits.RequestTimeout)},
+		{PilotActivationTimeout, durationSetting(&s.Limits.ActivationTimeout)},
+		{PilotMaxRetryInterval, durationSetting(&s.Limits.MaxRetryInterval)},
+		{PilotInsecureSkipVerify, boolSetting(&s.TLS.InsecureSkipVerify)},
+		{PilotHttpProxy, stringSetting(&s.TLS.Proxy)},
+		{PilotTelemetry, boolSetting(&s.Telemetry.Enabled)},
+		{PilotTelemetryBatchBytes, intSetting(&s.Telemetry.BatchBytes)},
+		{PilotHostMetrics, boolSetting(&s.Telemetry.HostMetrics.Enabled)},
+		{PilotHostMetricsInterval, durationSetting(&s.Telemetry.HostMetrics.Interval)},
+		{PilotHostMetricsChannel, stringSetting(&s.Telemetry.HostMetrics.Channel)},
+		{PilotOTLPReceiver, boolSetting(&s.Telemetry.OTLP.Enabled)},
+		{PilotOTLPHTTPAddress, stringSetting(&s.Telemetry.OTLP.HTTPAddress)},
+		{PilotOTLPGRPCAddress, stringSetting(&s.Telemetry.OTLP.GRPCAddress)},
+		{PilotOTLPChannel, stringSetting(&s.Telemetry.OTLP.Channel)},
+		{PilotJournal, boolSetting(&s.Telemetry.Journal.Enabled)},
+		{PilotJournalOutput, stringSetting(&s.Telemetry.Journal.Output)},
+		{PilotJournalChannel, stringSetting(&s.Telemetry.Journal.Channel)},
+		{PilotJournalPriority, stringSetting(&s.Telemetry.Journal.Priority)},
+		{PilotJournalMaxEvents, intSetting(&s.Telemetry.Journal.MaxEvents)},
+		{PilotSpoolMaxBytes, int64Setting(&s.Telemetry.Spool.MaxBytes)},
+		{PilotSpoolChannelMaxBytes, int64Setting(&s.Telemetry.Spool.ChannelMaxBytes)},
+		{PilotSpoolMaxAge, durationSetting(&s.Telemetry.Spool.MaxAge)},
+		{PilotSpoolPolicy, stringSetting(&s.Telemetry.Spool.Policy)},
+		{PilotCompression, boolSetting(&s.Compression.Enabled)},
+		{PilotCompressionMinBytes, intSetting(&s.Compression.MinBytes)},
+		{PilotSyslogPort, intSetting(&s.Syslog.Port)},
+		{PilotReloadWatch, boolSetting(&s.Reload.Watch)},
+		{PilotMetricsEnabled, boolSetting(&s.Metrics.Enabled)},
+		{PilotMetricsAddress, stringSetting(&s.Metrics.Address)},
+		{PilotTraceExporter, stringSetting(&s.Tracing.Exporter)},
+		{PilotTraceEndpoint, stringSetting(&s.Tracing.Endpoint)},
+		{PilotTraceInsecure, boolSetting(&s.Tracing.Insecure)},
+		{PilotTraceFile, stringSetting(&s.Tracing.File)},
+	}
+}
+
+func (s *Settings) loadEnv() error {
+	for _, o := range s.envOverrides() {
+		if value, ok := os.LookupEnv(o.key.String()); ok && len(value) > 0 {
+			if err := o.set(value); err != nil {
+				return fmt.Errorf("invalid value '%s' for %s: %s", value, o.key, err)
+			}
+		}
+	}
+	return nil
+}
+
+func stringSetting(field *string) func(string) error {
+	return func(value string) error {
+		*field = value
+		return nil
+	}
+}
+
+func boolSetting(field *bool) func(string) error {
+	return func(value string) error {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("expected true or false")
+		}
+		*field = b
+		return nil
+	}
+}
+
+// flagSetting a boolean historically enabled by setting the variable to any value, unless it is explicitly false
+func flagSetting(field *bool) func(string) error {
+	return func(value string) error {
+		b, err := strconv.ParseBool(value)
+		*field = err != nil || b
+		return nil
+	}
+}
+
+func intSetting(field *int) func(string) error {
+	return func(value string) error {
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("expected an integer")
+		}
+		*field = i
+		return nil
+	}
+}
+
+func int64Setting(field *int64) func(string) error {
+	return func(value string) error {
+		i, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("expected an integer")
+		}
+		*field = i
+		return nil
+	}
+}
+
+func durationSetting(field *Duration) func(string) error {
+	return func(value string) error {
+		return field.UnmarshalText([]byte(value))
+	}
+}
+
+// Validate checks the settings and returns an error listing every invalid value
+func (s *Settings) Validate() error {
+	var errs []string
+	invalid := func(name, format string, a ...interface{}) {
+		errs = append(errs, fmt.Sprintf("%s: %s", name, fmt.Sprintf(format, a...)))
+	}
+	if _, err := zerolog.ParseLevel(strings.ToLower(s.Log.Level)); err != nil || len(s.Log.Level) == 0 {
+		invalid("log.level", "unknown level '%s', use one of trace, debug, info, warn, error, fatal or panic", s.Log.Level)
+	}
+	if s.Log.Format != LogFormatText && s.Log.Format != LogFormatJSON {
+		invalid("log.format", "unknown format '%s', use text or json", s.Log.Format)
+	}
+	if s.Log.MaxDays < 0 {
+		invalid("log.max_days", "must be zero, to keep log files forever, or greater")
+	}
+	positive := map[string]Duration{
+		"intervals.ping":            s.Intervals.Ping,
+		"intervals.key_refresh":     s.Intervals.KeyRefresh,
+		"limits.request_timeout":    s.Limits.RequestTimeout,
+		"limits.activation_timeout": s.Limits.ActivationTimeout,
+		"limits.max_retry_interval": s.Limits.MaxRetryInterval,
+	}
+	for name, d := range positive {
+		if d <= 0 {
+			invalid(name, "must be greater than zero")
+		}
+	}
+	if s.Intervals.CVEUploadDelay.Duration() < time.Minute {
+		invalid("intervals.cve_upload_delay", "must be at least 1m")
+	}
+	if s.Limits.MaxRetryInterval > 0 && s.Limits.MaxRetryInterval.Duration() < 15*time.Second {
+		invalid("limits.max_retry_interval", "must be at least 15s, the first retry interval")
+	}
+	if s.Syslog.Port < 1 || s.Syslog.Port > 65535 {
+		invalid("syslog.port", "%d is not a valid port number", s.Syslog.Port)
+	}
+	if len(s.TLS.Proxy) > 0 {
+		if u, err := url.Parse(s.TLS.Proxy); err != nil || len(u.Scheme) == 0 || len(u.Host) == 0 {
+			invalid("tls.proxy", "'%s' is not a valid URL, use a value such as http://proxy:3128", s.TLS.Proxy)
+		}
+	}
+	if s.Metrics.Enabled {
+		if _, _, err := net.SplitHostPort(s.Metrics.Address); err != nil {
+			invalid("metrics.address", "'%s' is not a valid address, use a value such as 127.0.0.1:9911", s.Metrics.Address)
+		}
+	}
+	switch s.Tracing.Exporter {
+	case TraceExporterNone, TraceExporterFile:
+	case TraceExporterOTLP:
+		if _, _, err := net.SplitHostPort(s.Tracing.Endpoint); err != nil {
+			invalid("tracing.endpoint", "'%s' is not a valid address, use a value such as localhost:4318", s.Tracing.Endpoint)
+		}
+	default:
+		invalid("tracing.exporter", "unknown exporter '%s', use none, otlp or file", s.Tracing.Exporter)
+	}
+	if s.Telemetry.Enabled {
+		if info, err := os.Stat(Abs(s.Paths.Telemetry)); err != nil || !info.IsDir() {
+			invalid("paths.telemetry", "folder '%s' does not exist", s.Paths.Telemetry)
+		}
+	}
+	if s.Telemetry.BatchBytes < 1 {
+		invalid("telemetry.batch_bytes", "must be greater than zero")
+	}
+	if s.Telemetry.HostMetrics.Enabled {
+		if s.Telemetry.HostMetrics.Interval.Duration() < time.Second {
+			invalid("telemetry.host_metrics.interval", "must be at least 1s")
+		}
+		if !validChannel(s.Telemetry.HostMetrics.Channel) {
+			invalid("telemetry.host_metrics.channel", "'%s' is not a valid channel name", s.Telemetry.HostMetrics.Channel)
+		}
+	}
+	if s.Telemetry.OTLP.Enabled {
+		if !validChannel(s.Telemetry.OTLP.Channel) {
+			invalid("telemetry.otlp.channel", "'%s' is not a valid channel name", s.Telemetry.OTLP.Channel)
+		}
+		if !loopbackAddress(s.Telemetry.OTLP.HTTPAddress) {
+			invalid("telemetry.otlp.http_address", "'%s' is not a loopback address, use a value such as 127.0.0.1:4318", s.Telemetry.OTLP.HTTPAddress)
+		}
+		if len(s.Telemetry.OTLP.GRPCAddress) > 0 && !loopbackAddress(s.Telemetry.OTLP.GRPCAddress) {
+			invalid("telemetry.otlp.grpc_address", "'%s' is not a loopback address, use a value such as 127.0.0.1:4317", s.Telemetry.OTLP.GRPCAddress)
+		}
+	}
+	for i, tail := range s.Telemetry.Tail {
+		name := fmt.Sprintf("telemetry.tail[%d]", i)
+		if !validChannel(tail.Channel) {
+			invalid(name+".channel", "'%s' is not a valid channel name", tail.Channel)
+		}
+		if len(tail.Paths) == 0 {
+			invalid(name+".paths", "at least one path is required")
+		}
+		for _, path := range tail.Paths {
+			if _, err := filepath.Match(path, ""); err != nil {
+				invalid(name+".paths", "'%s' is not a valid glob pattern", path)
+			}
+		}
+		if _, err := regexp.Compile(tail.Multiline); err != nil {
+			invalid(name+".multiline", "'%s' is not a valid regular expression: %s", tail.Multiline, err)
+		}
+	}
+	if s.Telemetry.Journal.Enabled {
+		switch s.Telemetry.Journal.Output {
+		case JournalOutputLogs:
+			if !validChannel(s.Telemetry.Journal.Channel) {
+				invalid("telemetry.journal.channel", "'%s' is not a valid channel name", s.Telemetry.Journal.Channel)
+			}
+		case JournalOutputEvents:
+			if s.Telemetry.Journal.MaxEvents < 1 {
+				invalid("telemetry.journal.max_events", "must be greater than zero")
+			}
+		default:
+			invalid("telemetry.journal.output", "unknown output '%s', use logs or events", s.Telemetry.Journal.Output)
+		}
+		if _, ok := journalPriority(s.Telemetry.Journal.Priority); !ok && len(s.Telemetry.Journal.Priority) > 0 {
+			invalid("telemetry.journal.priority", "unknown priority '%s', use emerg, alert, crit, err, warning, notice, info or debug", s.Telemetry.Journal.Priority)
+		}
+		for _, match := range s.Telemetry.Journal.Matches {
+			if match != "+" && !strings.Contains(match, "=") {
+				invalid("telemetry.journal.matches", "'%s' is not a match expression, use FIELD=value or +", match)
+			}
+		}
+	}
+	if s.Telemetry.Spool.MaxBytes < 0 {
+		invalid("telemetry.spool.max_bytes", "cannot be negative")
+	}
+	if s.Telemetry.Spool.ChannelMaxBytes < 0 {
+		invalid("telemetry.spool.channel_max_bytes", "cannot be negative")
+	}
+	if s.Telemetry.Spool.MaxAge.Duration() < 0 {
+		invalid("telemetry.spool.max_age", "cannot be negative")
+	}
+	switch s.Telemetry.Spool.Policy {
+	case SpoolDropOldest, SpoolDropNewest, SpoolStopProducers:
+	default:
+		invalid("telemetry.spool.policy", "unknown policy '%s', use drop-oldest, drop-newest or stop-producers", s.Telemetry.Spool.Policy)
+	}
+	if s.Compression.MinBytes < 0 {
+		invalid("compression.min_bytes", "cannot be negative")
+	}
+	for name, file := range map[string]string{
+		"paths.trust_anchor": s.Paths.TrustAnchor,
+		"paths.tenant_key":   s.Paths.TenantKey,
+		"paths.legacy_key":   s.Paths.LegacyKey,
+	} {
+		if len(file) > 0 {
+			if _, err := os.Stat(Abs(file)); err != nil {
+				invalid(name, "file '%s' does not exist", file)
+			}
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	sort.Strings(errs)
+	return fmt.Errorf("invalid configuration:\n  - %s", strings.Join(errs, "\n  - "))
+}
+
+// Marshal writes the settings in the specified format: yaml, toml or json
+func (s *Settings) Marshal(format string) ([]byte, error) {
+	switch strings.ToLower(format) {
+	case "yaml", "yml", "":
+		return yaml.Marshal(s)
+	case "toml":
+		buf := new(bytes.Buffer)
+		err := toml.NewEncoder(buf).Encode(s)
+		return buf.Bytes(), err
+	case "json":
+		return json.MarshalIndent(s, "", "  ")
+	}
+	return nil, fmt.Errorf("unsupported format '%s', use yaml, toml or json", format)
+}
+
+var (
+	settingsMu sync.RWMutex
+	settings   *Settings
+)
+
+// CurrentSettings returns the settings in use
+// if none have been set, they are loaded from the configuration file and environment, falling back to the defaults
+func CurrentSettings() *Settings {
+	settingsMu.RLock()
+	s := settings
+	settingsMu.RUnlock()
+	if s != nil {
+		return s
+	}
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+	if settings == nil {
+		var err error
+		if settings, err = LoadSettings(""); err != nil {
+			WarningLogger.Printf("%s, using default configuration\n", err)
+			settings = DefaultSettings()
+		}
+	}
+	return settings
+}
+
+// SetSettings sets the settings in use
+func SetSettings(s *Settings) {
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+	settings = s
+}
+
+// validChannel checks that a telemetry channel name can be used as a folder name in the telemetry path
+func validChannel(channel string) bool {
+	return len(channel) > 0 && channel == filepath.Base(channel) && !strings.HasPrefix(channel, ".")
+}
+
+// loopbackAddress checks that a host:port address can only be reached from the host
+func loopbackAddress(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,105 @@
+/*
+   Pilot Host Controller
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadSettings(t *testing.T) {
+	dir := t.TempDir()
+	yamlFile := filepath.Join(dir, "pilot.yaml")
+	os.WriteFile(yamlFile, []byte(`
+log:
+  level: debug
+intervals:
+  ping: 30s
+syslog:
+  port: 2514
+`), filePerm)
+	tomlFile := filepath.Join(dir, "pilot.toml")
+	os.WriteFile(tomlFile, []byte(`
+[log]
+level = "debug"
+[intervals]
+ping = "30s"
+[syslog]
+port = 2514
+`), filePerm)
+	// the environment overrides the file
+	t.Setenv(PilotSyslogPort.String(), "3514")
+	for _, file := range []string{yamlFile, tomlFile} {
+		s, err := LoadSettings(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.Log.Level != "debug" || s.Intervals.Ping.Duration() != 30*time.Second {
+			t.Fatalf("%s: file values not loaded: %+v", file, s)
+		}
+		if s.Syslog.Port != 3514 {
+			t.Fatalf("%s: expected port from environment, got %d", file, s.Syslog.Port)
+		}
+		// values not in the file keep their defaults
+		if s.Limits.RequestTimeout.Duration() != 5*time.Minute {
+			t.Fatalf("%s: expected default request timeout, got %s", file, s.Limits.RequestTimeout.Duration())
+		}
+		if err = s.Validate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSettingsErrors(t *testing.T) {
+	dir := t.TempDir()
+	// misspelled keys are rejected
+	file := filepath.Join(dir, "pilot.yaml")
+	os.WriteFile(file, []byte("intervals:\n  pings: 30s\n"), filePerm)
+	if _, err := LoadSettings(file); err == nil {
+		t.Fatal("unknown key not rejected")
+	}
+	file = filepath.Join(dir, "pilot.toml")
+	os.WriteFile(file, []byte("[intervals]\npings = \"30s\"\n"), filePerm)
+	if _, err := LoadSettings(file); err == nil {
+		t.Fatal("unknown key not rejected")
+	}
+	// invalid environment values are reported
+	file = filepath.Join(dir, "empty.yaml")
+	os.WriteFile(file, nil, filePerm)
+	t.Setenv(PilotPingInterval.String(), "soon")
+	if _, err := LoadSettings(file); err == nil || !strings.Contains(err.Error(), PilotPingInterval.String()) {
+		t.Fatalf("invalid environment value not reported: %v", err)
+	}
+	s := DefaultSettings()
+	s.Log.Level = "loud"
+	s.Syslog.Port = 0
+	s.TLS.Proxy = "proxy"
+	err := s.Validate()
+	if err == nil {
+		t.Fatal("invalid settings not reported")
+	}
+	for _, name := range []string{"log.level", "syslog.port", "tls.proxy"} {
+		if !strings.Contains(err.Error(), name) {
+			t.Fatalf("expected an error for %s, got: %s", name, err)
+		}
+	}
+}
@@ -0,0 +1,422 @@
+/*
+   Pilot Host Controller
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// spool eviction policies, applied when a size quota is exceeded
+const (
+	// discards the oldest files until the spool is within quota
+	SpoolDropOldest = "drop-oldest"
+	// discards the newest files until the spool is within quota
+	SpoolDropNewest = "drop-newest"
+	// keeps the files pilot wrote, pilot stops writing telemetry until uploads bring the spool within quota
+	// files written by other tools are discarded oldest first, as pilot cannot stop them
+	SpoolStopProducers = "stop-producers"
+)
+
+// how often the spool quotas are enforced
+const spoolCheckInterval = 5 * time.Second
+
+// the minimum time between events about the telemetry discarded from a channel, so that a channel over quota does
+// not raise an event every check
+const spoolEventInterval = 5 * time.Minute
+
+// the name prefix of the telemetry files pilot writes, so that they can be told apart from the files of other tools
+const spoolFilePrefix = "pilot-"
+
+// the reasons telemetry is discarded, used as metric labels
+var spoolReasons = map[string]string{
+	"age":           "older than the maximum age",
+	"channel_quota": "channel over quota",
+	"spool_quota":   "spool over quota",
+	"rejected":      "spool full",
+}
+
+// errSpoolFull returned when telemetry cannot be written because the spool is over quota
+var errSpoolFull = errors.New("telemetry spool is full")
+
+// Spool enforces the size and age quotas of the telemetry channel folders
+type Spool struct {
+	// the telemetry path
+	path     string
+	settings SpoolSettings
+	// where events about discarded data are raised, no events are raised if nil
+	state *StateDir
+	// channel folders pilot cannot write to until the spool is within quota, "" if the global quota is exceeded
+	blocked map[string]bool
+	mu      sync.RWMutex
+	// the telemetry discarded since the last event, by channel and reason
+	discards map[string]*spoolDiscards
+}
+
+// spoolDiscards the telemetry discarded from a channel for a reason since the last event
+type spoolDiscards struct {
+	channel   string
+	telemType string
+	reason    string
+	files     int
+	bytes     int64
+	// when the last event was raised
+	reported time.Time
+	// true if the files were in quarantine
+	quarantined bool
+}
+
+// spoolFile a telemetry file waiting to be uploaded
+type spoolFile struct {
+	path      string
+	channel   string
+	telemType string
+	size      int64
+	modTime   time.Time
+	// true if pilot wrote the file
+	owned bool
+	// true if the file is in quarantine, i.e. it is never uploaded
+	quarantined bool
+}
+
+func NewSpool(path string, settings SpoolSettings, state *StateDir) *Spool {
+	return &Spool{
+		path:     path,
+		settings: settings,
+		state:    state,
+		blocked:  map[string]bool{},
+		discards: map[string]*spoolDiscards{},
+	}
+}
+
+// accepts returns true if pilot can write telemetry to the channel folder
+func (s *Spool) accepts(dir string) bool {
+	if s == nil {
+		return true
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return !s.blocked[""] && !s.blocked[dir]
+}
+
+// write writes the content of a new telemetry file to a channel folder, unless the spool is over quota and the
+// policy is to stop producers
+// the content is synced to disk under a hidden name first, so that processors never pick up a partially written
+// file and accepted telemetry survives a crash
+func (s *Spool) write(dir, prefix string, content []byte) error {
+	if !s.accepts(dir) {
+		spoolDiscardedFiles.WithLabelValues(filepath.Base(filepath.Dir(dir)), filepath.Base(dir), "rejected").Inc()
+		spoolDiscardedBytes.WithLabelValues(filepath.Base(filepath.Dir(dir)), filepath.Base(dir), "rejected").Add(float64(len(content)))
+		return errSpoolFull
+	}
+	name := fmt.Sprintf("%s%s_%d.json", spoolFilePrefix, prefix, time.Now().UnixNano())
+	tmp := filepath.Join(dir, fmt.Sprintf(".%s", name))
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, filePerm)
+	if err != nil {
+		return fmt.Errorf("cannot create telemetry file: %s", err)
+	}
+	_, err = f.Write(content)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(dir, name))
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("cannot write telemetry file: %s", err)
+	}
+	return nil
+}
+
+// run enforces the quotas periodically until quit is closed
+func (s *Spool) run(quit chan struct{}) {
+	ticker := time.NewTicker(spoolCheckInterval)
+	defer ticker.Stop()
+	for {
+		if err := s.enforce(); err != nil {
+			ErrorLogger.Printf("cannot enforce telemetry spool quotas: %s\n", err)
+		}
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// enforce discards files older than the maximum age, then applies the eviction policy to the channels and to the
+// whole spool if they exceed their size quota
+// quarantined files count towards the maximum age and the spool quota, and are discarded first when the spool is
+// over quota as they are never uploaded
+func (s *Spool) enforce() error {
+	files, err := s.files()
+	if err != nil {
+		return err
+	}
+	// files are sorted oldest first
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+	if maxAge := s.settings.MaxAge.Duration(); maxAge > 0 {
+		var kept []spoolFile
+		var expired []spoolFile
+		for _, f := range files {
+			if time.Since(f.modTime) > maxAge {
+				expired = append(expired, f)
+			} else {
+				kept = append(kept, f)
+			}
+		}
+		s.discard(expired, "age")
+		files = kept
+	}
+	var pending, quarantined []spoolFile
+	for _, f := range files {
+		if f.quarantined {
+			quarantined = append(quarantined, f)
+		} else {
+			pending = append(pending, f)
+		}
+	}
+	files = pending
+	blocked := map[string]bool{}
+	// per channel quota
+	if s.settings.ChannelMaxBytes > 0 {
+		channels := map[string][]spoolFile{}
+		var names []string
+		for _, f := range files {
+			if _, exists := channels[f.channel]; !exists {
+				names = append(names, f.channel)
+			}
+			channels[f.channel] = append(channels[f.channel], f)
+		}
+		files = nil
+		for _, channel := range names {
+			kept, full := s.evict(channels[channel], s.settings.ChannelMaxBytes, "channel_quota")
+			if full {
+				blocked[channel] = true
+			}
+			files = append(files, kept...)
+		}
+		sort.Slice(files, func(i, j int) bool {
+			return files[i].modTime.Before(files[j].modTime)
+		})
+	}
+	// global quota
+	if s.settings.MaxBytes > 0 {
+		quarantined = s.dropOldest(quarantined, s.settings.MaxBytes-spoolSizeOf(files), "spool_quota")
+		var full bool
+		if files, full = s.evict(files, s.settings.MaxBytes-spoolSizeOf(quarantined), "spool_quota"); full {
+			blocked[""] = true
+		}
+	}
+	spoolSize.WithLabelValues("pending").Set(float64(spoolSizeOf(files)))
+	spoolSize.WithLabelValues("quarantined").Set(float64(spoolSizeOf(quarantined)))
+	s.setBlocked(blocked)
+	s.report()
+	return nil
+}
+
+// evict applies the eviction policy to files sorted oldest first if their total size exceeds maxBytes
+// it returns the files kept and true if the quota is still exceeded, i.e. producers must stop
+func (s *Spool) evict(files []spoolFile, maxBytes int64, reason string) ([]spoolFile, bool) {
+	size := spoolSizeOf(files)
+	if size <= maxBytes {
+		return files, false
+	}
+	switch s.settings.Policy {
+	case SpoolStopProducers:
+		// pilot cannot stop other tools writing to the channel folders, so their files are discarded oldest first
+		// and pilot only stops writing if the quota is still exceeded
+		var kept, dropped []spoolFile
+		for _, f := range files {
+			if size > maxBytes && !f.owned {
+				size -= f.size
+				dropped = append(dropped, f)
+				continue
+			}
+			kept = append(kept, f)
+		}
+		s.discard(dropped, reason)
+		return kept, size > maxBytes
+	case SpoolDropNewest:
+		i := len(files)
+		for i > 0 && size > maxBytes {
+			i--
+			size -= files[i].size
+		}
+		s.discard(files[i:], reason)
+		return files[:i], false
+	default:
+		return s.dropOldest(files, maxBytes, reason), false
+	}
+}
+
+// dropOldest discards files sorted oldest first until their total size is within maxBytes, returning the files kept
+func (s *Spool) dropOldest(files []spoolFile, maxBytes int64, reason string) []spoolFile {
+	size := spoolSizeOf(files)
+	i := 0
+	for i < len(files) && size > maxBytes {
+		size -= files[i].size
+		i++
+	}
+	s.discard(files[:i], reason)
+	return files[i:]
+}
+
+// spoolSizeOf returns the total size of files
+func spoolSizeOf(files []spoolFile) int64 {
+	var size int64
+	for _, f := range files {
+		size += f.size
+	}
+	return size
+}
+
+// discard removes files, updating the metrics and adding them to the totals reported for each channel affected
+func (s *Spool) discard(files []spoolFile, reason string) {
+	for _, f := range files {
+		if err := os.Remove(f.path); err != nil {
+			// the file was uploaded in the meantime
+			continue
+		}
+		spoolDiscardedFiles.WithLabelValues(f.telemType, filepath.Base(f.channel), reason).Inc()
+		spoolDiscardedBytes.WithLabelValues(f.telemType, filepath.Base(f.channel), reason).Add(float64(f.size))
+		key := fmt.Sprintf("%s|%s", f.channel, reason)
+		d, exists := s.discards[key]
+		if !exists {
+			d = &spoolDiscards{channel: f.channel, telemType: f.telemType, reason: reason, quarantined: f.quarantined}
+			s.discards[key] = d
+		}
+		d.files++
+		d.bytes += f.size
+	}
+}
+
+// report logs and raises an event for the telemetry discarded from each channel, at most once per
+// spoolEventInterval, so that a channel over quota raises an event when it starts losing data and then
+// periodically while it keeps losing data
+func (s *Spool) report() {
+	for key, d := range s.discards {
+		if time.Since(d.reported) < spoolEventInterval {
+			continue
+		}
+		if d.files == 0 {
+			// nothing was discarded for a whole interval, the next discard is reported straight away
+			delete(s.discards, key)
+			continue
+		}
+		what := "telemetry"
+		if d.quarantined {
+			what = "quarantined telemetry"
+		}
+		WarningLogger.Printf("discarded %d %s file(s), %d bytes, from %s channel '%s': %s\n", d.files, what, d.bytes, d.telemType, filepath.Base(d.channel), spoolReasons[d.reason])
+		if s.state != nil {
+			raiseEvent(s.state, SevWarning, "telemetry", "discarded %d %s file(s), %d bytes, from %s channel '%s': %s", d.files, what, d.bytes, d.telemType, filepath.Base(d.channel), spoolReasons[d.reason])
+		}
+		d.files, d.bytes, d.reported = 0, 0, time.Now()
+	}
+}
+
+// setBlocked updates the channels pilot cannot write to, raising an event when producers are stopped
+func (s *Spool) setBlocked(blocked map[string]bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for dir := range blocked {
+		if s.blocked[dir] {
+			continue
+		}
+		what := "the telemetry spool"
+		if len(dir) > 0 {
+			what = fmt.Sprintf("%s channel '%s'", filepath.Base(filepath.Dir(dir)), filepath.Base(dir))
+		}
+		WarningLogger.Printf("%s is over quota, pilot stopped writing telemetry to it until it is uploaded\n", what)
+		if s.state != nil {
+			raiseEvent(s.state, SevWarning, "telemetry", "%s is over quota, pilot stopped writing telemetry to it until it is uploaded", what)
+		}
+	}
+	s.blocked = blocked
+}
+
+// files lists the telemetry files in all channel folders and in quarantine
+func (s *Spool) files() ([]spoolFile, error) {
+	var files []spoolFile
+	for _, telemType := range telemTypes {
+		channels, err := ls(filepath.Join(s.path, telemType), true)
+		if err != nil {
+			return nil, err
+		}
+		for _, channel := range channels {
+			if files, err = s.channelFiles(files, channel, telemType, false); err != nil {
+				return nil, err
+			}
+		}
+		quarantine := filepath.Join(s.path, telemQuarantineDir, telemType)
+		if _, err = os.Stat(quarantine); os.IsNotExist(err) {
+			// nothing was quarantined
+			continue
+		}
+		if channels, err = ls(quarantine, true); err != nil {
+			return nil, err
+		}
+		for _, channel := range channels {
+			if files, err = s.channelFiles(files, channel, telemType, true); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return files, nil
+}
+
+// channelFiles appends the files in a channel folder to files
+func (s *Spool) channelFiles(files []spoolFile, channel, telemType string, quarantined bool) ([]spoolFile, error) {
+	entries, err := os.ReadDir(channel)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read channel folder: %s", err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, spoolFile{
+			path:        filepath.Join(channel, entry.Name()),
+			channel:     channel,
+			telemType:   telemType,
+			size:        info.Size(),
+			modTime:     info.ModTime(),
+			owned:       strings.HasPrefix(entry.Name(), spoolFilePrefix),
+			quarantined: quarantined,
+		})
+	}
+	return files, nil
+}
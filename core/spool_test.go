@@ -0,0 +1,184 @@
+/*
+   Pilot Host Controller
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestSpoolEviction(t *testing.T) {
+	// writes three 10 byte files to channel a and one to channel b, oldest first
+	setup := func(t *testing.T) string {
+		dir := t.TempDir()
+		now := time.Now()
+		for i, name := range []string{"a/1", "a/2", "b/3", "a/4"} {
+			file := filepath.Join(dir, "metrics", name+".json")
+			_ = os.MkdirAll(filepath.Dir(file), dirPerm)
+			_ = os.WriteFile(file, []byte("0123456789"), filePerm)
+			_ = os.Chtimes(file, now, now.Add(time.Duration(i-4)*time.Hour))
+		}
+		_ = os.MkdirAll(filepath.Join(dir, "logs"), dirPerm)
+		return dir
+	}
+	left := func(t *testing.T, dir string) []string {
+		var names []string
+		for _, channel := range []string{"a", "b"} {
+			entries, _ := os.ReadDir(filepath.Join(dir, "metrics", channel))
+			for _, entry := range entries {
+				names = append(names, channel+"/"+entry.Name())
+			}
+		}
+		sort.Strings(names)
+		return names
+	}
+	cases := []struct {
+		name     string
+		settings SpoolSettings
+		left     string
+	}{
+		{"channel drop-oldest", SpoolSettings{ChannelMaxBytes: 20, Policy: SpoolDropOldest}, "[a/2.json a/4.json b/3.json]"},
+		{"channel drop-newest", SpoolSettings{ChannelMaxBytes: 20, Policy: SpoolDropNewest}, "[a/1.json a/2.json b/3.json]"},
+		{"global drop-oldest", SpoolSettings{MaxBytes: 20, Policy: SpoolDropOldest}, "[a/4.json b/3.json]"},
+		{"global drop-newest", SpoolSettings{MaxBytes: 20, Policy: SpoolDropNewest}, "[a/1.json a/2.json]"},
+		{"age", SpoolSettings{MaxAge: Duration(150 * time.Minute), Policy: SpoolDropOldest}, "[a/4.json b/3.json]"},
+		// files not written by pilot are dropped oldest first, as their producers cannot be stopped
+		{"stop-producers", SpoolSettings{MaxBytes: 20, Policy: SpoolStopProducers}, "[a/4.json b/3.json]"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir := setup(t)
+			if err := NewSpool(dir, c.settings, nil).enforce(); err != nil {
+				t.Fatal(err)
+			}
+			if got := fmt.Sprintf("%v", left(t, dir)); got != c.left {
+				t.Fatalf("expected %s to be left, got %s", c.left, got)
+			}
+		})
+	}
+}
+
+func TestSpoolStopProducers(t *testing.T) {
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "metrics", "a"), filepath.Join(dir, "metrics", "b")
+	_ = os.MkdirAll(a, dirPerm)
+	_ = os.MkdirAll(b, dirPerm)
+	_ = os.MkdirAll(filepath.Join(dir, "logs"), dirPerm)
+	s := NewSpool(dir, SpoolSettings{ChannelMaxBytes: 10, Policy: SpoolStopProducers}, nil)
+	for i := 0; i < 2; i++ {
+		if err := s.write(a, "test", []byte("0123456789")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a file written by another tool is discarded, the files written by pilot are kept
+	_ = os.WriteFile(filepath.Join(a, "other.json"), []byte("0123456789"), filePerm)
+	_ = s.enforce()
+	if _, err := os.Stat(filepath.Join(a, "other.json")); !os.IsNotExist(err) {
+		t.Fatalf("expected the file of another tool to be discarded, got %v", err)
+	}
+	if entries, _ := os.ReadDir(a); len(entries) != 2 {
+		t.Fatalf("expected the files written by pilot to be kept, got %d files", len(entries))
+	}
+	if err := s.write(a, "test", []byte("0123456789")); err != errSpoolFull {
+		t.Fatalf("expected the write to a full channel to be rejected, got %v", err)
+	}
+	// other channels are not affected
+	if err := s.write(b, "test", []byte("0123456789")); err != nil {
+		t.Fatal(err)
+	}
+	// producers resume once the channel is uploaded
+	entries, _ := os.ReadDir(a)
+	for _, entry := range entries {
+		_ = os.Remove(filepath.Join(a, entry.Name()))
+	}
+	_ = s.enforce()
+	if err := s.write(a, "test", []byte("0123456789")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSpoolDiscardEvents(t *testing.T) {
+	dir := t.TempDir()
+	channel := filepath.Join(dir, "metrics", "a")
+	_ = os.MkdirAll(channel, dirPerm)
+	_ = os.MkdirAll(filepath.Join(dir, "logs"), dirPerm)
+	state := NewStateDir(t.TempDir())
+	_ = ensureDir(state.Submit(""))
+	s := NewSpool(dir, SpoolSettings{ChannelMaxBytes: 10, Policy: SpoolDropOldest}, state)
+	// the channel stays over quota for several checks
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 2; j++ {
+			_ = os.WriteFile(filepath.Join(channel, fmt.Sprintf("%d_%d.json", i, j)), []byte("0123456789"), filePerm)
+		}
+		if err := s.enforce(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if events := countFiles(state.Submit(""), ".ev"); events != 1 {
+		t.Fatalf("expected a single discard event, got %d", events)
+	}
+	// the files discarded since the event are reported once the interval elapses
+	for _, d := range s.discards {
+		if d.files != 4 {
+			t.Fatalf("expected 4 files pending report, got %d", d.files)
+		}
+		d.reported = d.reported.Add(-spoolEventInterval)
+	}
+	s.report()
+	if events := countFiles(state.Submit(""), ".ev"); events != 2 {
+		t.Fatalf("expected a second discard event, got %d", events)
+	}
+}
+
+func TestSpoolQuarantine(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	// a quarantined file, then two files waiting to be uploaded, oldest first
+	for i, name := range []string{"quarantine/metrics/a/1", "metrics/a/2", "metrics/a/3"} {
+		file := filepath.Join(dir, name+".json")
+		_ = os.MkdirAll(filepath.Dir(file), dirPerm)
+		_ = os.WriteFile(file, []byte("0123456789"), filePerm)
+		_ = os.Chtimes(file, now, now.Add(time.Duration(i-3)*time.Hour))
+	}
+	_ = os.MkdirAll(filepath.Join(dir, "logs"), dirPerm)
+	// the quarantined file is discarded first, whatever the policy
+	if err := NewSpool(dir, SpoolSettings{MaxBytes: 20, Policy: SpoolDropNewest}, nil).enforce(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "quarantine/metrics/a/1.json")); !os.IsNotExist(err) {
+		t.Fatalf("expected the quarantined file to be discarded, got %v", err)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(dir, "metrics/a")); len(entries) != 2 {
+		t.Fatalf("expected the files waiting to be uploaded to be kept, got %d files", len(entries))
+	}
+	// quarantined files expire like the other files
+	file := filepath.Join(dir, "quarantine/metrics/a/4.json")
+	_ = os.WriteFile(file, []byte("0123456789"), filePerm)
+	_ = os.Chtimes(file, now, now.Add(-3*time.Hour))
+	if err := NewSpool(dir, SpoolSettings{MaxAge: Duration(90 * time.Minute), Policy: SpoolDropOldest}, nil).enforce(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Fatalf("expected the expired quarantined file to be discarded, got %v", err)
+	}
+}
@@ -0,0 +1,219 @@
+/*
+   Pilot Host Controller
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// StateDir the folder where pilot keeps its local state: the job queue, job results and events waiting to be
+// submitted, job markers, quarantined jobs, the audit log and traces
+type StateDir struct {
+	root string
+}
+
+// NewStateDir creates a state folder abstraction rooted at the specified path
+func NewStateDir(root string) *StateDir {
+	if abs, err := filepath.Abs(root); err == nil {
+		root = abs
+	}
+	return &StateDir{root: root}
+}
+
+// DefaultStateDir returns the state folder for the current settings
+func DefaultStateDir() *StateDir {
+	return NewStateDir(StateRoot(CurrentSettings()))
+}
+
+// StateRoot returns the path of the state folder: the data folder in paths.home (PILOT_HOME) if set,
+// otherwise the data folder in the configuration path (PILOT_CFG_PATH or the current folder)
+func StateRoot(s *Settings) string {
+	if len(s.Paths.Home) > 0 {
+		return filepath.Join(s.Paths.Home, "data")
+	}
+	return filepath.Join(CurrentPath(), "data")
+}
+
+// Root returns the path of the state folder
+func (d *StateDir) Root() string {
+	return d.root
+}
+
+// Path returns the path of a file or folder in the state folder
+func (d *StateDir) Path(elem ...string) string {
+	return filepath.Join(append([]string{d.root}, elem...)...)
+}
+
+// Process returns the path of a file in the queue of jobs to be processed
+func (d *StateDir) Process(file string) string {
+	return d.Path("process", file)
+}
+
+// Submit returns the path of a file in the queue of information to be submitted to pilot control
+func (d *StateDir) Submit(file string) string {
+	return d.Path("submit", file)
+}
+
+// Quarantine returns the path of a file in the folder of jobs that failed verification
+func (d *StateDir) Quarantine(file string) string {
+	return d.Path("quarantine", file)
+}
+
+// Audit returns the path of the audit log folder
+func (d *StateDir) Audit() string {
+	return d.Path("audit")
+}
+
+// Trace returns the path of the trace folder
+func (d *StateDir) Trace() string {
+	return d.Path("trace")
+}
+
+// Checkpoints returns the path of a file in the folder where telemetry sources persist how far they have read
+func (d *StateDir) Checkpoints(file string) string {
+	return d.Path("checkpoints", file)
+}
+
+// Validate creates the state folders if they do not exist, then audits their ownership and permissions and
+// checks pilot can write to them; pilot cannot start if other users can write to the state folder
+func (d *StateDir) Validate() error {
+	for _, dir := range []string{d.root, d.Process(""), d.Submit("")} {
+		if err := ensureDir(dir); err != nil {
+			return err
+		}
+	}
+	if err := auditPath(d.root); err != nil {
+		return fmt.Errorf("insecure state folder: %s", err)
+	}
+	probe := d.Path(".probe")
+	if err := writeFile(probe, []byte{}); err != nil {
+		return fmt.Errorf("state folder %s is not writable: %s", d.root, err)
+	}
+	return os.Remove(probe)
+}
+
+// Migrate moves job, result, event and marker files left in the specified state folders, by previous versions
+// resolving the state folder differently, into this state folder; files already in this folder are not replaced
+// folders failing the ownership and permission checks of the state folder are skipped, as their files could have
+// been planted by other users; Validate must be called afterwards, so that the files moved are audited too
+// it returns the number of files moved
+func (d *StateDir) Migrate(roots []string) (int, error) {
+	moved := 0
+	for _, root := range roots {
+		root, _ = filepath.Abs(root)
+		if root == d.root {
+			continue
+		}
+		if info, err := os.Stat(root); err != nil || !info.IsDir() {
+			continue
+		}
+		if err := auditPath(root); err != nil {
+			WarningLogger.Printf("not migrating files left in %s by a previous version: %s\n", root, err)
+			continue
+		}
+		for _, m := range []struct {
+			from, to string
+			match    func(name string) bool
+		}{
+			{filepath.Join(root, "process"), d.Process(""), hasExt(".job")},
+			{filepath.Join(root, "submit"), d.Submit(""), hasExt(".result", ".ev")},
+			{root, d.root, func(name string) bool {
+				return name == "events.json" || (strings.HasPrefix(name, "job_") && hasExt(".started", ".submitted")(name))
+			}},
+		} {
+			n, err := migrateFiles(m.from, m.to, m.match)
+			moved += n
+			if err != nil {
+				return moved, err
+			}
+		}
+	}
+	return moved, nil
+}
+
+// legacyStateRoots returns the state folders used by previous versions
+func legacyStateRoots() []string {
+	var roots []string
+	if home := os.Getenv(PilotHome.String()); len(home) > 0 {
+		roots = append(roots, filepath.Join(home, "data"))
+	}
+	if wd, err := os.Getwd(); err == nil {
+		roots = append(roots, filepath.Join(wd, "data"))
+	}
+	roots = append(roots, filepath.Join(CurrentPath(), "data"))
+	if exe, err := os.Executable(); err == nil {
+		roots = append(roots, filepath.Join(filepath.Dir(exe), "data"))
+	}
+	return roots
+}
+
+func hasExt(ext ...string) func(string) bool {
+	return func(name string) bool {
+		for _, e := range ext {
+			if filepath.Ext(name) == e {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func migrateFiles(from, to string, match func(name string) bool) (int, error) {
+	entries, err := os.ReadDir(from)
+	if err != nil {
+		return 0, nil
+	}
+	moved := 0
+	for _, entry := range entries {
+		if entry.IsDir() || !match(entry.Name()) {
+			continue
+		}
+		src, dst := filepath.Join(from, entry.Name()), filepath.Join(to, entry.Name())
+		if _, err = os.Stat(dst); err == nil {
+			WarningLogger.Printf("cannot migrate %s, %s already exists\n", src, dst)
+			continue
+		}
+		if err = ensureDir(to); err != nil {
+			return moved, err
+		}
+		if err = moveFile(src, dst); err != nil {
+			return moved, fmt.Errorf("cannot migrate %s: %s", src, err)
+		}
+		moved++
+	}
+	return moved, nil
+}
+
+// moveFile renames a file, copying it if the destination is in a different file system
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	content, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	if err = writeFile(dst, content); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
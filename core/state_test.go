@@ -0,0 +1,75 @@
+/*
+   Pilot Host Controller
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStateDirMigrate(t *testing.T) {
+	state := NewStateDir(filepath.Join(t.TempDir(), "data"))
+	if err := state.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	// state left by a previous version in another folder
+	legacy := filepath.Join(t.TempDir(), "data")
+	for _, file := range []string{
+		filepath.Join("process", "job_1.job"),
+		filepath.Join("submit", "job_2.result"),
+		filepath.Join("submit", "pilot_1.ev"),
+		"job_1.started",
+		"events.json",
+		"unrelated.txt",
+	} {
+		os.MkdirAll(filepath.Dir(filepath.Join(legacy, file)), dirPerm)
+		os.WriteFile(filepath.Join(legacy, file), []byte("{}"), filePerm)
+	}
+	// a job already in the state folder is not replaced
+	os.WriteFile(state.Submit("job_2.result"), []byte("current"), filePerm)
+	moved, err := state.Migrate([]string{legacy, state.Root()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved != 4 {
+		t.Fatalf("expected 4 files moved, got %d", moved)
+	}
+	for _, file := range []string{state.Process("job_1.job"), state.Submit("pilot_1.ev"), state.Path("job_1.started"), state.Path("events.json")} {
+		if _, err = os.Stat(file); err != nil {
+			t.Fatalf("%s not migrated", file)
+		}
+	}
+	if b, _ := os.ReadFile(state.Submit("job_2.result")); string(b) != "current" {
+		t.Fatal("existing result replaced")
+	}
+	if _, err = os.Stat(filepath.Join(legacy, "unrelated.txt")); err != nil {
+		t.Fatal("unrelated file moved")
+	}
+	// files in a folder other users can write to are not migrated, as they could have been planted
+	parent := t.TempDir()
+	insecure := filepath.Join(parent, "data")
+	os.MkdirAll(filepath.Join(insecure, "process"), dirPerm)
+	os.WriteFile(filepath.Join(insecure, "process", "job_3.job"), []byte("{}"), filePerm)
+	os.Chmod(parent, 0777)
+	defer os.Chmod(parent, 0700)
+	if moved, err = state.Migrate([]string{insecure}); err != nil || moved != 0 {
+		t.Fatalf("expected no files moved from an insecure folder, got %d: %v", moved, err)
+	}
+}
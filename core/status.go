@@ -0,0 +1,341 @@
+/*
+   Pilot Host Controller
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Status the state of a running pilot, served by the local status API
+type Status struct {
+	Version          string          `json:"version"`
+	HostUUID         string          `json:"host_uuid"`
+	Started          time.Time       `json:"started"`
+	Connected        bool            `json:"connected"`
+	ControlURI       string          `json:"control_uri,omitempty"`
+	LastPing         *time.Time      `json:"last_ping,omitempty"`
+	PingInterval     Duration        `json:"ping_interval"`
+	ActivationExpiry *time.Time      `json:"activation_expiry,omitempty"`
+	RunningJob       *RunningJob     `json:"running_job,omitempty"`
+	Queues           QueueStatus     `json:"queues"`
+	Telemetry        []ChannelStatus `json:"telemetry,omitempty"`
+	CVE              CVEStatus       `json:"cve"`
+}
+
+// RunningJob the job being executed by the worker
+type RunningJob struct {
+	JobId    int64     `json:"job_id"`
+	Package  string    `json:"package"`
+	Function string    `json:"function"`
+	Started  time.Time `json:"started"`
+}
+
+// QueueStatus the number of files in the local queues
+type QueueStatus struct {
+	Jobs        int `json:"jobs"`
+	Results     int `json:"results"`
+	Events      int `json:"events"`
+	Quarantined int `json:"quarantined"`
+}
+
+// ChannelStatus the backlog and health of a telemetry channel
+type ChannelStatus struct {
+	Type    string `json:"type"`
+	Channel string `json:"channel"`
+	Path    string `json:"path"`
+	Backlog int    `json:"backlog"`
+	// pass, warn if submissions are failing or fail if the channel failed and is waiting to be restarted
+	Health string `json:"health"`
+	// the last submission or channel error
+	Error string `json:"error,omitempty"`
+	// the number of times the channel was restarted after failing
+	Restarts int `json:"restarts"`
+	// the number of files of the channel moved to quarantine
+	Quarantined int `json:"quarantined"`
+}
+
+// CVEStatus the state of the CVE exporter
+type CVEStatus struct {
+	Enabled     bool     `json:"enabled"`
+	Path        string   `json:"path,omitempty"`
+	Pending     int      `json:"pending"`
+	UploadDelay Duration `json:"upload_delay,omitempty"`
+	// the number of pending reports that failed to upload and are waiting to be retried
+	Retrying int `json:"retrying"`
+	// the number of reports pilot control rejected, moved to the failed folder
+	Failed int `json:"failed"`
+	// when the next retry is due and why the report to retry failed
+	NextRetry *time.Time `json:"next_retry,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+}
+
+// health check results
+const (
+	HealthPass = "pass"
+	HealthWarn = "warn"
+	HealthFail = "fail"
+)
+
+// Health the result of the pilot health checks, the status is the worst result of all checks
+type Health struct {
+	Status string        `json:"status"`
+	Checks []HealthCheck `json:"checks"`
+}
+
+type HealthCheck struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Message string `json:"message"`
+}
+
+// activation keys expiring within this period raise a warning
+const activationExpiryWarning = 14 * 24 * time.Hour
+
+// StatusSocket returns the path of the status API socket for the current settings
+func StatusSocket() string {
+	return statusSocket(DefaultStateDir())
+}
+
+// statusSocket returns paths.socket (PILOT_STATUS_SOCKET) if set, otherwise pilot.sock in the state folder
+func statusSocket(state *StateDir) string {
+	if socket := CurrentSettings().Paths.Socket; len(socket) > 0 {
+		return Abs(socket)
+	}
+	return state.Path("pilot.sock")
+}
+
+// status collects the current state of pilot
+func (p *Pilot) status() Status {
+	p.statusMu.RLock()
+	s := Status{
+		Version:      Version,
+		HostUUID:     p.info.HostUUID,
+		Started:      p.started,
+		Connected:    p.connected,
+		PingInterval: Duration(p.pingInterval),
+	}
+	if !p.lastPing.IsZero() {
+		lastPing := p.lastPing
+		s.LastPing = &lastPing
+	}
+	p.statusMu.RUnlock()
+	if p.ctl != nil {
+		s.ControlURI = p.ctl.cfg.BaseURI
+	}
+	if A != nil {
+		expiry := A.Expiry
+		s.ActivationExpiry = &expiry
+	}
+	s.RunningJob = p.worker.Running()
+	s.Queues = QueueStatus{
+		Jobs:        countFiles(p.state.Process(""), ".job"),
+		Results:     countFiles(p.state.Submit(""), ".result"),
+		Events:      countFiles(p.state.Submit(""), ".ev"),
+		Quarantined: countFiles(p.state.Quarantine(""), ""),
+	}
+	// telemetry and the CVE exporter are replaced on configuration reload
+	p.reloadMu.Lock()
+	defer p.reloadMu.Unlock()
+	if p.telem != nil {
+		s.Telemetry = p.telem.Backlog()
+	}
+	if p.cveExporter != nil {
+		s.CVE = p.cveExporter.Status()
+	}
+	return s
+}
+
+// health checks whether pilot is able to do its job
+func (p *Pilot) health() Health {
+	s := p.status()
+	h := Health{Status: HealthPass}
+	check := func(name, status, format string, a ...interface{}) {
+		h.Checks = append(h.Checks, HealthCheck{Name: name, Status: status, Message: fmt.Sprintf(format, a...)})
+		if status == HealthFail || (status == HealthWarn && h.Status == HealthPass) {
+			h.Status = status
+		}
+	}
+	switch {
+	case s.Connected:
+		check("control", HealthPass, "connected to %s", s.ControlURI)
+	case s.LastPing != nil:
+		check("control", HealthFail, "cannot reach pilot control, last successful ping at %s", s.LastPing.Format(time.RFC3339))
+	default:
+		check("control", HealthFail, "not connected to pilot control yet")
+	}
+	switch {
+	case s.ActivationExpiry == nil:
+		check("activation", HealthFail, "pilot is not activated")
+	case time.Now().After(*s.ActivationExpiry):
+		check("activation", HealthFail, "activation expired on %s", s.ActivationExpiry.Format(time.RFC3339))
+	case time.Until(*s.ActivationExpiry) < activationExpiryWarning:
+		check("activation", HealthWarn, "activation expires on %s", s.ActivationExpiry.Format(time.RFC3339))
+	default:
+		check("activation", HealthPass, "activation expires on %s", s.ActivationExpiry.Format(time.RFC3339))
+	}
+	var failed, quarantined []string
+	for _, ch := range s.Telemetry {
+		name := fmt.Sprintf("%s/%s", ch.Type, ch.Channel)
+		if ch.Health == HealthFail {
+			failed = append(failed, fmt.Sprintf("%s (%s)", name, ch.Error))
+		}
+		if ch.Quarantined > 0 {
+			quarantined = append(quarantined, name)
+		}
+	}
+	switch {
+	case len(failed) > 0:
+		check("telemetry", HealthWarn, "channel(s) failed: %s", strings.Join(failed, ", "))
+	case len(quarantined) > 0:
+		check("telemetry", HealthWarn, "channel(s) with quarantined files: %s", strings.Join(quarantined, ", "))
+	case len(s.Telemetry) > 0:
+		check("telemetry", HealthPass, "%d channel(s)", len(s.Telemetry))
+	}
+	switch {
+	case !s.CVE.Enabled:
+	case s.CVE.Failed > 0:
+		check("cve", HealthWarn, "%d report(s) rejected by pilot control, see %s", s.CVE.Failed, filepath.Join(s.CVE.Path, "failed"))
+	case s.CVE.Retrying > 0:
+		check("cve", HealthWarn, "%d report(s) waiting to be retried: %s", s.CVE.Retrying, s.CVE.LastError)
+	default:
+		check("cve", HealthPass, "%d report(s) pending", s.CVE.Pending)
+	}
+	if s.Queues.Quarantined > 0 {
+		check("jobs", HealthWarn, "%d job(s) failed verification and were quarantined", s.Queues.Quarantined)
+	} else {
+		check("jobs", HealthPass, "%d job(s) queued", s.Queues.Jobs)
+	}
+	return h
+}
+
+// serveStatus starts the read-only status API on a unix socket only accessible by the user running pilot
+func (p *Pilot) serveStatus() {
+	socket := statusSocket(p.state)
+	// remove a socket left by a previous run
+	if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+		WarningLogger.Printf("cannot remove status socket %s, status API disabled: %s\n", socket, err)
+		return
+	}
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		WarningLogger.Printf("cannot listen on status socket %s, status API disabled: %s\n", socket, err)
+		return
+	}
+	if err = os.Chmod(socket, filePerm); err != nil {
+		WarningLogger.Printf("cannot restrict access to status socket %s, status API disabled: %s\n", socket, err)
+		l.Close()
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", readOnly(func() (interface{}, int) {
+		return p.status(), http.StatusOK
+	}))
+	mux.HandleFunc("/health", readOnly(func() (interface{}, int) {
+		h := p.health()
+		if h.Status == HealthFail {
+			return h, http.StatusServiceUnavailable
+		}
+		return h, http.StatusOK
+	}))
+	go func() {
+		if err := http.Serve(l, mux); err != nil {
+			WarningLogger.Printf("status API stopped: %s\n", err)
+		}
+	}()
+	InfoLogger.Printf("status API listening on %s\n", socket)
+}
+
+// readOnly serves the JSON value returned by the specified function to GET requests
+func readOnly(get func() (interface{}, int)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		value, code := get()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(value)
+	}
+}
+
+// GetStatus retrieves the status of the pilot listening on the specified socket
+func GetStatus(socket string) (*Status, error) {
+	s := new(Status)
+	if _, err := getLocal(socket, "/status", s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// GetHealth retrieves the health of the pilot listening on the specified socket
+func GetHealth(socket string) (*Health, error) {
+	h := new(Health)
+	if _, err := getLocal(socket, "/health", h); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func getLocal(socket, path string, value interface{}) (int, error) {
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		},
+		Timeout: 10 * time.Second,
+	}
+	resp, err := client.Get(fmt.Sprintf("http://pilot%s", path))
+	if err != nil {
+		return 0, fmt.Errorf("cannot connect to pilot at %s, is pilot running? %s", socket, err)
+	}
+	defer resp.Body.Close()
+	if err = json.NewDecoder(resp.Body).Decode(value); err != nil {
+		return resp.StatusCode, fmt.Errorf("cannot read pilot %s: %s", path, err)
+	}
+	return resp.StatusCode, nil
+}
+
+// countFiles counts the files in a folder with the specified extension, or all files if ext is empty
+func countFiles(dir, ext string) int {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0
+	}
+	count := 0
+	for _, entry := range entries {
+		if !entry.IsDir() && (len(ext) == 0 || filepath.Ext(entry.Name()) == ext) {
+			count++
+		}
+	}
+	return count
+}
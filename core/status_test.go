@@ -0,0 +1,61 @@
+/*
+   Pilot Host Controller
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"os"
+	ctl "southwinds.dev/pilotctl/types"
+	"testing"
+	"time"
+)
+
+func TestStatusAPI(t *testing.T) {
+	state := NewStateDir(t.TempDir())
+	if err := state.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(state.Process("job_1.job"), []byte("{}"), filePerm)
+	p := &Pilot{
+		info:         &ctl.HostInfo{HostUUID: "host-1"},
+		worker:       NewWorker(state, nil),
+		state:        state,
+		started:      time.Now(),
+		pingInterval: 15 * time.Second,
+	}
+	p.serveStatus()
+	socket := statusSocket(state)
+	if info, err := os.Stat(socket); err != nil || info.Mode().Perm() != filePerm {
+		t.Fatalf("socket not restricted to the owner: %v", err)
+	}
+	s, err := GetStatus(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.HostUUID != "host-1" || s.Queues.Jobs != 1 || s.Connected {
+		t.Fatalf("unexpected status %+v", s)
+	}
+	// not connected to pilot control, nor activated
+	h, err := GetHealth(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Status != HealthFail {
+		t.Fatalf("expected a failed health check, got %+v", h)
+	}
+}
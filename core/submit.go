@@ -25,36 +25,39 @@ import (
 	"os"
 	"path"
 	"southwinds.dev/pilotctl/types"
+	"time"
 )
 
 // submitJobResult persist the result of executing a Job in the file system
 // fail-safe: remove start mark created by peek
 //
 //	create a submitted mark in case host goes before removing the job from the queue
-func submitJobResult(result types.JobResult) error {
-	defer TRA(CE())
-	dir := submitDir(fmt.Sprintf("job_%d.result", result.JobId))
+func submitJobResult(state *StateDir, result types.JobResult) error {
+	dir := state.Submit(fmt.Sprintf("job_%d.result", result.JobId))
 	bytes, err := json.Marshal(result)
 	if err != nil {
 		return err
 	}
-	err = ioutil.WriteFile(dir, bytes, os.ModePerm)
+	bytes, err = sealData(bytes)
 	if err != nil {
 		return err
 	}
-	return submittedMarker(result.JobId)
+	err = writeFile(dir, bytes)
+	if err != nil {
+		return err
+	}
+	return submittedMarker(state, result.JobId)
 }
 
-func submittedMarker(jobId int64) error {
-	defer TRA(CE())
-	dir := dataDir(fmt.Sprintf("job_%d.submitted", jobId))
+func submittedMarker(state *StateDir, jobId int64) error {
+	dir := state.Path(fmt.Sprintf("job_%d.submitted", jobId))
 	// creates a submitted marker
-	err := ioutil.WriteFile(dir, []byte{}, os.ModePerm)
+	err := writeFile(dir, []byte{})
 	if err != nil {
 		return err
 	}
 	// remove the started marker
-	dir = dataDir(fmt.Sprintf("job_%d.started", jobId))
+	dir = state.Path(fmt.Sprintf("job_%d.started", jobId))
 	err = os.Remove(dir)
 	// started marker might not exist if the job failed to start
 	if err != nil {
@@ -63,30 +66,36 @@ func submittedMarker(jobId int64) error {
 	return nil
 }
 
-func submittedMarkerExists(jobId int64) bool {
-	defer TRA(CE())
-	dir := dataDir(fmt.Sprintf("job_%d.submitted", jobId))
+func submittedMarkerExists(state *StateDir, jobId int64) bool {
+	dir := state.Path(fmt.Sprintf("job_%d.submitted", jobId))
 	_, err := os.Stat(dir)
 	return err == nil
 }
 
-func peekJobResult() (jobResult *types.JobResult, err error) {
-	defer TRA(CE())
+func peekJobResult(state *StateDir) (jobResult *types.JobResult, err error) {
 	var bytes []byte
-	dir := submitDir("")
+	dir := state.Submit("")
 	files, err := lsJobs(dir)
 	if err != nil {
 		return nil, err
 	}
 	for _, file := range files {
 		if !file.IsDir() && path.Ext(file.Name()) == ".result" {
-			bytes, err = ioutil.ReadFile(submitDir(file.Name()))
+			bytes, err = ioutil.ReadFile(state.Submit(file.Name()))
 			if err != nil {
 				return nil, err
 			}
-			err = json.Unmarshal(bytes, &jobResult)
+			bytes, err = openData(bytes)
+			if err == nil {
+				err = json.Unmarshal(bytes, &jobResult)
+			}
 			if err != nil {
-				return nil, err
+				// a corrupted result would block the queue, it is moved aside and the next one is peeked
+				if qErr := quarantineResult(state, file.Name(), err); qErr != nil {
+					return nil, qErr
+				}
+				jobResult = nil
+				continue
 			}
 			// returns the found job and creates a started marker for the job in the file system
 			return jobResult, nil
@@ -96,9 +105,21 @@ func peekJobResult() (jobResult *types.JobResult, err error) {
 	return nil, nil
 }
 
-func removeJobResult(result types.JobResult) error {
-	defer TRA(CE())
+// quarantineResult moves a job result file that cannot be read to the quarantine folder and raises an event
+func quarantineResult(state *StateDir, name string, cause error) error {
+	if err := ensureDir(state.Quarantine("")); err != nil {
+		return err
+	}
+	dst := state.Quarantine(fmt.Sprintf("%s.%d", name, time.Now().UnixNano()))
+	if err := os.Rename(state.Submit(name), dst); err != nil {
+		return fmt.Errorf("cannot quarantine job result file %s: %s", name, err)
+	}
+	raiseEvent(state, SevError, "security", "job result file %s cannot be read and was quarantined: %s", name, cause)
+	return nil
+}
+
+func removeJobResult(state *StateDir, result types.JobResult) error {
 	// remove job from queue
-	dir := submitDir(fmt.Sprintf("job_%d.result", result.JobId))
+	dir := state.Submit(fmt.Sprintf("job_%d.result", result.JobId))
 	return os.Remove(dir)
 }
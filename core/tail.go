@@ -0,0 +1,440 @@
+/*
+   Pilot Host Controller
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/plog"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// how often tailed files are checked for new content
+const tailPollInterval = time.Second
+
+// how long a file must stop growing before its last multiline entry or unterminated line is shipped
+const tailIdleTimeout = 3 * time.Second
+
+// Tailer follows log files and writes their new entries to logs channels, from where they are uploaded to pilot
+// control as any other logs file
+// entries are written in OTLP JSON format, one file per source and poll; the offset of each file is checkpointed
+// once its entries are written, so that pilot resumes where it stopped after a restart
+type Tailer struct {
+	sources []*tailSource
+	// the file the offsets of the tailed files are persisted to, offsets are not persisted if empty
+	checkpointFile string
+	checkpoints    map[string]tailCheckpoint
+	// the checkpoints last persisted, so that they are only written when offsets change
+	lastCheckpoints []byte
+	spool           *Spool
+	quit            chan struct{}
+	// closed when the poll loop exits, nil if the tailer was not started
+	done chan struct{}
+}
+
+// tailCheckpoint the position up to which a tailed file has been shipped
+type tailCheckpoint struct {
+	// identifies the file, so that a file rotated while pilot was stopped is read from the start
+	Id     uint64 `json:"id"`
+	Offset int64  `json:"offset"`
+}
+
+type tailSource struct {
+	settings TailSettings
+	// the logs channel folder
+	dir string
+	// matches the first line of an entry, if nil every line is an entry
+	multiline *regexp.Regexp
+	// the followed files keyed by path
+	files map[string]*tailFile
+	// files rotated or no longer matched, read to the end before they are closed
+	draining []*tailFile
+}
+
+// tailFile a followed file
+type tailFile struct {
+	path string
+	f    *os.File
+	info os.FileInfo
+	// the position up to which the file has been shipped
+	offset int64
+	// the size of the file when it was last read and the time it last grew
+	size    int64
+	grownAt time.Time
+}
+
+// tailRecord a log entry read from a file
+type tailRecord struct {
+	path     string
+	body     string
+	observed time.Time
+}
+
+func NewTailer(sources []TailSettings, telemetryPath, checkpointFile string, spool *Spool) (*Tailer, error) {
+	t := &Tailer{
+		checkpointFile: checkpointFile,
+		checkpoints:    map[string]tailCheckpoint{},
+		spool:          spool,
+		quit:           make(chan struct{}),
+	}
+	for _, settings := range sources {
+		s := &tailSource{
+			settings: settings,
+			dir:      filepath.Join(telemetryPath, "logs", settings.Channel),
+			files:    map[string]*tailFile{},
+		}
+		if len(settings.Multiline) > 0 {
+			re, err := regexp.Compile(settings.Multiline)
+			if err != nil {
+				return nil, fmt.Errorf("invalid multiline pattern for channel %s: %s", settings.Channel, err)
+			}
+			s.multiline = re
+		}
+		t.sources = append(t.sources, s)
+	}
+	if len(checkpointFile) > 0 {
+		content, err := os.ReadFile(checkpointFile)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("cannot read tail checkpoints: %s", err)
+		}
+		if len(content) > 0 {
+			if err = json.Unmarshal(content, &t.checkpoints); err != nil {
+				WarningLogger.Printf("cannot read tail checkpoints, tailing files from their end: %s\n", err)
+			}
+		}
+	}
+	return t, nil
+}
+
+// Start follows the files of all sources, checking for new content every second
+func (t *Tailer) Start() {
+	for _, s := range t.sources {
+		logFor("telemetry").Info().Strs("paths", s.settings.Paths).Str("channel", s.settings.Channel).Msg("tailing log files")
+	}
+	t.done = make(chan struct{})
+	go func() {
+		defer close(t.done)
+		ticker := time.NewTicker(tailPollInterval)
+		defer ticker.Stop()
+		t.poll(true)
+		for {
+			select {
+			case <-t.quit:
+				return
+			case <-ticker.C:
+				t.poll(false)
+			}
+		}
+	}()
+}
+
+// Stop stops following files; entries not yet written are read again from the checkpoint when pilot restarts
+func (t *Tailer) Stop() {
+	close(t.quit)
+	if t.done != nil {
+		<-t.done
+	}
+	for _, s := range t.sources {
+		for _, f := range append(s.draining, mapValues(s.files)...) {
+			_ = f.f.Close()
+		}
+	}
+}
+
+// poll writes the new entries of each source and checkpoints their offsets
+// startup is true for the first poll, when files without a checkpoint are read from their end unless the source
+// is set to read them from the start; files found later are always read from the start
+func (t *Tailer) poll(startup bool) {
+	for _, s := range t.sources {
+		if err := t.pollSource(s, startup); err != nil {
+			logFor("telemetry").Error().Err(err).Str("channel", s.settings.Channel).Msg("cannot tail log files")
+		}
+	}
+	t.saveCheckpoints()
+}
+
+func (t *Tailer) pollSource(s *tailSource, startup bool) error {
+	matched := s.match()
+	// files rotated or no longer matched are read to the end before they are closed
+	for path, f := range s.files {
+		if info, err := os.Stat(path); err == nil && matched[path] && os.SameFile(info, f.info) {
+			continue
+		}
+		s.draining = append(s.draining, f)
+		delete(s.files, path)
+	}
+	paths := make([]string, 0, len(matched))
+	for path := range matched {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		if _, exists := s.files[path]; exists {
+			continue
+		}
+		f, err := t.open(s, path, startup)
+		if err != nil {
+			logFor("telemetry").Warn().Err(err).Str("channel", s.settings.Channel).Msg("cannot tail log file")
+			continue
+		}
+		s.files[path] = f
+	}
+	// reads the rotated files first, so that entries are shipped in order
+	files := append([]*tailFile{}, s.draining...)
+	for _, path := range paths {
+		if f := s.files[path]; f != nil {
+			files = append(files, f)
+		}
+	}
+	var records []tailRecord
+	offsets := make([]int64, len(files))
+	for i, f := range files {
+		r, offset, err := s.read(f, i < len(s.draining))
+		if err != nil {
+			return fmt.Errorf("cannot read %s: %s", f.path, err)
+		}
+		records = append(records, r...)
+		offsets[i] = offset
+	}
+	if len(records) > 0 {
+		content, err := marshalTailRecords(records)
+		if err != nil {
+			return err
+		}
+		// offsets are not moved, so that the entries are read again in the next poll
+		if err = t.spool.write(s.dir, "tail", content); err != nil {
+			return err
+		}
+	}
+	for i, f := range files {
+		f.offset = offsets[i]
+	}
+	// rotated files read to the end are closed
+	var draining []*tailFile
+	for _, f := range s.draining {
+		if size, err := fileSize(f.f); err == nil && f.offset < size {
+			draining = append(draining, f)
+			continue
+		}
+		_ = f.f.Close()
+	}
+	s.draining = draining
+	return nil
+}
+
+// match returns the paths of the files matching the source paths and globs
+func (s *tailSource) match() map[string]bool {
+	matched := map[string]bool{}
+	for _, pattern := range s.settings.Paths {
+		paths, _ := filepath.Glob(Abs(pattern))
+		for _, path := range paths {
+			if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+				matched[path] = true
+			}
+		}
+	}
+	return matched
+}
+
+// open starts following a file, from its checkpoint if it has one
+// a file renamed by a rotation to a name the source also matches is followed from where it was
+func (t *Tailer) open(s *tailSource, path string, startup bool) (*tailFile, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	for i, f := range s.draining {
+		if os.SameFile(info, f.info) {
+			s.draining = append(s.draining[:i], s.draining[i+1:]...)
+			f.path = path
+			return f, nil
+		}
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	f := &tailFile{path: path, f: file, info: info, size: info.Size(), grownAt: time.Now()}
+	if cp, exists := t.checkpoints[path]; exists && cp.Id == fileId(info) && cp.Offset <= info.Size() {
+		f.offset = cp.Offset
+	} else if startup && !s.settings.FromStart {
+		f.offset = info.Size()
+	}
+	return f, nil
+}
+
+// read returns the complete entries written to a file since its offset and the offset after them
+// the last entry is kept for the next poll if more lines might still be appended to it, unless the file is
+// rotated or has not grown for a while
+func (s *tailSource) read(f *tailFile, rotated bool) ([]tailRecord, int64, error) {
+	size, err := fileSize(f.f)
+	if err != nil {
+		return nil, f.offset, err
+	}
+	if size < f.offset {
+		// the file was truncated, e.g. rotated using copytruncate
+		logFor("telemetry").Info().Str("path", f.path).Msg("log file truncated, reading it from the start")
+		f.offset = 0
+	}
+	if size != f.size {
+		f.size = size
+		f.grownAt = time.Now()
+	}
+	if size == f.offset {
+		return nil, f.offset, nil
+	}
+	idle := rotated || time.Since(f.grownAt) > tailIdleTimeout
+	limit := int64(CurrentSettings().Telemetry.BatchBytes)
+	if size-f.offset < limit {
+		limit = size - f.offset
+	}
+	buf := make([]byte, limit)
+	n, err := f.f.ReadAt(buf, f.offset)
+	if err != nil && err != io.EOF {
+		return nil, f.offset, err
+	}
+	if n == 0 {
+		// the file shrank since its size was read, the offset is reset in the next poll
+		return nil, f.offset, nil
+	}
+	buf = buf[:n]
+	eof := f.offset+int64(n) >= size
+	end := bytes.LastIndexByte(buf, '\n') + 1
+	if end == 0 {
+		// waits for the end of the line, unless it is longer than a batch or will not be terminated
+		if eof && !idle {
+			return nil, f.offset, nil
+		}
+		end = n
+	}
+	type entry struct {
+		lines []string
+		end   int
+	}
+	var entries []entry
+	for start := 0; start < end; {
+		next := bytes.IndexByte(buf[start:end], '\n')
+		if next < 0 {
+			next = end
+		} else {
+			next += start + 1
+		}
+		line := string(bytes.TrimRight(buf[start:next], "\r\n"))
+		if s.multiline == nil || len(entries) == 0 || s.multiline.MatchString(line) {
+			entries = append(entries, entry{lines: []string{line}, end: next})
+		} else {
+			last := &entries[len(entries)-1]
+			last.lines = append(last.lines, line)
+			last.end = next
+		}
+		start = next
+	}
+	// the last entry may continue in lines not written or not read yet
+	if s.multiline != nil && !idle && len(entries) > 1 {
+		entries = entries[:len(entries)-1]
+	} else if s.multiline != nil && !idle && eof {
+		return nil, f.offset, nil
+	}
+	if len(entries) == 0 {
+		return nil, f.offset, nil
+	}
+	observed := time.Now()
+	records := make([]tailRecord, 0, len(entries))
+	for _, e := range entries {
+		records = append(records, tailRecord{path: f.path, body: strings.Join(e.lines, "\n"), observed: observed})
+	}
+	return records, f.offset + int64(entries[len(entries)-1].end), nil
+}
+
+// saveCheckpoints persists the offsets of the followed files
+func (t *Tailer) saveCheckpoints() {
+	if len(t.checkpointFile) == 0 {
+		return
+	}
+	checkpoints := map[string]tailCheckpoint{}
+	for _, s := range t.sources {
+		for path, f := range s.files {
+			checkpoints[path] = tailCheckpoint{Id: fileId(f.info), Offset: f.offset}
+		}
+	}
+	content, err := json.Marshal(checkpoints)
+	if err != nil {
+		return
+	}
+	if bytes.Equal(content, t.lastCheckpoints) {
+		return
+	}
+	if err = writeFile(t.checkpointFile, content); err != nil {
+		logFor("telemetry").Error().Err(err).Msg("cannot save tail checkpoints")
+		return
+	}
+	t.checkpoints = checkpoints
+	t.lastCheckpoints = content
+}
+
+// marshalTailRecords converts log entries to OTLP JSON
+func marshalTailRecords(records []tailRecord) ([]byte, error) {
+	logs := plog.NewLogs()
+	rl := logs.ResourceLogs().AppendEmpty()
+	res := rl.Resource().Attributes()
+	if hostname, err := os.Hostname(); err == nil {
+		res.PutStr("host.name", hostname)
+	}
+	if A != nil {
+		res.PutStr("host.id", A.HostUUID)
+	}
+	sl := rl.ScopeLogs().AppendEmpty()
+	sl.Scope().SetName("southwinds.dev/piloth/tail")
+	for _, r := range records {
+		lr := sl.LogRecords().AppendEmpty()
+		lr.SetObservedTimestamp(pcommon.NewTimestampFromTime(r.observed))
+		lr.Body().SetStr(r.body)
+		lr.Attributes().PutStr("log.file.path", r.path)
+		lr.Attributes().PutStr("log.file.name", filepath.Base(r.path))
+	}
+	content, err := (&plog.JSONMarshaler{}).MarshalLogs(logs)
+	if err != nil {
+		return nil, fmt.Errorf("cannot marshal log entries: %s", err)
+	}
+	return content, nil
+}
+
+func fileSize(f *os.File) (int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func mapValues(files map[string]*tailFile) []*tailFile {
+	values := make([]*tailFile, 0, len(files))
+	for _, f := range files {
+		values = append(values, f)
+	}
+	return values
+}
@@ -0,0 +1,138 @@
+/*
+   Pilot Host Controller
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"go.opentelemetry.io/collector/pdata/plog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTailer(t *testing.T) {
+	dir := t.TempDir()
+	logFile := filepath.Join(dir, "app.log")
+	checkpoints := filepath.Join(dir, "tail.json")
+	channel := filepath.Join(dir, "telemetry", "logs", "app")
+	_ = os.MkdirAll(channel, dirPerm)
+	_ = os.WriteFile(logFile, []byte("0 written before pilot started\n"), filePerm)
+	appendLog := func(path, content string) {
+		f, _ := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, filePerm)
+		_, _ = f.WriteString(content)
+		_ = f.Close()
+	}
+	// returns the entries shipped to the channel since the last call
+	shipped := func() string {
+		var bodies []string
+		files, _ := getFiles(channel)
+		for _, f := range files {
+			content, _ := os.ReadFile(filepath.Join(channel, f.Name()))
+			logs, err := (&plog.JSONUnmarshaler{}).UnmarshalLogs(content)
+			if err != nil {
+				t.Fatal(err)
+			}
+			records := logs.ResourceLogs().At(0).ScopeLogs().At(0).LogRecords()
+			for i := 0; i < records.Len(); i++ {
+				bodies = append(bodies, records.At(i).Body().Str())
+			}
+			_ = os.Remove(filepath.Join(channel, f.Name()))
+		}
+		return strings.Join(bodies, "|")
+	}
+	source := TailSettings{Paths: []string{filepath.Join(dir, "*.log")}, Channel: "app", Multiline: `^\d`}
+	tailer, err := NewTailer([]TailSettings{source}, filepath.Join(dir, "telemetry"), checkpoints, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// existing content is skipped
+	tailer.poll(true)
+	if got := shipped(); got != "" {
+		t.Fatalf("unexpected entries %q", got)
+	}
+	// the last entry waits for continuation lines
+	appendLog(logFile, "1 first\n  continued\n2 second\n")
+	tailer.poll(false)
+	if got := shipped(); got != "1 first\n  continued" {
+		t.Fatalf("unexpected entries %q", got)
+	}
+	// a rotated file is read to the end before the new file
+	_ = os.Rename(logFile, logFile+".1")
+	appendLog(logFile, "3 third\n")
+	tailer.poll(false)
+	if got := shipped(); got != "2 second" {
+		t.Fatalf("unexpected entries %q", got)
+	}
+	tailer.Stop()
+	// a restarted tailer resumes from the checkpoint
+	tailer, err = NewTailer([]TailSettings{source}, filepath.Join(dir, "telemetry"), checkpoints, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tailer.poll(true)
+	// the last entry is shipped once the file stops growing
+	tailer.sources[0].files[logFile].grownAt = time.Now().Add(-time.Minute)
+	tailer.poll(false)
+	if got := shipped(); got != "3 third" {
+		t.Fatalf("unexpected entries %q", got)
+	}
+	tailer.Stop()
+}
+
+func TestTailerTruncation(t *testing.T) {
+	dir := t.TempDir()
+	logFile := filepath.Join(dir, "app.log")
+	_ = os.WriteFile(logFile, []byte("first entry\nsecond entry\n"), filePerm)
+	source := TailSettings{Paths: []string{logFile}, Channel: "app", FromStart: true}
+	tailer, err := NewTailer([]TailSettings{source}, filepath.Join(dir, "telemetry"), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tailer.Stop()
+	s := tailer.sources[0]
+	f, err := tailer.open(s, logFile, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, offset, err := s.read(f, false)
+	if err != nil || len(records) != 2 {
+		t.Fatalf("expected 2 entries, got %d: %v", len(records), err)
+	}
+	f.offset = offset
+	// a file truncated in place, e.g. by copytruncate, is read from the start
+	_ = os.WriteFile(logFile, []byte("new\n"), filePerm)
+	records, offset, err = s.read(f, false)
+	if err != nil || len(records) != 1 || records[0].body != "new" || offset != 4 {
+		t.Fatalf("expected the new entry, got %v at %d: %v", records, offset, err)
+	}
+	// a file that shrinks after its size is read has nothing to read at the offset
+	sysFile := "/sys/kernel/mm/transparent_hugepage/enabled"
+	sf, err := os.Open(sysFile)
+	if err != nil {
+		t.Skipf("cannot open %s: %s", sysFile, err)
+	}
+	defer sf.Close()
+	// sysfs files report a size larger than their content
+	shrunk := &tailFile{path: sysFile, f: sf, offset: 100, grownAt: time.Now().Add(-time.Minute)}
+	records, offset, err = s.read(shrunk, true)
+	if err != nil || len(records) != 0 || offset != 100 {
+		t.Fatalf("expected no entries at the same offset, got %v at %d: %v", records, offset, err)
+	}
+}
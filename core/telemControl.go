@@ -20,70 +20,291 @@ package core
 
 import (
 	"fmt"
-	"log"
+	"github.com/fsnotify/fsnotify"
 	"os"
 	"path/filepath"
 	"sort"
-	"southwinds.dev/artisan/core"
+	"strings"
+	"sync"
+	"time"
 )
 
+// the telemetry types, each with a folder of channels under the telemetry path
+var telemTypes = []string{"metrics", "logs"}
+
+// the folder under the telemetry path where the files that cannot be uploaded are moved, by type and channel
+const telemQuarantineDir = "quarantine"
+
+// TelemCtl uploads the files written to the channel folders under the telemetry path, with a processor per channel
+// channel folders are watched, so that processors are started and stopped as channels are created and removed, and
+// are notified as soon as new files are written
 type TelemCtl struct {
-	logsChannels    []string
-	metricsChannels []string
+	// the telemetry path
+	path string
+	api  *PilotCtl
+	// the processors of the current channels, keyed by channel folder
+	processors map[string]*Processor
+	mu         sync.Mutex
+	// watches the type and channel folders
+	w *fsnotify.Watcher
+	// samples host metrics, if enabled
+	hostMetrics *HostCollector
+	// receives telemetry pushed by local applications, if enabled
+	otlp *OTLPReceiver
+	// follows log files, if any tail source is set
+	tailer *Tailer
+	// follows the systemd journal, if enabled
+	journal *JournalReader
+	// enforces the quotas of the channel folders
+	spool *Spool
+	// where events are raised, no events are raised if nil
+	state *StateDir
+	quit  chan struct{}
 }
 
-func NewTelemCtl() (*TelemCtl, error) {
+func NewTelemCtl(state *StateDir) (*TelemCtl, error) {
 	var err error
-	path := os.Getenv("PILOT_CTL_TELEM_PATH")
-	if len(path) == 0 {
-		log.Printf("missing PILOT_CTL_TELEM_PATH variable, reading telemetry data from default path at ./telemetry\n")
-		path = "telemetry"
-	} else {
-		log.Printf("reading telemetry data from %s\n", path)
-	}
+	path := CurrentSettings().Paths.Telemetry
+	logFor("telemetry").Info().Str("path", path).Msg("reading telemetry data")
 	path, _ = filepath.Abs(path)
-
-	// get the logs channels
-	logsPath := filepath.Join(path, "logs")
-	var logsChannels []string
-	if _, err = os.Stat(logsPath); os.IsNotExist(err) {
-		core.InfoLogger.Printf("logs path %s not found, skipping logs publication")
-	} else {
-		logsChannels, err = ls(logsPath, true)
-		if err != nil {
+	// the type folders are created, so that channels created later are found
+	for _, telemType := range telemTypes {
+		if err = ensureDir(filepath.Join(path, telemType)); err != nil {
+			return nil, fmt.Errorf("cannot create telemetry folder: %s", err)
+		}
+	}
+	spool := NewSpool(path, CurrentSettings().Telemetry.Spool, state)
+	// the channels written by pilot are created, so that they are found as any other channel
+	var hostMetrics *HostCollector
+	if hm := CurrentSettings().Telemetry.HostMetrics; hm.Enabled {
+		channelPath := filepath.Join(path, "metrics", hm.Channel)
+		if err = ensureDir(channelPath); err != nil {
+			return nil, fmt.Errorf("cannot create host metrics channel: %s", err)
+		}
+		hostMetrics = NewHostCollector(channelPath, hm.Interval.Duration(), spool)
+	}
+	var otlp *OTLPReceiver
+	if o := CurrentSettings().Telemetry.OTLP; o.Enabled {
+		otlp = NewOTLPReceiver(filepath.Join(path, "metrics", o.Channel), filepath.Join(path, "logs", o.Channel), o, spool)
+		for _, channelPath := range []string{otlp.metricsPath, otlp.logsPath} {
+			if err = ensureDir(channelPath); err != nil {
+				return nil, fmt.Errorf("cannot create OTLP receiver channel: %s", err)
+			}
+		}
+	}
+	var tailer *Tailer
+	if tail := CurrentSettings().Telemetry.Tail; len(tail) > 0 {
+		for _, source := range tail {
+			if err = ensureDir(filepath.Join(path, "logs", source.Channel)); err != nil {
+				return nil, fmt.Errorf("cannot create tail channel: %s", err)
+			}
+		}
+		var checkpoints string
+		if state != nil {
+			if err = ensureDir(state.Checkpoints("")); err != nil {
+				return nil, fmt.Errorf("cannot create checkpoints folder: %s", err)
+			}
+			checkpoints = state.Checkpoints("tail.json")
+		}
+		if tailer, err = NewTailer(tail, path, checkpoints, spool); err != nil {
 			return nil, err
 		}
 	}
-	// get the metrics channels
-	metricsPath := filepath.Join(path, "metrics")
-	var metricsChannels []string
-	if _, err = os.Stat(metricsPath); os.IsNotExist(err) {
-		core.InfoLogger.Printf("metrics path %s not found, skipping metrics publication")
-	} else {
-		metricsChannels, err = ls(metricsPath, true)
-		if err != nil {
+	var journal *JournalReader
+	if j := CurrentSettings().Telemetry.Journal; j.Enabled {
+		channelPath := filepath.Join(path, "logs", j.Channel)
+		if j.Output == JournalOutputLogs {
+			if err = ensureDir(channelPath); err != nil {
+				return nil, fmt.Errorf("cannot create journal channel: %s", err)
+			}
+		}
+		if journal, err = NewJournalReader(j, channelPath, state, spool); err != nil {
 			return nil, err
 		}
 	}
-
+	// the type folders are watched for channels, the channel folders are added as they are found, see sync
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("cannot watch telemetry folder: %s", err)
+	}
+	for _, telemType := range telemTypes {
+		if err = w.Add(filepath.Join(path, telemType)); err != nil {
+			w.Close()
+			return nil, fmt.Errorf("cannot watch telemetry folder: %s", err)
+		}
+	}
 	return &TelemCtl{
-		logsChannels:    logsChannels,
-		metricsChannels: metricsChannels,
+		path:        path,
+		processors:  map[string]*Processor{},
+		w:           w,
+		hostMetrics: hostMetrics,
+		otlp:        otlp,
+		tailer:      tailer,
+		journal:     journal,
+		spool:       spool,
+		state:       state,
+		quit:        make(chan struct{}),
 	}, nil
 }
 
 func (t *TelemCtl) Start(api *PilotCtl) error {
-	for _, mChannel := range t.metricsChannels {
-		p, _ := NewProcessor(mChannel, api, "metrics")
-		p.Start()
+	t.api = api
+	if err := t.sync(); err != nil {
+		return err
+	}
+	go t.watch()
+	go t.spool.run(t.quit)
+	if t.hostMetrics != nil {
+		t.hostMetrics.Start()
+	}
+	if t.tailer != nil {
+		t.tailer.Start()
+	}
+	if t.journal != nil {
+		t.journal.Start()
+	}
+	if t.otlp != nil {
+		if err := t.otlp.Start(); err != nil {
+			ErrorLogger.Printf("cannot start OTLP receiver: %s\n", err)
+			t.otlp = nil
+		}
+	}
+	return nil
+}
+
+// watch reacts to changes in the type and channel folders
+func (t *TelemCtl) watch() {
+	for {
+		select {
+		case event, ok := <-t.w.Events:
+			if !ok {
+				return
+			}
+			if filepath.Dir(filepath.Dir(event.Name)) == t.path {
+				// a channel folder was created, removed or renamed
+				if event.Op&(fsnotify.Create|fsnotify.Remove|fsnotify.Rename) != 0 {
+					if err := t.sync(); err != nil {
+						ErrorLogger.Printf("%s\n", err)
+					}
+				}
+				continue
+			}
+			// telemetry files are written under a hidden name and renamed when complete
+			if event.Op&(fsnotify.Create|fsnotify.Write) == 0 || strings.HasPrefix(filepath.Base(event.Name), ".") {
+				continue
+			}
+			// a file was written to a channel, wakes up its processor
+			t.mu.Lock()
+			p := t.processors[filepath.Dir(event.Name)]
+			t.mu.Unlock()
+			if p != nil {
+				p.Notify()
+			}
+		case err, ok := <-t.w.Errors:
+			if !ok {
+				return
+			}
+			WarningLogger.Printf("telemetry folder watch: %s\n", err)
+		}
+	}
+}
+
+// sync starts a processor for each new channel folder and stops the processors of removed channel folders,
+// watching the folders of the running processors
+func (t *TelemCtl) sync() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	channels := map[string]string{}
+	for _, telemType := range telemTypes {
+		paths, err := ls(filepath.Join(t.path, telemType), true)
+		if err != nil {
+			return err
+		}
+		for _, channelPath := range paths {
+			channels[channelPath] = telemType
+		}
 	}
-	for _, mChannel := range t.logsChannels {
-		p, _ := NewProcessor(mChannel, api, "logs")
+	for channelPath, p := range t.processors {
+		if _, exists := channels[channelPath]; !exists {
+			logFor("telemetry").Info().Str("type", p.telemType).Str("channel", filepath.Base(channelPath)).Msg("channel removed")
+			p.Stop()
+			// the watch of a removed folder is already gone
+			_ = t.w.Remove(channelPath)
+			delete(t.processors, channelPath)
+		}
+	}
+	for channelPath, telemType := range channels {
+		if _, exists := t.processors[channelPath]; exists {
+			continue
+		}
+		p, err := NewProcessor(channelPath, t.api, telemType, t.state)
+		if err != nil {
+			return fmt.Errorf("cannot start %s channel %s: %s", telemType, filepath.Base(channelPath), err)
+		}
+		// without a watch, the processor still checks its folder periodically
+		if err = t.w.Add(channelPath); err != nil {
+			logFor("telemetry").Warn().Err(err).Str("channel", filepath.Base(channelPath)).Msg("cannot watch channel folder")
+		}
+		logFor("telemetry").Info().Str("type", telemType).Str("channel", filepath.Base(channelPath)).Msg("channel found")
 		p.Start()
+		t.processors[channelPath] = p
 	}
 	return nil
 }
 
+// Backlog returns the number of files waiting to be submitted and the health of each channel
+func (t *TelemCtl) Backlog() []ChannelStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var channels []ChannelStatus
+	for _, p := range t.processors {
+		files, _ := getFiles(p.path)
+		health, lastErr, restarts := p.Health()
+		channels = append(channels, ChannelStatus{
+			Type:        p.telemType,
+			Channel:     filepath.Base(p.path),
+			Path:        p.path,
+			Backlog:     len(files),
+			Health:      health,
+			Error:       lastErr,
+			Restarts:    restarts,
+			Quarantined: p.Quarantined(),
+		})
+	}
+	sort.Slice(channels, func(i, j int) bool {
+		return channels[i].Path < channels[j].Path
+	})
+	return channels
+}
+
+// Stop stops the processors of all channels
+func (t *TelemCtl) Stop() {
+	t.w.Close()
+	close(t.quit)
+	t.mu.Lock()
+	for _, p := range t.processors {
+		p.Stop()
+	}
+	t.processors = map[string]*Processor{}
+	t.mu.Unlock()
+	if t.hostMetrics != nil {
+		t.hostMetrics.Stop()
+		t.hostMetrics = nil
+	}
+	if t.otlp != nil {
+		t.otlp.Stop()
+		t.otlp = nil
+	}
+	if t.tailer != nil {
+		t.tailer.Stop()
+		t.tailer = nil
+	}
+	if t.journal != nil {
+		t.journal.Stop()
+		t.journal = nil
+	}
+}
+
 // ls returns a list of file or folder names ordered by mod time
 func ls(dirname string, isDir bool) ([]string, error) {
 	// read entries from folder
@@ -91,19 +312,25 @@ func ls(dirname string, isDir bool) ([]string, error) {
 	if err != nil {
 		return nil, fmt.Errorf("cannot read telemetry entries: %s", err)
 	}
-	// sort the file slice by ModTime()
-	// ensuring the oldest file is processed first
-	sort.Slice(entries, func(i, j int) bool {
-		ii, _ := entries[i].Info()
-		jj, _ := entries[j].Info()
-		return ii.ModTime().UnixNano() <= jj.ModTime().UnixNano()
-	})
 	result := make([]string, 0)
+	modTimes := map[string]time.Time{}
 	for _, entry := range entries {
-		if isDir == entry.IsDir() {
-			abs := filepath.Join(dirname, entry.Name())
-			result = append(result, abs)
+		if isDir != entry.IsDir() {
+			continue
 		}
+		info, err := entry.Info()
+		if err != nil {
+			// the entry was removed in the meantime
+			continue
+		}
+		abs := filepath.Join(dirname, entry.Name())
+		result = append(result, abs)
+		modTimes[abs] = info.ModTime()
 	}
+	// sort the entries by modification time
+	// ensuring the oldest file is processed first
+	sort.SliceStable(result, func(i, j int) bool {
+		return modTimes[result[i]].Before(modTimes[result[j]])
+	})
 	return result, nil
 }
@@ -0,0 +1,72 @@
+/*
+   Pilot Host Controller
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileSpanExporter(t *testing.T) {
+	state := NewStateDir(t.TempDir())
+	s := DefaultSettings()
+	s.Tracing.Exporter = TraceExporterFile
+	stop, err := StartTracing(s, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, span := startSpan(context.Background(), "job.run", attrJobId.Int64(42))
+	req, _ := http.NewRequest(http.MethodPost, "http://localhost/ping", nil)
+	injectTrace(ctx, req)
+	endSpan(span, errors.New("job failed"))
+	if len(req.Header.Get("traceparent")) == 0 {
+		t.Fatalf("trace context not propagated in request headers")
+	}
+	if !strings.Contains(req.Header.Get("traceparent"), span.SpanContext().TraceID().String()) {
+		t.Fatalf("unexpected traceparent %s", req.Header.Get("traceparent"))
+	}
+	if err = stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(filepath.Join(state.Trace(), "spans.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{`"Name":"job.run"`, `"pilot.job.id"`, `"job failed"`} {
+		if !strings.Contains(string(b), expected) {
+			t.Fatalf("exported span does not contain %s: %s", expected, b)
+		}
+	}
+}
+
+func TestTracingDisabled(t *testing.T) {
+	s := DefaultSettings()
+	if _, err := StartTracing(s, NewStateDir(t.TempDir())); err != nil {
+		t.Fatal(err)
+	}
+	s.Tracing.Exporter = "jaeger"
+	if err := s.Validate(); err == nil || !strings.Contains(err.Error(), "tracing.exporter") {
+		t.Fatalf("expected an invalid exporter error, got %v", err)
+	}
+}
@@ -0,0 +1,81 @@
+/*
+   Pilot Host Controller
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"fmt"
+	"os"
+)
+
+// openKey verifies the signature of user or activation key data and returns the decrypted content
+//
+//	keyFormatPGP: the signature is checked against the configured trust anchor and the data decrypted with the
+//	              tenant private key, both provisioned at install time
+//	keyFormatLegacy: compatibility path for keys issued before the migration, requires PILOT_LEGACY_KEY
+func openKey(format int, data, signature string) (string, error) {
+	switch format {
+	case keyFormatPGP:
+		return openPGPKey(data, signature)
+	case keyFormatLegacy:
+		WarningLogger.Printf("reading key in legacy format, a key in the new format should be requested from pilot control\n")
+		return openLegacyKey(data, signature)
+	}
+	return "", fmt.Errorf("unsupported key format %d", format)
+}
+
+func openPGPKey(data, signature string) (string, error) {
+	anchor, err := os.ReadFile(TrustAnchorFile())
+	if err != nil {
+		return "", fmt.Errorf("cannot read trust anchor: %s", err)
+	}
+	if err = verifyKeySignature(data, signature, string(anchor)); err != nil {
+		return "", fmt.Errorf("signature verification failed: %s", err)
+	}
+	tenant, err := LoadPGP(TenantKeyFile(), os.Getenv(PilotTenantKeyPwd.String()))
+	if err != nil {
+		return "", fmt.Errorf("cannot load tenant key: %s", err)
+	}
+	if !tenant.HasPrivate() {
+		return "", fmt.Errorf("tenant key should be private, public key found")
+	}
+	plain, err := tenant.Decrypt([]byte(data))
+	if err != nil {
+		return "", fmt.Errorf("cannot decrypt key data: %s", err)
+	}
+	return string(plain), nil
+}
+
+func openLegacyKey(data, signature string) (string, error) {
+	keys, err := loadLegacyKeys()
+	if err != nil {
+		return "", err
+	}
+	pub, err := decrypt(keys.SK, keys.Pub, keys.IV)
+	if err != nil {
+		return "", fmt.Errorf("cannot decrypt legacy public PGP key: %s", err)
+	}
+	if err = verifyKeySignature(data, signature, pub); err != nil {
+		return "", fmt.Errorf("signature verification failed: %s", err)
+	}
+	plain, err := decrypt(keys.SK, data, keys.IV)
+	if err != nil {
+		return "", fmt.Errorf("cannot decrypt key data: %s", err)
+	}
+	return plain, nil
+}
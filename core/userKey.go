@@ -31,6 +31,8 @@ import (
 type userKey struct {
 	Key       userKeyString `json:"uk"`
 	Signature string        `json:"s"`
+	// Format the format used to protect the key data, zero if the key was issued in the legacy format
+	Format int `json:"f,omitempty"`
 }
 
 type userKeyString string
@@ -44,7 +46,6 @@ type userKeyInfo struct {
 }
 
 func loadUserKey(path string) (*userKey, error) {
-	defer TRA(CE())
 	if len(path) == 0 {
 		path = ".userkey"
 	}
@@ -67,15 +68,10 @@ func loadUserKey(path string) (*userKey, error) {
 
 // readUserKey read the content of an encoded user key and verifies its digital signature
 func readUserKey(key userKey) (*userKeyInfo, error) {
-	defer TRA(CE())
-	// check the validity of the key's digital signature
-	if valid, err := verify(string(key.Key), key.Signature); !valid {
-		return nil, fmt.Errorf("invalid user key signature: %s\n", err)
-	}
-	// decrypt the key information
-	d, err := decrypt(sk, string(key.Key), iv)
+	// check the validity of the key's digital signature and decrypt the key information
+	d, err := openKey(key.Format, string(key.Key), key.Signature)
 	if err != nil {
-		return nil, fmt.Errorf("cannot decrypt user key data: %s\n", err)
+		return nil, fmt.Errorf("cannot open user key: %s\n", err)
 	}
 	db, err := hex.DecodeString(d[:])
 	if err != nil {
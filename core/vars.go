@@ -18,20 +18,47 @@
 
 package core
 
-import "encoding/hex"
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
 
-var (
-	sk  = "819da5fa6489428f9b95780d5f5d740d651b50e21c99b33101eceeb37a5c8850"
-	iv  = "f9e02e9fce1a498a34b08e67"
-	pub = "233937abe973e03080d18ab92bec0c37c9c113368464fb21c89ec3fcba1ce960dccc9be75c08fe563fdb114d609d42b44ab932e28ea1946a668a8de768f1fc7602c0d84cd4d37ad4d23d3cae721baeeadb232815d0ed1eb220ccd6138f401e5b4f3dde5f27b6fb2a2f2d1ced788ca69a1e68614409fdec6b12252130330689ca3112a3635701eeaad96a0cf0f54d6c12a6a1e687b9ebc4f20f5d19e99c9d61bdab2f87a26b28b99de92d8c4118437cf6360487217d8c51095217db8242e98b6423936e25c14f362dd2e24e3db44db0de1953604d345614ca9dece830dafa3f15af7893c622edd125ac53a5f57c0bed98356bdb4e4d5b61f65e16963dfd9b412853c01a93fd441ecd1ad4c3debbb8da94e72dbaad24217fbe1124ebe42bb87ba84feb732981e8f6c1f3a3d870f57a9bdc3a4418f354b35b67bd19e6f14a0dc7794d7e1144374e3b5370516cf3c41aadf22dd0426724b3e91031dee9f7a8263467661277bc067ee1ff26060f2ae90e9b4af7dd97a8ab7c14b08a1c6b2d80f6bc8bf3e24d9de3ca607ea08b62e5a0cf2c92282f9e2e9356e691e652f7e10fdc0f8140d37a6d110b021f1af1ddbc1f4c8cf6111ab2155578ecc4376f7f3f7996a111459e7215933d922519907f68d77a9b1d45d4bd7d7fb4dd46f06af1dfc3e5111a9c6edad48ee19a014ed4cd194ddc60f42b0b3fd3d037c7aa301cc2225ce0de9749cf5cac08038104270021c489d9e0000073157c04b69102f40a6d8f550df3fb5b7a416ea0a87b626367c54c3a761cb54f09fe062de4981b5e5a8fd22e88306aaf9ce73e6145b8698466e1fac570c9f38e3d200f573d192f2af756eaf39698860c85a2a2fae800ae5b30cff37cf472e56313ab64d9f698e53c093375c1364f09c52d93751dbefa0ecfc269ec10f0253f29fd1232114ceea8f77928bde96bfcb6391a8b58c92b5953d36d8ac07da1fae142e28a99cd7773e60594a69c64686f3a087bcc630e6803c7da70e5721ab640a00ec934b2d8a5cdc617480d59e8c6f47890401972a22e98a426b4954be7032d3b4d8942525cb3b0b696b22593abcd9b71e8d0cf777d97c54a52e332f7e6a67e26cc44219da75b1b2c6700d1080c4744dc8bd931b71e39c25c6e831a416095a5d0f36cfbc0375a043dc23cfc92eb54a6ebf6af083b52f52d200ad23d21b64f80ad9d583043f78810eff3ccffe8a8e6731b365c512b375b32b9300214672eeffdd2754cb14e7456a7d3c90ec8b1f97171bb881a86e3d5686437dbc0b76dfe99f95460b565a4724da8f5cc1e4aef3d8ee1d2de3686cb70229e0bec322fffa03f6fa1859ed56437e72f748521205839bbfa3c9864fb652842c3b5d704ddfe9b7c6acedda0abc2fc4803772a6f3c98dd463fd2e5e6f964e4bdee725c3e17e0f3bfe39f370e91c4888bbb13303b8027b952b435916dca45130beac777c20e2dcd2a6cc1cdb8947dba6217bc92bac91faad48a6d4aa0fea1a2f9549a4f657fef5f5765f3d44f7d9ace4cb38fb4911d2986318ccd8a60556487dfd3c99183cffc80c2012b82b1ed424e9b5b8a9c82a6bfeb15ed0e0f9cdc25e62ff6bebccbe7ae3151c85669fcaf24b7def65942af6d3fe46306b1f53e3df8b95fd95cfd7f9c466fc46c206e5376ade39e8be00e62e67112054a83a29208e1711960a847a508d6cb703b8db9856aa380c12bbce5ccbb9aa962407f234454620e20c11ed69786796e7df54ef79ebc3a52e52ac6629b0892b8a52e183f9892be573e09e569965aeb9b237d61b491cb3a5116baf400f885c4298abee7404c09caafe9f0d5e193d8cc6d4c8ebf7febc8869c9db1bf82688b774bb216478857728a2e8183f2d0ba7ee766d4f7fe2b9412a136c1b97fc75e6596394eac583d3802ba62246b4a9d23ae840b4e24ddd46fa5f158e6d2bffca0d85b40e8c9eef084fdf30debf6358651d76ccf80a723c492ab3aba7c484709e784e669c5110ea26c1cdc7b69772aa99adda15567c52713110bded9dec85a42d11d11efef59fde2f98f3783a918f34aff3994e8b79309760b87e614df3830e1dc2455bae5e6f20690a891eae4fe6223f3316d567c2311ba47fefc73f611847d75b1c7dd4fb41d61cbd7e92c880f3814f6476c58edc448eb3aa706d53c9f167b66441878e74fb38cbc2280220caa3cf639ff2bea72362c099c06f6416d4dccd21a2481836baeba27dbbae77e3e41bce2bd8038910d309814d6a2176d12442242dfe86822d58de182553abb529cb7604add5416effaeff33811fabb9d390bf828f440295a8127480a0b4fa00844ee567dc6df019df2318ff9540a6e01a081f3c56296c15ff2500aeec4208091c27474bb9f56b2a29c56943d3720023b1b375c424e836e669cc9455d7a688e710066c2bfc970694f29bcaefbd38ac3be19f835c8b2dbd9b5840b6bfc6322f6b9f2e49ee3eb664640116a00d8d1ea3a186348d46c7d41df0ecdb42472ff10bb84be01c7acb43cf42b5ec16bd84a021d77e15602f6e5a24d56987901dcc3066161262d6dbf0bd306735314cd77cb1d03d668b963ee7b3864de0a8b0f2c6f6e48d1ec240e42b52e820bf34ba176e1365b639e20ead54b85e9f6e5c68970e33786f4fce6b4b670295973f8932dd21b08927c5398eff020edd64dcc5e9d2d440e3b6b93adb107e5078784e5b6816eef3264aaf7903a823ecbcbca380c8fa5b80b060e6b65316242de9ed6f87498be6c5d669ea08cd77a3016c85fb8954b3256a2c12f35c5c9343ff51de7085ed604e90f1a09768bde501a2aa294fd76b486e410c5978c4bec44431b382e8a2104bed023b3530195dc3c473216112948d4f3d5efacee2be55502998e4786511856ac0aa437eed5704cbc2c14be"
+// key formats used by user and activation keys
+const (
+	// keyFormatLegacy key data encrypted with the symmetric key shared by all tenants (pre-migration keys)
+	keyFormatLegacy = iota
+	// keyFormatPGP key data encrypted with the tenant PGP public key and signed with the trust anchor private key
+	keyFormatPGP
 )
 
-func skb() []byte {
-	d, _ := hex.DecodeString(sk)
-	return d
+// legacyKeys the key material used by earlier pilot releases to protect user and activation keys
+// it is no longer embedded in the binary, during migration it can be provided in a file referenced by PILOT_LEGACY_KEY
+type legacyKeys struct {
+	// hex encoded AES-256 key
+	SK string `json:"sk"`
+	// hex encoded GCM nonce
+	IV string `json:"iv"`
+	// hex encoded, AES encrypted, armored PGP public key used to verify legacy key signatures
+	Pub string `json:"pub"`
 }
 
-func ivb() []byte {
-	d, _ := hex.DecodeString(iv)
-	return d
+// loadLegacyKeys loads the legacy key material required to read keys issued before the migration
+func loadLegacyKeys() (*legacyKeys, error) {
+	path := LegacyKeyFile()
+	if len(path) == 0 {
+		return nil, fmt.Errorf("key was issued in the legacy format, set %s to read it or ask for a key in the new format", PilotLegacyKey)
+	}
+	b, err := os.ReadFile(Abs(path))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read legacy key file: %s", err)
+	}
+	keys := new(legacyKeys)
+	if err = json.Unmarshal(b, keys); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal legacy key file: %s", err)
+	}
+	if len(keys.SK) == 0 || len(keys.IV) == 0 || len(keys.Pub) == 0 {
+		return nil, fmt.Errorf("legacy key file %s is incomplete", path)
+	}
+	return keys, nil
 }
@@ -0,0 +1,165 @@
+/*
+   Pilot Host Controller
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// signature algorithms pilot can verify
+const (
+	// SigAlgPGP detached, armored OpenPGP signature
+	SigAlgPGP = "pgp"
+	// SigAlgEd25519 raw 64-byte Ed25519 signature
+	SigAlgEd25519 = "ed25519"
+)
+
+// canonicalisation methods used to produce the digest that is signed
+const (
+	// CanonIndent sha256 of the object serialised by Go's encoding/json and indented with two spaces
+	// kept for compatibility with existing control planes, it depends on Go field ordering
+	CanonIndent = "indent"
+	// CanonJCS sha256 of the RFC 8785 canonical JSON of the object, independent of the implementation language
+	CanonJCS = "jcs"
+)
+
+// SupportedSignatures the signature formats pilot accepts, in order of preference
+// they are advertised at registration so that pilot control can choose the one to use
+var SupportedSignatures = []string{
+	SigAlgEd25519 + "/" + CanonJCS,
+	SigAlgPGP + "/" + CanonJCS,
+	SigAlgPGP + "/" + CanonIndent,
+}
+
+// Signature a signature and the way it was produced
+//
+//	the string form is "<alg>/<canon>:<base64 signature>", e.g. "ed25519/jcs:3q2+7w=="
+//	a string without a prefix is a legacy signature, i.e. a base64 encoded PGP signature over the indent digest
+type Signature struct {
+	Alg   string
+	Canon string
+	Value []byte
+}
+
+// ParseSignature parses the string form of a signature
+func ParseSignature(s string) (*Signature, error) {
+	alg, canon, value := SigAlgPGP, CanonIndent, s
+	// base64 does not use colons, so a colon separates the format prefix
+	if ix := strings.Index(s, ":"); ix > 0 {
+		parts := strings.Split(s[:ix], "/")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid signature format '%s'", s[:ix])
+		}
+		alg, canon, value = parts[0], parts[1], s[ix+1:]
+	}
+	if !supportedSignature(alg, canon) {
+		return nil, fmt.Errorf("unsupported signature format '%s/%s'", alg, canon)
+	}
+	v, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode signature string '%s': %s", value, err)
+	}
+	return &Signature{Alg: alg, Canon: canon, Value: v}, nil
+}
+
+// String returns the string form of the signature, legacy signatures are written without prefix
+func (s Signature) String() string {
+	value := base64.StdEncoding.EncodeToString(s.Value)
+	if s.Alg == SigAlgPGP && s.Canon == CanonIndent {
+		return value
+	}
+	return fmt.Sprintf("%s/%s:%s", s.Alg, s.Canon, value)
+}
+
+// Digest returns the sha256 digest of the object using the specified canonicalisation
+func Digest(canon string, obj interface{}) ([]byte, error) {
+	switch canon {
+	case CanonIndent:
+		return checksum(obj)
+	case CanonJCS:
+		b, err := canonicalJSON(obj)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(b)
+		return sum[:], nil
+	}
+	return nil, fmt.Errorf("unsupported canonicalisation '%s'", canon)
+}
+
+// Verify checks the signature of an object sent by pilot control against the verification keys valid now
+// more than one key might be valid during a key rotation overlap period, any of them can verify the signature
+func Verify(obj interface{}, signature string) error {
+	_, err := VerifySigner(obj, signature)
+	return err
+}
+
+// VerifySigner checks the signature like Verify and returns the fingerprint of the key that verified it
+func VerifySigner(obj interface{}, signature string) (string, error) {
+	keys, err := trustedKeysAt(time.Now())
+	if err != nil {
+		return "", fmt.Errorf("verify => cannot load host verification keys: %s", err)
+	}
+	key, err := verifyWith(keys, obj, signature)
+	if err != nil {
+		return "", err
+	}
+	return key.Fingerprint(), nil
+}
+
+// VerifyWith checks the signature of an object against the specified keys
+func VerifyWith(keys []VerifyKey, obj interface{}, signature string) error {
+	_, err := verifyWith(keys, obj, signature)
+	return err
+}
+
+func verifyWith(keys []VerifyKey, obj interface{}, signature string) (*VerifyKey, error) {
+	sig, err := ParseSignature(signature)
+	if err != nil {
+		return nil, fmt.Errorf("verify => %s", err)
+	}
+	digest, err := Digest(sig.Canon, obj)
+	if err != nil {
+		return nil, fmt.Errorf("verify => cannot calculate digest: %s", err)
+	}
+	err = fmt.Errorf("verify => no %s verification key available", sig.Alg)
+	for i, key := range keys {
+		if key.alg() != sig.Alg {
+			continue
+		}
+		if err = key.verify(digest, sig.Value); err == nil {
+			return &keys[i], nil
+		}
+		err = fmt.Errorf("verify => %s", err)
+	}
+	return nil, err
+}
+
+func supportedSignature(alg, canon string) bool {
+	for _, s := range SupportedSignatures {
+		if s == alg+"/"+canon {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,279 @@
+/*
+   Pilot Host Controller
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// VerifyKey a pilot control public key trusted to verify the signature of the commands sent to the host
+type VerifyKey struct {
+	// the armored PGP public key, or the base64 encoded raw public key if the algorithm is ed25519
+	Key string `json:"key"`
+	// the signature algorithm the key is used with, pgp if not specified
+	Alg string `json:"alg,omitempty"`
+	// the time from which the key is valid, zero means valid since the key was received
+	NotBefore time.Time `json:"not_before,omitempty"`
+	// the time after which the key is no longer valid, zero means the key does not expire
+	NotAfter time.Time `json:"not_after,omitempty"`
+	// where the key came from, i.e. activation key or rotation
+	Source string `json:"source,omitempty"`
+}
+
+// ValidAt true if the key can be used to verify signatures at the specified time
+func (k VerifyKey) ValidAt(t time.Time) bool {
+	return (k.NotBefore.IsZero() || !t.Before(k.NotBefore)) && (k.NotAfter.IsZero() || t.Before(k.NotAfter))
+}
+
+// Fingerprint returns the fingerprint of the key or an empty string if the key cannot be read
+// PGP keys use their OpenPGP fingerprint, ed25519 keys the sha256 of the raw public key
+func (k VerifyKey) Fingerprint() string {
+	switch k.alg() {
+	case SigAlgEd25519:
+		raw, err := base64.StdEncoding.DecodeString(k.Key)
+		if err != nil {
+			return ""
+		}
+		sum := sha256.Sum256(raw)
+		return strings.ToUpper(hex.EncodeToString(sum[:]))
+	default:
+		pgp, err := LoadPGPBytes([]byte(k.Key))
+		if err != nil {
+			return ""
+		}
+		return pgp.Fingerprint()
+	}
+}
+
+func (k VerifyKey) alg() string {
+	if len(k.Alg) == 0 {
+		return SigAlgPGP
+	}
+	return k.Alg
+}
+
+// validate checks the key can be used for verification
+func (k VerifyKey) validate() error {
+	switch k.alg() {
+	case SigAlgPGP:
+		pgp, err := LoadPGPBytes([]byte(k.Key))
+		if err != nil {
+			return err
+		}
+		if pgp.HasPrivate() {
+			return fmt.Errorf("verification key should be public, private key found")
+		}
+	case SigAlgEd25519:
+		raw, err := base64.StdEncoding.DecodeString(k.Key)
+		if err != nil {
+			return fmt.Errorf("cannot decode ed25519 key: %s", err)
+		}
+		if len(raw) != ed25519.PublicKeySize {
+			return fmt.Errorf("invalid ed25519 public key size %d", len(raw))
+		}
+	default:
+		return fmt.Errorf("unsupported key algorithm '%s'", k.Alg)
+	}
+	return nil
+}
+
+// verify checks the signature of the digest using the key
+func (k VerifyKey) verify(digest, sig []byte) error {
+	if err := k.validate(); err != nil {
+		return err
+	}
+	switch k.alg() {
+	case SigAlgEd25519:
+		raw, _ := base64.StdEncoding.DecodeString(k.Key)
+		if !ed25519.Verify(raw, digest, sig) {
+			return fmt.Errorf("invalid ed25519 signature")
+		}
+		return nil
+	default:
+		pgp, _ := LoadPGPBytes([]byte(k.Key))
+		return pgp.Verify(digest, sig)
+	}
+}
+
+// KeyRotation delivers new verification keys to the host
+// and can also change the validity period of existing keys, e.g. to retire a key after an overlap period
+type KeyRotation struct {
+	Keys []VerifyKey `json:"keys"`
+	Time time.Time   `json:"time"`
+}
+
+// KeyRotationEnvelope a key rotation signed by a verification key currently trusted by the host
+type KeyRotationEnvelope struct {
+	Rotation  KeyRotation `json:"rotation"`
+	Signature string      `json:"signature"`
+}
+
+// TrustedKeys returns all known verification keys, that is, the key in the activation key
+// followed by any key received via rotation; a rotated entry for the activation key overrides its validity period
+func TrustedKeys() ([]VerifyKey, error) {
+	var keys []VerifyKey
+	if A != nil && len(A.VerifyKey) > 0 {
+		keys = append(keys, VerifyKey{Key: A.VerifyKey, Source: "activation"})
+	}
+	rotated, err := loadRotatedKeys()
+	if err != nil {
+		return nil, err
+	}
+	return mergeKeys(keys, rotated), nil
+}
+
+// trustedKeysAt returns the verification keys valid at the specified time
+func trustedKeysAt(t time.Time) ([]VerifyKey, error) {
+	keys, err := TrustedKeys()
+	if err != nil {
+		return nil, err
+	}
+	var valid []VerifyKey
+	for _, key := range keys {
+		if key.ValidAt(t) {
+			valid = append(valid, key)
+		}
+	}
+	if len(valid) == 0 {
+		return nil, fmt.Errorf("no valid verification key found")
+	}
+	return valid, nil
+}
+
+// applyKeyRotation verifies the rotation envelope with a currently valid key and persists the new key set
+// only rotations newer than the last one applied are accepted, so that an older signed envelope cannot be replayed
+// to restore the validity of a retired key
+func applyKeyRotation(env KeyRotationEnvelope) (bool, error) {
+	if err := Verify(env.Rotation, env.Signature); err != nil {
+		return false, fmt.Errorf("cannot trust key rotation: %s", err)
+	}
+	if env.Rotation.Time.IsZero() {
+		return false, fmt.Errorf("key rotation has no time")
+	}
+	last, err := loadRotationTime()
+	if err != nil {
+		return false, err
+	}
+	if env.Rotation.Time.Equal(last) {
+		// pilot control keeps serving the last rotation until there is a new one
+		return false, nil
+	}
+	if env.Rotation.Time.Before(last) {
+		return false, fmt.Errorf("key rotation of %s is older than the last rotation applied on %s", env.Rotation.Time.Format(time.RFC3339), last.Format(time.RFC3339))
+	}
+	for _, key := range env.Rotation.Keys {
+		if err := key.validate(); err != nil {
+			return false, fmt.Errorf("invalid key in rotation: %s", err)
+		}
+	}
+	current, err := loadRotatedKeys()
+	if err != nil {
+		return false, err
+	}
+	// the signed envelope is left untouched
+	keys := append([]VerifyKey{}, env.Rotation.Keys...)
+	for i := range keys {
+		keys[i].Source = "rotation"
+	}
+	merged := mergeKeys(current, keys)
+	updated := !sameKeys(current, merged)
+	if updated {
+		if err = saveRotatedKeys(merged); err != nil {
+			return false, err
+		}
+	}
+	return updated, saveRotationTime(env.Rotation.Time)
+}
+
+// mergeKeys adds or updates keys by fingerprint preserving the original order
+func mergeKeys(keys []VerifyKey, updates []VerifyKey) []VerifyKey {
+	result := append([]VerifyKey{}, keys...)
+	for _, update := range updates {
+		found := false
+		for i, key := range result {
+			if key.Fingerprint() == update.Fingerprint() {
+				result[i].NotBefore = update.NotBefore
+				result[i].NotAfter = update.NotAfter
+				found = true
+				break
+			}
+		}
+		if !found {
+			result = append(result, update)
+		}
+	}
+	return result
+}
+
+func sameKeys(a, b []VerifyKey) bool {
+	ab, _ := json.Marshal(a)
+	bb, _ := json.Marshal(b)
+	return string(ab) == string(bb)
+}
+
+func loadRotatedKeys() ([]VerifyKey, error) {
+	b, err := os.ReadFile(VerifyKeysFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("cannot read verification keys: %s", err)
+	}
+	var keys []VerifyKey
+	if err = json.Unmarshal(b, &keys); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal verification keys: %s", err)
+	}
+	return keys, nil
+}
+
+// loadRotationTime returns the time of the last key rotation applied, or the zero time if none was applied
+func loadRotationTime() (time.Time, error) {
+	b, err := os.ReadFile(KeyRotationFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return time.Time{}, nil
+		}
+		return time.Time{}, fmt.Errorf("cannot read last key rotation time: %s", err)
+	}
+	t, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(string(b)))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("cannot parse last key rotation time: %s", err)
+	}
+	return t, nil
+}
+
+func saveRotationTime(t time.Time) error {
+	return writeFile(KeyRotationFile(), []byte(t.UTC().Format(time.RFC3339Nano)))
+}
+
+func saveRotatedKeys(keys []VerifyKey) error {
+	b, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return fmt.Errorf("cannot marshal verification keys: %s", err)
+	}
+	return writeFile(VerifyKeysFile(), b)
+}
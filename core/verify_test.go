@@ -0,0 +1,174 @@
+/*
+   Pilot Host Controller
+   Copyright (C) 2022-Present SouthWinds Tech Ltd - www.southwinds.io
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signatureVectors cross-implementation test vectors for canonical JSON and ed25519/jcs signatures
+// the same file can be used to test pilot control or any other implementation
+type signatureVectors struct {
+	PublicKey string `json:"public_key"`
+	Vectors   []struct {
+		Name      string `json:"name"`
+		Input     string `json:"input"`
+		Canonical string `json:"canonical"`
+		Digest    string `json:"digest"`
+		Signature string `json:"signature"`
+	} `json:"vectors"`
+}
+
+func loadSignatureVectors(t *testing.T) signatureVectors {
+	b, err := os.ReadFile("testdata/signature_vectors.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v signatureVectors
+	if err = json.Unmarshal(b, &v); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestCanonicalJSON(t *testing.T) {
+	for _, v := range loadSignatureVectors(t).Vectors {
+		c, err := canonicalise([]byte(v.Input))
+		if err != nil {
+			t.Fatalf("%s: %s", v.Name, err)
+		}
+		if string(c) != v.Canonical {
+			t.Fatalf("%s: expected %s, got %s", v.Name, v.Canonical, c)
+		}
+		d, err := Digest(CanonJCS, json.RawMessage(v.Input))
+		if err != nil {
+			t.Fatalf("%s: %s", v.Name, err)
+		}
+		if hex.EncodeToString(d) != v.Digest {
+			t.Fatalf("%s: expected digest %s, got %x", v.Name, v.Digest, d)
+		}
+	}
+}
+
+func TestVerifyEd25519(t *testing.T) {
+	vectors := loadSignatureVectors(t)
+	keys := []VerifyKey{{Key: vectors.PublicKey, Alg: SigAlgEd25519}}
+	for _, v := range vectors.Vectors {
+		if err := VerifyWith(keys, json.RawMessage(v.Input), v.Signature); err != nil {
+			t.Fatalf("%s: %s", v.Name, err)
+		}
+		// the signature of one vector must not verify another
+		if err := VerifyWith(keys, json.RawMessage(`{"tampered":true}`), v.Signature); err == nil {
+			t.Fatalf("%s: tampered object verified", v.Name)
+		}
+	}
+}
+
+func TestParseSignature(t *testing.T) {
+	sig, err := ParseSignature("c2ln")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sig.Alg != SigAlgPGP || sig.Canon != CanonIndent || sig.String() != "c2ln" {
+		t.Fatalf("unexpected legacy signature %+v", sig)
+	}
+	sig, err = ParseSignature("ed25519/jcs:c2ln")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sig.Alg != SigAlgEd25519 || sig.Canon != CanonJCS || sig.String() != "ed25519/jcs:c2ln" {
+		t.Fatalf("unexpected signature %+v", sig)
+	}
+	if _, err = ParseSignature("rsa/jcs:c2ln"); err == nil {
+		t.Fatal("unsupported algorithm accepted")
+	}
+}
+
+func TestKeyRotationReplay(t *testing.T) {
+	t.Setenv(PilotCfgPath.String(), t.TempDir())
+	activation := A
+	A = nil
+	defer func() { A = activation }()
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	signer := VerifyKey{Key: base64.StdEncoding.EncodeToString(pub), Alg: SigAlgEd25519}
+	retired, _, _ := ed25519.GenerateKey(rand.Reader)
+	old := VerifyKey{Key: base64.StdEncoding.EncodeToString(retired), Alg: SigAlgEd25519}
+	if err := saveRotatedKeys([]VerifyKey{signer}); err != nil {
+		t.Fatal(err)
+	}
+	envelope := func(rotation KeyRotation) KeyRotationEnvelope {
+		digest, err := Digest(CanonJCS, rotation)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig := Signature{Alg: SigAlgEd25519, Canon: CanonJCS, Value: ed25519.Sign(priv, digest)}
+		return KeyRotationEnvelope{Rotation: rotation, Signature: sig.String()}
+	}
+	now := time.Now().UTC()
+	// a key is added, then retired by a later rotation
+	added := envelope(KeyRotation{Keys: []VerifyKey{old}, Time: now.Add(-time.Hour)})
+	if updated, err := applyKeyRotation(added); err != nil || !updated {
+		t.Fatalf("rotation not applied: %v", err)
+	}
+	old.NotAfter = now.Add(-time.Minute)
+	retire := envelope(KeyRotation{Keys: []VerifyKey{old}, Time: now})
+	if updated, err := applyKeyRotation(retire); err != nil || !updated {
+		t.Fatalf("retirement not applied: %v", err)
+	}
+	// the current rotation served again is not an error
+	if updated, err := applyKeyRotation(retire); err != nil || updated {
+		t.Fatalf("current rotation applied again: %v", err)
+	}
+	// replaying the older rotation must not restore the retired key
+	if _, err := applyKeyRotation(added); err == nil {
+		t.Fatal("older key rotation accepted")
+	}
+	keys, _ := loadRotatedKeys()
+	if len(keys) != 2 || keys[1].NotAfter.IsZero() {
+		t.Fatalf("retired key restored: %+v", keys)
+	}
+}
+
+func TestSignVerify(t *testing.T) {
+	key, err := NewPGP("host", "", "", 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, _ := key.PublicKey()
+	obj := map[string]interface{}{"b": 1, "a": "x"}
+	sig, err := sign(key, obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// host signatures use the same canonical form as the signatures pilot verifies
+	if !strings.HasPrefix(sig, SigAlgPGP+"/"+CanonJCS+":") {
+		t.Fatalf("unexpected signature format %s", sig)
+	}
+	if err = VerifyWith([]VerifyKey{{Key: string(pub)}}, obj, sig); err != nil {
+		t.Fatal(err)
+	}
+}
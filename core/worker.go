@@ -29,6 +29,7 @@ import (
 	"southwinds.dev/artisan/merge"
 	ctl "southwinds.dev/pilotctl/types"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -59,30 +60,41 @@ type Worker struct {
 	run Runnable
 	// syslog writer
 	logs *syslog.Writer
+	// checks the authenticity of a job before it is executed, no check is done if nil
+	verify func(job *Job) error
+	// the folder where jobs and results are queued
+	state *StateDir
+	// the job being executed, if any
+	running   *RunningJob
+	runningMu sync.RWMutex
+	// the number of consecutive rejected job files that could neither be quarantined nor removed
+	rejectFailures int
 }
 
 // NewWorker create new worker using the specified runnable function
 // Runnable: the function that processes each job
-func NewWorker(run Runnable) *Worker {
-	defer TRA(CE())
+// State: the folder where jobs and results are queued
+func NewWorker(state *StateDir, run Runnable) *Worker {
 	ctx, cancel := context.WithCancel(context.Background())
 	return &Worker{
 		status: stopped,
 		ctx:    ctx,
 		cancel: cancel,
 		run:    run,
+		state:  state,
 	}
 }
 
 // NewCmdRequestWorker create a new worker to process pilotctl command requests
-func NewCmdRequestWorker() *Worker {
-	defer TRA(CE())
-	return NewWorker(run)
+// jobs are verified against the trusted pilot control keys before they are executed
+func NewCmdRequestWorker(state *StateDir) *Worker {
+	w := NewWorker(state, run)
+	w.verify = verifyJob
+	return w
 }
 
 // Start starts the worker execution loop
 func (w *Worker) Start() {
-	defer TRA(CE())
 	// if the worker is stopped then it can start
 	if w.status == stopped {
 		// changes the
@@ -91,7 +103,16 @@ func (w *Worker) Start() {
 		go func() {
 			for {
 				// peek the next job to be processed
-				job, err := peekJob()
+				peekStart := time.Now()
+				job, err := peekJob(w.state)
+				// the peek is only recorded if it found a job or failed, as an idle worker peeks every few seconds
+				if job != nil || err != nil {
+					_, span := startSpanAt(context.Background(), "job.peek", peekStart)
+					if job != nil && job.cmd != nil {
+						span.SetAttributes(attrJobId.Int64(job.cmd.JobId))
+					}
+					endSpan(span, err)
+				}
 				// if it can't peek the next job, it must consider it as a failure as, if not, pilot could
 				// continue to repeat the failure forever
 				if err != nil {
@@ -105,10 +126,10 @@ func (w *Worker) Start() {
 						// if a Job Id is known
 						if job.cmd != nil && job.cmd.JobId > 0 {
 							// send the error result for that job
-							sendResult(job.cmd.JobId, "", errorMsg)
+							w.sendResult(job.cmd.JobId, "", errorMsg)
 						} else {
 							// if no Job could be found, remove the job from the local queue to avoid retrying over and over
-							err = os.Remove(processDir(job.file.Name()))
+							err = os.Remove(w.state.Process(job.file.Name()))
 							// and write to syslog
 							if err == nil {
 								SyslogWriter.Err(fmt.Sprintf("forcedly removed file %s from local queue, due to being unable to read it to avoid retrying\n", err))
@@ -118,28 +139,60 @@ func (w *Worker) Start() {
 					// restart the loop to avoid retrying execution all over
 					continue
 				}
+				// reject jobs that cannot be proven to come from pilot control
+				if job != nil && w.verify != nil {
+					if err = w.verify(job); err != nil {
+						w.reject(job, err)
+						continue
+					}
+					audit(AuditPolicy, map[string]interface{}{
+						"job_id":   job.cmd.JobId,
+						"decision": "accept",
+					})
+				}
 				// if the worker is ready to process a job and there are jobs waiting to start
 				if w.status == ready && job != nil {
 					// set the worker as busy
 					w.status = busy
-					InfoLogger.Printf("starting job %d, %s -> %s", job.cmd.JobId, job.cmd.Package, job.cmd.Function)
-					// dump env vars if in debug mode
+					logFor("worker").Info().Int64("job_id", job.cmd.JobId).Str("package", job.cmd.Package).Str("function", job.cmd.Function).Msg("starting job")
+					// dump env vars if in debug mode, values encrypted by pilot control are still encrypted
 					w.debug(job.cmd.PrintEnv())
-					// execute the job
-					out, runErr := w.run(*job.cmd)
+					// decrypt the registry credentials in memory just before execution
+					cmd, runErr := openCmd(*job.cmd)
+					var out string
+					if runErr == nil {
+						// execute the job
+						started := time.Now()
+						w.setRunning(&RunningJob{JobId: job.cmd.JobId, Package: job.cmd.Package, Function: job.cmd.Function, Started: started})
+						_, span := startSpan(context.Background(), "job.run",
+							attrJobId.Int64(job.cmd.JobId),
+							attrJobPackage.String(job.cmd.Package),
+							attrJobFunction.String(job.cmd.Function))
+						out, runErr = w.run(cmd)
+						endSpan(span, runErr)
+						w.setRunning(nil)
+						jobDuration.WithLabelValues(resultLabel(runErr)).Observe(time.Since(started).Seconds())
+					}
+					jobsTotal.WithLabelValues(resultLabel(runErr)).Inc()
 					if runErr != nil {
-						InfoLogger.Printf("job %d, %s -> %s failed: %s", job.cmd.JobId, job.cmd.Package, job.cmd.Function, mask(runErr.Error(), job.cmd.User, job.cmd.Pwd))
+						logFor("worker").Error().Int64("job_id", job.cmd.JobId).Str("package", job.cmd.Package).Str("function", job.cmd.Function).Str("error", mask(runErr.Error(), cmd.User, cmd.Pwd)).Msg("job failed")
 					} else {
-						InfoLogger.Printf("job %d, %s -> %s succeeded", job.cmd.JobId, job.cmd.Package, job.cmd.Function)
+						logFor("worker").Info().Int64("job_id", job.cmd.JobId).Str("package", job.cmd.Package).Str("function", job.cmd.Function).Msg("job succeeded")
 					}
+					audit(AuditExecution, map[string]interface{}{
+						"job_id":   job.cmd.JobId,
+						"package":  job.cmd.Package,
+						"function": job.cmd.Function,
+						"success":  runErr == nil,
+					})
 					// check for an error
 					var errorMsg string
 					if runErr != nil {
 						// build an error message masking registry credentials
-						errorMsg = mask(runErr.Error(), job.cmd.User, job.cmd.Pwd)
+						errorMsg = mask(runErr.Error(), cmd.User, cmd.Pwd)
 					}
 					// send the result to control
-					sendResult(job.cmd.JobId, out, errorMsg)
+					w.sendResult(job.cmd.JobId, out, errorMsg)
 					w.status = ready
 				} else {
 					// if no jobs wait for a little while until more jobs are available
@@ -152,16 +205,27 @@ func (w *Worker) Start() {
 	}
 }
 
+// Running returns the job being executed or nil if the worker is idle
+func (w *Worker) Running() *RunningJob {
+	w.runningMu.RLock()
+	defer w.runningMu.RUnlock()
+	return w.running
+}
+
+func (w *Worker) setRunning(job *RunningJob) {
+	w.runningMu.Lock()
+	defer w.runningMu.Unlock()
+	w.running = job
+}
+
 // Stop stops the worker execution loop
 func (w *Worker) Stop() {
-	defer TRA(CE())
 	w.cancel()
 	w.status = stopped
 }
 
 func (w *Worker) Jobs() int {
-	defer TRA(CE())
-	dir := processDir("")
+	dir := w.state.Process("")
 	files, err := ioutil.ReadDir(dir)
 	if err != nil {
 		panic(fmt.Sprintf("cannot read directory: %s", err))
@@ -175,23 +239,68 @@ func (w *Worker) Jobs() int {
 	return count
 }
 
-// AddJob add a new job for processing to the worker
+// AddJob add a new unsigned job for processing to the worker
+// a worker created with NewCmdRequestWorker rejects unsigned jobs, use AddSignedJob instead
 func (w *Worker) AddJob(job ctl.CmdInfo) {
-	defer TRA(CE())
-	err := addJob(Job{cmd: &job})
+	err := addJob(w.state, Job{cmd: &job})
+	if err != nil {
+		ErrorLogger.Printf("cannot write job to process queue: %s\n", err)
+	}
+}
+
+// AddSignedJob add the job in a verified pilot control response to the worker, keeping its signature
+func (w *Worker) AddSignedJob(resp ctl.PingResponse) {
+	job, err := newSignedJob(resp)
+	if err == nil {
+		err = addJob(w.state, *job)
+	}
 	if err != nil {
 		ErrorLogger.Printf("cannot write job to process queue: %s\n", err)
 	}
 }
 
+// reject quarantines a job that failed verification and raises a security event
+func (w *Worker) reject(job *Job, reason error) {
+	var jobId int64
+	if job.cmd != nil {
+		jobId = job.cmd.JobId
+	}
+	logFor("worker").Error().Int64("job_id", jobId).Str("file", job.file.Name()).AnErr("reason", reason).Msg("rejecting job file, it cannot be verified")
+	jobsTotal.WithLabelValues("rejected").Inc()
+	if err := quarantineJob(w.state, job); err != nil {
+		ErrorLogger.Printf("%s\n", err)
+		// remove it to avoid executing it in any case
+		if err = os.Remove(w.state.Process(job.file.Name())); err != nil && !os.IsNotExist(err) {
+			// the job file stays in the queue and is peeked again, backs off instead of rejecting it in a tight loop
+			w.rejectFailures++
+			wait := backoffTime(w.rejectFailures + 1)
+			logFor("worker").Error().Int64("job_id", jobId).Str("file", job.file.Name()).Err(err).Msgf("cannot remove job file that failed verification, retrying in %v", wait)
+			if w.rejectFailures == 1 {
+				raiseEvent(w.state, SevError, "security", "job file '%s' (job #%d) failed verification and cannot be quarantined or removed: %s", job.file.Name(), jobId, reason)
+			}
+			select {
+			case <-w.ctx.Done():
+			case <-time.After(wait):
+			}
+			return
+		}
+	}
+	w.rejectFailures = 0
+	raiseEvent(w.state, SevError, "security", "job file '%s' (job #%d) failed verification and was quarantined: %s", job.file.Name(), jobId, reason)
+	audit(AuditPolicy, map[string]interface{}{
+		"job_id":   jobId,
+		"file":     job.file.Name(),
+		"decision": "reject",
+		"reason":   reason.Error(),
+	})
+}
+
 // Result returns the next
 func (w *Worker) Result() (*ctl.JobResult, error) {
-	defer TRA(CE())
-	return peekJobResult()
+	return peekJobResult(w.state)
 }
 
 func run(data interface{}) (string, error) {
-	defer TRA(CE())
 	// unbox the data
 	cmd, ok := data.(ctl.CmdInfo)
 	if !ok {
@@ -204,8 +313,12 @@ func run(data interface{}) (string, error) {
 	)
 	// get the variables in the host environment
 	hostEnv := merge.NewEnVarFromSlice(os.Environ())
-	// get the variables in the command
-	cmdEnv := merge.NewEnVarFromSlice(cmd.Env())
+	// get the variables in the command, decrypting any value encrypted by pilot control
+	env, err := openEnv(cmd.Env())
+	if err != nil {
+		return "", err
+	}
+	cmdEnv := merge.NewEnVarFromSlice(env)
 	// if the execution is containerised
 	if cmd.Containerised {
 		// use the exec command instead
@@ -227,26 +340,22 @@ func run(data interface{}) (string, error) {
 }
 
 func (w *Worker) debug(msg string, a ...interface{}) {
-	defer TRA(CE())
-	if len(os.Getenv("PILOT_DEBUG")) > 0 {
+	if IsDebug() {
 		DebugLogger.Printf(fmt.Sprintf("DEBUG: %s", msg), a...)
 	}
 }
 
 func (w *Worker) RemoveResult(result *ctl.JobResult) error {
-	defer TRA(CE())
-	return removeJobResult(*result)
+	return removeJobResult(w.state, *result)
 }
 
 func mask(value, user, pwd string) string {
-	defer TRA(CE())
 	str := strings.Replace(value, user, "****", -1)
 	str = strings.Replace(str, pwd, "xxxx", -1)
 	return str
 }
 
-func sendResult(jobId int64, log, errorMsg string) {
-	defer TRA(CE())
+func (w *Worker) sendResult(jobId int64, log, errorMsg string) {
 	result := &ctl.JobResult{
 		JobId:   jobId,
 		Success: len(errorMsg) == 0,
@@ -255,7 +364,7 @@ func sendResult(jobId int64, log, errorMsg string) {
 		Time:    time.Now(),
 	}
 	// add the last result to the submit queue
-	err := submitJobResult(*result)
+	err := submitJobResult(w.state, *result)
 	// if the job result could not be saved
 	if err != nil {
 		// writes an error to Syslog, and do nothing
@@ -265,7 +374,7 @@ func sendResult(jobId int64, log, errorMsg string) {
 		SyslogWriter.Err(fmt.Sprintf("cannot persist result for Job Id = %d: %s\n", jobId, err))
 	}
 	// remove job from the queue
-	err = removeJob(jobId)
+	err = removeJob(w.state, jobId)
 	// if the job could not be removed
 	if err != nil {
 		// writes an error to Syslog, and do nothing else
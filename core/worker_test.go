@@ -22,6 +22,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 	"southwinds.dev/artisan/data"
 	"southwinds.dev/pilotctl/types"
 	"testing"
@@ -30,9 +31,12 @@ import (
 
 // test the worker
 func TestWorker(t *testing.T) {
-	os.Setenv("PILOT_HOME", "../")
+	// jobs and results are written encrypted
+	useTestDataKey()
+	state := NewStateDir("../data")
 	// create a new job processing worker
 	w := NewWorker(
+		state,
 		// define the processing logic
 		func(data interface{}) (string, error) {
 			// unbox the data
@@ -74,7 +78,7 @@ func TestWorker(t *testing.T) {
 	)
 	for count < results {
 		// attempt to retrieve the next result
-		r, _ := peekJobResult()
+		r, _ := peekJobResult(state)
 		if r != nil {
 			count++
 			status := func() string {
@@ -84,7 +88,7 @@ func TestWorker(t *testing.T) {
 				return "failed"
 			}()
 			if status == "successful" {
-				removeJobResult(*r)
+				removeJobResult(state, *r)
 			}
 			log.Printf("result for job %d: %s\n", r.JobId, status)
 		} else {
@@ -93,3 +97,21 @@ func TestWorker(t *testing.T) {
 		}
 	}
 }
+
+func TestWorkerRejectBackoff(t *testing.T) {
+	state := NewStateDir(t.TempDir())
+	_ = ensureDir(state.Submit(""))
+	// the job file can neither be quarantined nor removed
+	_ = os.WriteFile(state.Quarantine(""), []byte{}, filePerm)
+	_ = os.MkdirAll(filepath.Join(state.Process("job_1.job"), "x"), dirPerm)
+	info, _ := os.Stat(state.Process("job_1.job"))
+	w := NewWorker(state, nil)
+	started := time.Now()
+	w.reject(&Job{file: info}, fmt.Errorf("invalid signature"))
+	if w.rejectFailures != 1 || time.Since(started) < time.Second {
+		t.Fatalf("worker did not back off, %d failure(s) after %v", w.rejectFailures, time.Since(started))
+	}
+	if events := countFiles(state.Submit(""), ".ev"); events != 1 {
+		t.Fatalf("expected a single event, got %d", events)
+	}
+}